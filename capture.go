@@ -0,0 +1,334 @@
+package link
+
+// Link traffic can be captured to a pcapng file, which wireshark and
+// friends can open, and fed back into a Link later for debugging.
+//
+// Every frame sent or received becomes an enhanced packet block holding
+// the raw bytes as they crossed the wire, delimiter included. The
+// direction is recorded in the epb_flags option and whether the frame
+// decoded in an opt_comment. The interface uses LINKTYPE_USER0 since
+// there is no registered link type for this protocol.
+
+import (
+	"bytes"
+	"encoding/binary"
+	"errors"
+	"fmt"
+	"io"
+	"log/slog"
+	"sync"
+	"time"
+)
+
+// Direction says which way a captured frame was travelling.
+type Direction int
+
+const (
+	Inbound Direction = iota
+	Outbound
+)
+
+func (d Direction) String() string {
+	if d == Inbound {
+		return "in"
+	}
+	return "out"
+}
+
+// CaptureRecord is a single captured frame.
+type CaptureRecord struct {
+	Time      time.Time
+	Direction Direction
+	// The raw bytes read or written, including the delimiter.
+	Frame []byte
+	// How the frame decoded, "ok" or the decode error.
+	Comment string
+}
+
+const (
+	pcapngSectionHeader     = 0x0A0D0D0A
+	pcapngInterfaceDesc     = 0x00000001
+	pcapngEnhancedPacket    = 0x00000006
+	pcapngByteOrderMagic    = 0x1A2B3C4D
+	pcapngLinkTypeUser0     = 147
+	pcapngOptEnd            = 0
+	pcapngOptComment        = 1
+	pcapngOptEPBFlags       = 2
+	pcapngOptIfTsresol      = 9
+	pcapngFlagInbound       = 1
+	pcapngFlagOutbound      = 2
+	pcapngFlagDirectionMask = 3
+)
+
+// captureWriter writes frames to a pcapng stream. It is safe for
+// concurrent use. After the first write error it logs once and stops
+// capturing, a broken capture file should not take the link down.
+type captureWriter struct {
+	lock sync.Mutex
+	w    io.Writer
+	err  error
+}
+
+// newCaptureWriter starts the capture with the pcapng headers. If they
+// can't be written the failure is logged to log and nothing is captured.
+func newCaptureWriter(w io.Writer, log *slog.Logger) *captureWriter {
+	cw := &captureWriter{w: w}
+	var b bytes.Buffer
+	// Section header, little endian, unknown section length.
+	pcapngBlock(&b, pcapngSectionHeader, func(body *bytes.Buffer) {
+		binary.Write(body, binary.LittleEndian, uint32(pcapngByteOrderMagic))
+		binary.Write(body, binary.LittleEndian, uint16(1))
+		binary.Write(body, binary.LittleEndian, uint16(0))
+		binary.Write(body, binary.LittleEndian, int64(-1))
+	})
+	// A single interface with nanosecond timestamps.
+	pcapngBlock(&b, pcapngInterfaceDesc, func(body *bytes.Buffer) {
+		binary.Write(body, binary.LittleEndian, uint16(pcapngLinkTypeUser0))
+		binary.Write(body, binary.LittleEndian, uint16(0))
+		binary.Write(body, binary.LittleEndian, uint32(0))
+		pcapngOption(body, pcapngOptIfTsresol, []byte{9})
+		pcapngOption(body, pcapngOptEnd, nil)
+	})
+	_, cw.err = w.Write(b.Bytes())
+	if cw.err != nil {
+		log.Warn("capture failed, no frames will be captured", "err", cw.err)
+	}
+	return cw
+}
+
+// write records a frame, returning an error only the first time writing
+// to the capture fails.
+func (cw *captureWriter) write(rec CaptureRecord) error {
+	var b bytes.Buffer
+	pcapngBlock(&b, pcapngEnhancedPacket, func(body *bytes.Buffer) {
+		ts := uint64(rec.Time.UnixNano())
+		binary.Write(body, binary.LittleEndian, uint32(0))
+		binary.Write(body, binary.LittleEndian, uint32(ts>>32))
+		binary.Write(body, binary.LittleEndian, uint32(ts))
+		binary.Write(body, binary.LittleEndian, uint32(len(rec.Frame)))
+		binary.Write(body, binary.LittleEndian, uint32(len(rec.Frame)))
+		body.Write(rec.Frame)
+		pcapngPad(body)
+		flags := make([]byte, 4)
+		if rec.Direction == Inbound {
+			binary.LittleEndian.PutUint32(flags, pcapngFlagInbound)
+		} else {
+			binary.LittleEndian.PutUint32(flags, pcapngFlagOutbound)
+		}
+		pcapngOption(body, pcapngOptEPBFlags, flags)
+		if rec.Comment != "" {
+			pcapngOption(body, pcapngOptComment, []byte(rec.Comment))
+		}
+		pcapngOption(body, pcapngOptEnd, nil)
+	})
+
+	cw.lock.Lock()
+	defer cw.lock.Unlock()
+	if cw.err != nil {
+		return nil
+	}
+	_, cw.err = cw.w.Write(b.Bytes())
+	return cw.err
+}
+
+// pcapngBlock appends a block of the given type with the body written
+// by f to b.
+func pcapngBlock(b *bytes.Buffer, blockType uint32, f func(body *bytes.Buffer)) {
+	var body bytes.Buffer
+	f(&body)
+	total := uint32(12 + body.Len())
+	binary.Write(b, binary.LittleEndian, blockType)
+	binary.Write(b, binary.LittleEndian, total)
+	b.Write(body.Bytes())
+	binary.Write(b, binary.LittleEndian, total)
+}
+
+func pcapngOption(b *bytes.Buffer, code uint16, value []byte) {
+	binary.Write(b, binary.LittleEndian, code)
+	binary.Write(b, binary.LittleEndian, uint16(len(value)))
+	b.Write(value)
+	pcapngPad(b)
+}
+
+// pcapngPad pads b to a multiple of 4 bytes.
+func pcapngPad(b *bytes.Buffer) {
+	for b.Len()%4 != 0 {
+		b.WriteByte(0)
+	}
+}
+
+// capture records a frame if the link is capturing.
+func (link *Link) capture(dir Direction, frame []byte, decodeErr error) {
+	if link.captureWriter == nil {
+		return
+	}
+	comment := "ok"
+	if decodeErr != nil {
+		comment = decodeErr.Error()
+	}
+	err := link.captureWriter.write(CaptureRecord{
+		Time:      link.clock.Now(),
+		Direction: dir,
+		Frame:     frame,
+		Comment:   comment,
+	})
+	if err != nil {
+		link.log.Warn("capture failed, no more frames will be captured", "err", err)
+	}
+}
+
+var errBadCapture = errors.New("not a pcapng capture written by a link")
+
+// ReadCapture reads the frames from a capture written by a link.
+func ReadCapture(r io.Reader) ([]CaptureRecord, error) {
+	var records []CaptureRecord
+	// Nanoseconds per timestamp unit, the pcapng default is microseconds.
+	tsUnit := uint64(1000)
+	first := true
+	for {
+		var hdr [8]byte
+		_, err := io.ReadFull(r, hdr[:])
+		if err == io.EOF && !first {
+			return records, nil
+		}
+		if err != nil {
+			return records, err
+		}
+		blockType := binary.LittleEndian.Uint32(hdr[0:])
+		total := binary.LittleEndian.Uint32(hdr[4:])
+		if total < 12 || total%4 != 0 {
+			return records, fmt.Errorf("bad pcapng block length %d", total)
+		}
+		body := make([]byte, total-8)
+		_, err = io.ReadFull(r, body)
+		if err != nil {
+			return records, err
+		}
+		body = body[:len(body)-4]
+
+		if first {
+			if blockType != pcapngSectionHeader || len(body) < 4 ||
+				binary.LittleEndian.Uint32(body) != pcapngByteOrderMagic {
+				return nil, errBadCapture
+			}
+			first = false
+			continue
+		}
+
+		switch blockType {
+		case pcapngInterfaceDesc:
+			if len(body) < 8 || binary.LittleEndian.Uint16(body) != pcapngLinkTypeUser0 {
+				return records, errBadCapture
+			}
+			for _, opt := range pcapngOptions(body[8:]) {
+				if opt.code == pcapngOptIfTsresol && len(opt.value) == 1 && opt.value[0] <= 9 {
+					tsUnit = 1
+					for i := opt.value[0]; i < 9; i++ {
+						tsUnit *= 10
+					}
+				}
+			}
+		case pcapngEnhancedPacket:
+			if len(body) < 20 {
+				return records, fmt.Errorf("short enhanced packet block")
+			}
+			ts := uint64(binary.LittleEndian.Uint32(body[4:]))<<32 | uint64(binary.LittleEndian.Uint32(body[8:]))
+			capLen := int(binary.LittleEndian.Uint32(body[12:]))
+			padded := (capLen + 3) &^ 3
+			if 20+padded > len(body) {
+				return records, fmt.Errorf("bad captured length %d", capLen)
+			}
+			rec := CaptureRecord{
+				Time:  time.Unix(0, int64(ts*tsUnit)),
+				Frame: append([]byte(nil), body[20:20+capLen]...),
+			}
+			for _, opt := range pcapngOptions(body[20+padded:]) {
+				switch opt.code {
+				case pcapngOptEPBFlags:
+					if len(opt.value) == 4 &&
+						binary.LittleEndian.Uint32(opt.value)&pcapngFlagDirectionMask == pcapngFlagOutbound {
+						rec.Direction = Outbound
+					}
+				case pcapngOptComment:
+					rec.Comment = string(opt.value)
+				}
+			}
+			records = append(records, rec)
+		default:
+			// Skip blocks we don't know about.
+		}
+	}
+}
+
+type pcapngOpt struct {
+	code  uint16
+	value []byte
+}
+
+func pcapngOptions(b []byte) []pcapngOpt {
+	var opts []pcapngOpt
+	for len(b) >= 4 {
+		code := binary.LittleEndian.Uint16(b)
+		length := int(binary.LittleEndian.Uint16(b[2:]))
+		if code == pcapngOptEnd || 4+length > len(b) {
+			break
+		}
+		opts = append(opts, pcapngOpt{code, b[4 : 4+length]})
+		b = b[4+(length+3)&^3:]
+	}
+	return opts
+}
+
+// NewReplayReader returns a reader producing the raw bytes of the
+// captured frames travelling in direction dir, in order.
+func NewReplayReader(records []CaptureRecord, dir Direction) io.ReadCloser {
+	var b bytes.Buffer
+	for _, rec := range records {
+		if rec.Direction == dir {
+			b.Write(rec.Frame)
+		}
+	}
+	return io.NopCloser(&b)
+}
+
+type discardCloser struct{}
+
+func (discardCloser) Write(p []byte) (int, error) {
+	return len(p), nil
+}
+
+func (discardCloser) Close() error {
+	return nil
+}
+
+// Replay creates a link that reads the inbound frames of a capture, as
+// if they were arriving again, and discards anything it sends. Combined
+// with a Logger at debug level it shows how the link handled them. Once
+// the capture is exhausted the link stays up until closed, so sessions
+// can finish handling what they were sent.
+func Replay(records []CaptureRecord, conf Config) *Link {
+	r := &heldReader{r: NewReplayReader(records, Inbound), closed: make(chan struct{})}
+	l := CreateLinkWithConfig(r, discardCloser{}, conf)
+	l.closeWhenDown(r)
+	return l
+}
+
+// heldReader blocks at the end of r until it is closed.
+type heldReader struct {
+	r         io.Reader
+	closeOnce sync.Once
+	closed    chan struct{}
+}
+
+func (h *heldReader) Read(p []byte) (int, error) {
+	n, err := h.r.Read(p)
+	if err == io.EOF {
+		<-h.closed
+	}
+	return n, err
+}
+
+func (h *heldReader) Close() error {
+	h.closeOnce.Do(func() { close(h.closed) })
+	return nil
+}
@@ -0,0 +1,298 @@
+package channelsim
+
+// This package simulates an impaired serial or radio channel.
+// A Channel wraps an io.ReadWriteCloser and damages the data read through
+// it the way a real link would: corrupted, lost, inserted and duplicated
+// bytes, bursts of errors, a limited baud rate and propagation delay.
+// Writes pass through untouched, wrap each end of a link to impair both
+// directions.
+
+import (
+	"io"
+	"math/rand"
+	"sync"
+	"time"
+)
+
+// Config describes the impairments applied to the data read through a
+// Channel. Rates are probabilities per byte, the zero value passes data
+// through untouched.
+type Config struct {
+	// Probability that a byte is replaced with a random value.
+	ByteErrorRate float64
+	// Probability that a byte is dropped.
+	LossRate float64
+	// Probability that a random garbage byte is inserted before a byte.
+	InsertRate float64
+	// Probability that a byte is delivered twice.
+	DuplicateRate float64
+	// Bursts of errors on top of ByteErrorRate, nil disables them.
+	Burst *GilbertElliott
+
+	// Bandwidth limit in baud, assuming 10 bits on the wire per byte as
+	// with 8N1 framing. Zero is unlimited.
+	BaudRate int
+	// Time between a byte leaving the sender and arriving at the reader.
+	Delay time.Duration
+
+	// Seed for the random impairments, zero picks one from the clock.
+	// Channels with the same seed damage the same input the same way,
+	// see Channel.Seed.
+	Seed int64
+	// Keep a log of every impairment applied, see Channel.Events.
+	Record bool
+	// Apply exactly the impairments in Replay instead of random ones. The
+	// rates above are ignored, timing impairments still apply. An empty
+	// Replay passes data through untouched.
+	Replaying bool
+	Replay    []Event
+}
+
+// GilbertElliott is a two state burst error model. The channel is either
+// in a good or a bad state and moves between them with the given
+// probabilities after every byte, corrupting bytes at the error rate of
+// the current state.
+type GilbertElliott struct {
+	PGoodToBad    float64
+	PBadToGood    float64
+	GoodErrorRate float64
+	BadErrorRate  float64
+}
+
+// bytes read from the wrapped channel, waiting to be delivered.
+type chunk struct {
+	data []byte
+	// When the first byte started being transmitted.
+	start time.Time
+	err   error
+}
+
+type Channel struct {
+	rwc  io.ReadWriteCloser
+	conf Config
+	seed int64
+
+	// Time it takes to transmit a single byte, zero if unlimited.
+	byteTime time.Duration
+	// Only used by the pump goroutine.
+	rng      *rand.Rand
+	bad      bool
+	busyTill time.Time
+	// Number of bytes read from rwc so far.
+	offset int64
+	// Events not yet replayed.
+	replay []Event
+
+	eventsLock sync.Mutex
+	events     []Event
+
+	chunks chan chunk
+
+	// Only used while holding readLock.
+	readLock sync.Mutex
+	pending  chunk
+	err      error
+
+	closeOnce sync.Once
+	closed    chan struct{}
+}
+
+// New returns a Channel reading from and writing to rwc.
+func New(rwc io.ReadWriteCloser, conf Config) *Channel {
+	seed := conf.Seed
+	if seed == 0 {
+		seed = time.Now().UnixNano()
+	}
+	c := &Channel{
+		rwc:    rwc,
+		conf:   conf,
+		seed:   seed,
+		rng:    rand.New(rand.NewSource(seed)),
+		replay: conf.Replay,
+		chunks: make(chan chunk, 64),
+		closed: make(chan struct{}),
+	}
+	if conf.BaudRate > 0 {
+		c.byteTime = 10 * time.Second / time.Duration(conf.BaudRate)
+	}
+	go c.pump()
+	return c
+}
+
+func (c *Channel) pump() {
+	buf := make([]byte, 4096)
+	for {
+		n, err := c.rwc.Read(buf)
+		now := time.Now()
+		if n > 0 {
+			data := c.impair(buf[:n])
+			start := now
+			if c.busyTill.After(start) {
+				start = c.busyTill
+			}
+			c.busyTill = start.Add(time.Duration(len(data)) * c.byteTime)
+			select {
+			case c.chunks <- chunk{data: data, start: start}:
+			case <-c.closed:
+				return
+			}
+		}
+		if err != nil {
+			select {
+			case c.chunks <- chunk{err: err}:
+			case <-c.closed:
+			}
+			return
+		}
+	}
+}
+
+func (c *Channel) impair(in []byte) []byte {
+	out := make([]byte, 0, len(in))
+	for _, b := range in {
+		var events []Event
+		if c.conf.Replaying {
+			events = c.replayEvents()
+		} else {
+			events = c.randomEvents(b)
+		}
+		out = applyEvents(out, b, events)
+		if c.conf.Record && len(events) != 0 {
+			c.eventsLock.Lock()
+			c.events = append(c.events, events...)
+			c.eventsLock.Unlock()
+		}
+		c.offset++
+	}
+	return out
+}
+
+// randomEvents decides how to damage the input byte b.
+func (c *Channel) randomEvents(b byte) []Event {
+	conf := &c.conf
+	var events []Event
+	errorRate := conf.ByteErrorRate
+	if ge := conf.Burst; ge != nil {
+		if c.bad {
+			if c.rng.Float64() < ge.PBadToGood {
+				c.bad = false
+			}
+		} else if c.rng.Float64() < ge.PGoodToBad {
+			c.bad = true
+		}
+		burstRate := ge.GoodErrorRate
+		if c.bad {
+			burstRate = ge.BadErrorRate
+		}
+		// Either source of errors can corrupt the byte.
+		errorRate = 1 - (1-errorRate)*(1-burstRate)
+	}
+	if c.chance(conf.InsertRate) {
+		events = append(events, Event{c.offset, Insert, byte(c.rng.Uint32())})
+	}
+	if c.chance(conf.LossRate) {
+		return append(events, Event{c.offset, Drop, 0})
+	}
+	if c.chance(errorRate) {
+		b = byte(c.rng.Uint32())
+		events = append(events, Event{c.offset, Corrupt, b})
+	}
+	if c.chance(conf.DuplicateRate) {
+		events = append(events, Event{c.offset, Duplicate, 0})
+	}
+	return events
+}
+
+func (c *Channel) chance(p float64) bool {
+	return p > 0 && c.rng.Float64() < p
+}
+
+// replayEvents returns the recorded events for the current input byte.
+func (c *Channel) replayEvents() []Event {
+	n := 0
+	for n < len(c.replay) && c.replay[n].Offset <= c.offset {
+		n++
+	}
+	events := c.replay[:n]
+	c.replay = c.replay[n:]
+	return events
+}
+
+// Seed returns the seed of the random impairments, log it so a failure
+// can be reproduced by setting Config.Seed.
+func (c *Channel) Seed() int64 {
+	return c.seed
+}
+
+// Events returns the impairments applied so far, if Config.Record is set.
+// They can be saved with WriteEvents and fed back in with Config.Replay.
+func (c *Channel) Events() []Event {
+	c.eventsLock.Lock()
+	defer c.eventsLock.Unlock()
+	return append([]Event(nil), c.events...)
+}
+
+// due returns when byte idx of ch reaches the reader.
+func (c *Channel) due(ch *chunk, idx int) time.Time {
+	return ch.start.Add(time.Duration(idx+1)*c.byteTime + c.conf.Delay)
+}
+
+// Read returns the impaired data once it has made its way across the
+// channel.
+func (c *Channel) Read(p []byte) (int, error) {
+	c.readLock.Lock()
+	defer c.readLock.Unlock()
+
+	for len(c.pending.data) == 0 {
+		if c.err != nil {
+			return 0, c.err
+		}
+		select {
+		case ch := <-c.chunks:
+			if ch.err != nil {
+				c.err = ch.err
+			}
+			c.pending = ch
+		case <-c.closed:
+			return 0, io.ErrClosedPipe
+		}
+	}
+
+	wait := time.Until(c.due(&c.pending, 0))
+	if wait > 0 {
+		timer := time.NewTimer(wait)
+		select {
+		case <-timer.C:
+		case <-c.closed:
+			timer.Stop()
+			return 0, io.ErrClosedPipe
+		}
+	}
+
+	// Deliver everything that has arrived by now.
+	now := time.Now()
+	n := 0
+	for n < len(p) && n < len(c.pending.data) && !c.due(&c.pending, n).After(now) {
+		n++
+	}
+	if n == 0 && len(p) > 0 {
+		n = 1
+	}
+	copy(p, c.pending.data[:n])
+	c.pending.data = c.pending.data[n:]
+	c.pending.start = c.pending.start.Add(time.Duration(n) * c.byteTime)
+	return n, nil
+}
+
+func (c *Channel) Write(p []byte) (int, error) {
+	return c.rwc.Write(p)
+}
+
+func (c *Channel) Close() error {
+	var err error
+	c.closeOnce.Do(func() {
+		close(c.closed)
+		err = c.rwc.Close()
+	})
+	return err
+}
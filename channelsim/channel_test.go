@@ -0,0 +1,288 @@
+package channelsim
+
+import (
+	"bytes"
+	"io"
+	"mako/serial/link/concurrentbuffer"
+	"strings"
+	"testing"
+	"time"
+)
+
+// send writes data into a fresh channel, closes the sending side and
+// returns everything read back out.
+func send(t *testing.T, conf Config, data []byte) []byte {
+	buff := concurrentbuffer.New(0)
+	c := New(buff, conf)
+	defer c.Close()
+
+	_, err := buff.Write(data)
+	if err != nil {
+		t.Fatal(err)
+	}
+	buff.Close()
+
+	out, err := io.ReadAll(c)
+	if err != nil && err != concurrentbuffer.BufferClosed {
+		t.Fatal(err)
+	}
+	return out
+}
+
+func testData() []byte {
+	data := make([]byte, 10000)
+	for idx := range data {
+		data[idx] = byte(idx)
+	}
+	return data
+}
+
+func TestPassThrough(t *testing.T) {
+	data := testData()
+	out := send(t, Config{}, data)
+	if !bytes.Equal(data, out) {
+		t.Fatal("data should pass through untouched")
+	}
+}
+
+func TestLoss(t *testing.T) {
+	out := send(t, Config{LossRate: 1}, testData())
+	if len(out) != 0 {
+		t.Fatal("all bytes should be lost", len(out))
+	}
+	out = send(t, Config{LossRate: 0.5}, testData())
+	if len(out) < 4000 || len(out) > 6000 {
+		t.Fatal("about half the bytes should be lost", len(out))
+	}
+}
+
+func TestInsertAndDuplicate(t *testing.T) {
+	data := testData()
+	out := send(t, Config{InsertRate: 1}, data)
+	if len(out) != 2*len(data) {
+		t.Fatal("a byte should be inserted before every byte", len(out))
+	}
+	for idx := range data {
+		if out[2*idx+1] != data[idx] {
+			t.Fatal("original bytes should be kept")
+		}
+	}
+
+	out = send(t, Config{DuplicateRate: 1}, data)
+	if len(out) != 2*len(data) {
+		t.Fatal("every byte should be duplicated", len(out))
+	}
+	for idx := range data {
+		if out[2*idx] != data[idx] || out[2*idx+1] != data[idx] {
+			t.Fatal("bad duplicate")
+		}
+	}
+}
+
+func countDifferences(a, b []byte) int {
+	n := 0
+	for idx := range a {
+		if a[idx] != b[idx] {
+			n++
+		}
+	}
+	return n
+}
+
+func TestBurstErrors(t *testing.T) {
+	data := testData()
+
+	// Stuck in the bad state.
+	out := send(t, Config{Burst: &GilbertElliott{
+		PGoodToBad:   1,
+		BadErrorRate: 1,
+	}}, data)
+	if len(out) != len(data) {
+		t.Fatal("corruption should not change the length")
+	}
+	if countDifferences(data, out) < len(data)*9/10 {
+		t.Fatal("nearly every byte should be corrupt")
+	}
+
+	// Never leaving the good state.
+	out = send(t, Config{Burst: &GilbertElliott{
+		PBadToGood:   1,
+		BadErrorRate: 1,
+	}}, data)
+	if !bytes.Equal(data, out) {
+		t.Fatal("good state should not corrupt")
+	}
+
+	// Errors should arrive in runs.
+	out = send(t, Config{Burst: &GilbertElliott{
+		PGoodToBad:   0.01,
+		PBadToGood:   0.1,
+		BadErrorRate: 1,
+	}}, data)
+	diffs := countDifferences(data, out)
+	adjacent := 0
+	for idx := 1; idx < len(data); idx++ {
+		if data[idx] != out[idx] && data[idx-1] != out[idx-1] {
+			adjacent++
+		}
+	}
+	if diffs == 0 || adjacent < diffs/2 {
+		t.Fatal("errors should be bursty", diffs, adjacent)
+	}
+}
+
+func TestBaudRate(t *testing.T) {
+	// 100 bytes at 9600 baud takes about 104ms.
+	start := time.Now()
+	out := send(t, Config{BaudRate: 9600}, make([]byte, 100))
+	elapsed := time.Since(start)
+	if len(out) != 100 {
+		t.Fatal("bad length", len(out))
+	}
+	if elapsed < 100*time.Millisecond || elapsed > time.Second {
+		t.Fatal("bad transfer time", elapsed)
+	}
+}
+
+func TestDelay(t *testing.T) {
+	buff := concurrentbuffer.New(0)
+	c := New(buff, Config{Delay: 50 * time.Millisecond})
+	defer c.Close()
+
+	start := time.Now()
+	buff.Write([]byte("ping"))
+	p := make([]byte, 4)
+	_, err := io.ReadFull(c, p)
+	if err != nil {
+		t.Fatal(err)
+	}
+	elapsed := time.Since(start)
+	if elapsed < 50*time.Millisecond || elapsed > time.Second {
+		t.Fatal("bad delay", elapsed)
+	}
+}
+
+func noisyConfig() Config {
+	return Config{
+		ByteErrorRate: 0.01,
+		LossRate:      0.01,
+		InsertRate:    0.01,
+		DuplicateRate: 0.01,
+		Burst: &GilbertElliott{
+			PGoodToBad:   0.001,
+			PBadToGood:   0.1,
+			BadErrorRate: 0.5,
+		},
+	}
+}
+
+func TestSeed(t *testing.T) {
+	data := testData()
+	conf := noisyConfig()
+	conf.Seed = 1234
+	out1 := send(t, conf, data)
+	out2 := send(t, conf, data)
+	if !bytes.Equal(out1, out2) {
+		t.Fatal("the same seed should damage data the same way")
+	}
+	conf.Seed = 4321
+	out3 := send(t, conf, data)
+	if bytes.Equal(out1, out3) {
+		t.Fatal("different seeds should damage data differently")
+	}
+
+	conf.Seed = 0
+	if New(concurrentbuffer.New(0), conf).Seed() == 0 {
+		t.Fatal("a seed should be chosen")
+	}
+}
+
+func TestRecordReplay(t *testing.T) {
+	data := testData()
+
+	buff := concurrentbuffer.New(0)
+	conf := noisyConfig()
+	conf.Record = true
+	c := New(buff, conf)
+	buff.Write(data)
+	buff.Close()
+	out, _ := io.ReadAll(c)
+
+	events := c.Events()
+	if len(events) == 0 {
+		t.Fatal("expected events to be recorded")
+	}
+
+	var saved bytes.Buffer
+	err := WriteEvents(&saved, events)
+	if err != nil {
+		t.Fatal(err)
+	}
+	events, err = ReadEvents(&saved)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	// The rates should be ignored while replaying.
+	replayConf := noisyConfig()
+	replayConf.Replaying = true
+	replayConf.Replay = events
+	replayed := send(t, replayConf, data)
+	if !bytes.Equal(out, replayed) {
+		t.Fatal("replay should reproduce the recorded damage")
+	}
+}
+
+func TestReadEvents(t *testing.T) {
+	events, err := ReadEvents(strings.NewReader("# comment\n\n1 corrupt 7\n5 drop 0\n5 insert 255\n"))
+	if err != nil {
+		t.Fatal(err)
+	}
+	expected := []Event{{1, Corrupt, 7}, {5, Drop, 0}, {5, Insert, 255}}
+	if len(events) != len(expected) {
+		t.Fatal("bad events", events)
+	}
+	for idx := range events {
+		if events[idx] != expected[idx] {
+			t.Fatal("bad event", events[idx])
+		}
+	}
+
+	for _, bad := range []string{"1 explode 0\n", "5 drop 0\n1 drop 0\n", "garbage\n"} {
+		_, err = ReadEvents(strings.NewReader(bad))
+		if err == nil {
+			t.Fatalf("expected an error for %q", bad)
+		}
+	}
+}
+
+// Replaying a recording in which nothing happened must not fall back to
+// random impairments.
+func TestReplayEmpty(t *testing.T) {
+	data := testData()
+
+	buff := concurrentbuffer.New(0)
+	conf := Config{Record: true}
+	c := New(buff, conf)
+	buff.Write(data)
+	buff.Close()
+	io.ReadAll(c)
+
+	var saved bytes.Buffer
+	err := WriteEvents(&saved, c.Events())
+	if err != nil {
+		t.Fatal(err)
+	}
+	events, err := ReadEvents(&saved)
+	if err != nil {
+		t.Fatal(err)
+	}
+	for _, replay := range [][]Event{c.Events(), events} {
+		replayConf := noisyConfig()
+		replayConf.Replaying = true
+		replayConf.Replay = replay
+		if !bytes.Equal(send(t, replayConf, data), data) {
+			t.Fatal("an empty replay should leave the data untouched")
+		}
+	}
+}
@@ -0,0 +1,116 @@
+package channelsim
+
+import (
+	"bufio"
+	"fmt"
+	"io"
+	"strings"
+)
+
+type EventKind int
+
+const (
+	// The byte was replaced with Value.
+	Corrupt EventKind = iota
+	// The byte was lost.
+	Drop
+	// Value was inserted before the byte.
+	Insert
+	// The byte was delivered twice.
+	Duplicate
+)
+
+var eventKindNames = []string{"corrupt", "drop", "insert", "duplicate"}
+
+func (k EventKind) String() string {
+	if k < 0 || int(k) >= len(eventKindNames) {
+		return fmt.Sprintf("EventKind(%d)", int(k))
+	}
+	return eventKindNames[k]
+}
+
+// Event is a single impairment applied to the byte at Offset in the data
+// read from the wrapped channel.
+type Event struct {
+	Offset int64
+	Kind   EventKind
+	Value  byte
+}
+
+func (e Event) String() string {
+	return fmt.Sprintf("%d %s %d", e.Offset, e.Kind, e.Value)
+}
+
+// applyEvents appends input byte b to out, damaged as described by
+// events. Events are applied in the order randomEvents generates them.
+func applyEvents(out []byte, b byte, events []Event) []byte {
+	dropped := false
+	dup := false
+	for _, e := range events {
+		switch e.Kind {
+		case Insert:
+			out = append(out, e.Value)
+		case Drop:
+			dropped = true
+		case Corrupt:
+			b = e.Value
+		case Duplicate:
+			dup = true
+		}
+	}
+	if dropped {
+		return out
+	}
+	out = append(out, b)
+	if dup {
+		out = append(out, b)
+	}
+	return out
+}
+
+// WriteEvents writes events to w one per line, in the format ReadEvents
+// reads back.
+func WriteEvents(w io.Writer, events []Event) error {
+	for _, e := range events {
+		_, err := fmt.Fprintln(w, e)
+		if err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// ReadEvents reads events written by WriteEvents. Blank lines and lines
+// starting with # are ignored.
+func ReadEvents(r io.Reader) ([]Event, error) {
+	var events []Event
+	scanner := bufio.NewScanner(r)
+	lineno := 0
+	for scanner.Scan() {
+		lineno++
+		line := strings.TrimSpace(scanner.Text())
+		if line == "" || strings.HasPrefix(line, "#") {
+			continue
+		}
+		var e Event
+		var kind string
+		_, err := fmt.Sscanf(line, "%d %s %d", &e.Offset, &kind, &e.Value)
+		if err != nil {
+			return nil, fmt.Errorf("line %d: %s", lineno, err)
+		}
+		e.Kind = -1
+		for idx, name := range eventKindNames {
+			if name == kind {
+				e.Kind = EventKind(idx)
+			}
+		}
+		if e.Kind < 0 {
+			return nil, fmt.Errorf("line %d: unknown event kind %q", lineno, kind)
+		}
+		if len(events) != 0 && e.Offset < events[len(events)-1].Offset {
+			return nil, fmt.Errorf("line %d: events out of order", lineno)
+		}
+		events = append(events, e)
+	}
+	return events, scanner.Err()
+}
@@ -0,0 +1,209 @@
+package clock
+
+// This package lets code that waits on time be tested deterministically.
+// Production code uses Real, tests use a Fake and move time forward by
+// hand with Advance.
+
+import (
+	"sort"
+	"sync"
+	"time"
+)
+
+// Clock is the subset of the time package the link uses.
+type Clock interface {
+	Now() time.Time
+	Since(t time.Time) time.Duration
+	After(d time.Duration) <-chan time.Time
+	Sleep(d time.Duration)
+	NewTimer(d time.Duration) Timer
+}
+
+// Timer is the equivalent of time.Timer.
+type Timer interface {
+	C() <-chan time.Time
+	Stop() bool
+	Reset(d time.Duration) bool
+}
+
+type realClock struct{}
+
+// Real returns a Clock backed by the time package.
+func Real() Clock {
+	return realClock{}
+}
+
+func (realClock) Now() time.Time {
+	return time.Now()
+}
+
+func (realClock) Since(t time.Time) time.Duration {
+	return time.Since(t)
+}
+
+func (realClock) After(d time.Duration) <-chan time.Time {
+	return time.After(d)
+}
+
+func (realClock) Sleep(d time.Duration) {
+	time.Sleep(d)
+}
+
+func (realClock) NewTimer(d time.Duration) Timer {
+	return realTimer{time.NewTimer(d)}
+}
+
+type realTimer struct {
+	t *time.Timer
+}
+
+func (rt realTimer) C() <-chan time.Time {
+	return rt.t.C
+}
+
+func (rt realTimer) Stop() bool {
+	return rt.t.Stop()
+}
+
+func (rt realTimer) Reset(d time.Duration) bool {
+	return rt.t.Reset(d)
+}
+
+// Fake is a Clock that only moves when Advance is called.
+type Fake struct {
+	cond    *sync.Cond
+	now     time.Time
+	pending []*fakeTimer
+}
+
+// NewFake returns a Fake clock set to now.
+func NewFake(now time.Time) *Fake {
+	return &Fake{
+		cond: sync.NewCond(&sync.Mutex{}),
+		now:  now,
+	}
+}
+
+func (f *Fake) Now() time.Time {
+	f.cond.L.Lock()
+	defer f.cond.L.Unlock()
+	return f.now
+}
+
+func (f *Fake) Since(t time.Time) time.Duration {
+	return f.Now().Sub(t)
+}
+
+func (f *Fake) After(d time.Duration) <-chan time.Time {
+	return f.NewTimer(d).C()
+}
+
+func (f *Fake) Sleep(d time.Duration) {
+	<-f.NewTimer(d).C()
+}
+
+func (f *Fake) NewTimer(d time.Duration) Timer {
+	t := &fakeTimer{
+		f: f,
+		c: make(chan time.Time, 1),
+	}
+	t.Reset(d)
+	return t
+}
+
+// Advance moves the clock forward by d, firing every timer that expires
+// on the way in order.
+func (f *Fake) Advance(d time.Duration) {
+	f.cond.L.Lock()
+	defer f.cond.L.Unlock()
+	end := f.now.Add(d)
+	for len(f.pending) != 0 && !f.pending[0].when.After(end) {
+		t := f.pending[0]
+		f.pending = f.pending[1:]
+		f.now = t.when
+		select {
+		case t.c <- t.when:
+		default:
+		}
+	}
+	f.now = end
+	f.cond.Broadcast()
+}
+
+// BlockUntil waits until at least n timers, sleeps or Afters are
+// pending, so a test knows the code under test has started waiting
+// before it calls Advance.
+func (f *Fake) BlockUntil(n int) {
+	f.cond.L.Lock()
+	defer f.cond.L.Unlock()
+	for len(f.pending) < n {
+		f.cond.Wait()
+	}
+}
+
+// Pending returns the number of timers waiting to fire.
+func (f *Fake) Pending() int {
+	f.cond.L.Lock()
+	defer f.cond.L.Unlock()
+	return len(f.pending)
+}
+
+// remove takes t off the pending list and reports whether it was there.
+// f.cond.L must be held.
+func (f *Fake) remove(t *fakeTimer) bool {
+	for idx, p := range f.pending {
+		if p == t {
+			f.pending = append(f.pending[:idx], f.pending[idx+1:]...)
+			return true
+		}
+	}
+	return false
+}
+
+type fakeTimer struct {
+	f    *Fake
+	when time.Time
+	c    chan time.Time
+}
+
+func (t *fakeTimer) C() <-chan time.Time {
+	return t.c
+}
+
+// Stop and Reset drop a fire time that was not received yet, like
+// time.Timer does since Go 1.23, so no stale value is seen afterwards.
+func (t *fakeTimer) Stop() bool {
+	t.f.cond.L.Lock()
+	defer t.f.cond.L.Unlock()
+	t.drain()
+	return t.f.remove(t)
+}
+
+func (t *fakeTimer) Reset(d time.Duration) bool {
+	f := t.f
+	f.cond.L.Lock()
+	defer f.cond.L.Unlock()
+	t.drain()
+	active := f.remove(t)
+	t.when = f.now.Add(d)
+	if d <= 0 {
+		select {
+		case t.c <- t.when:
+		default:
+		}
+		return active
+	}
+	f.pending = append(f.pending, t)
+	sort.SliceStable(f.pending, func(i, j int) bool {
+		return f.pending[i].when.Before(f.pending[j].when)
+	})
+	f.cond.Broadcast()
+	return active
+}
+
+func (t *fakeTimer) drain() {
+	select {
+	case <-t.c:
+	default:
+	}
+}
@@ -0,0 +1,108 @@
+package clock
+
+import (
+	"testing"
+	"time"
+)
+
+func TestFakeTimers(t *testing.T) {
+	f := NewFake(time.Unix(0, 0))
+
+	t1 := f.NewTimer(time.Second)
+	t2 := f.NewTimer(2 * time.Second)
+	t3 := f.NewTimer(3 * time.Second)
+	t3.Stop()
+
+	f.Advance(999 * time.Millisecond)
+	select {
+	case <-t1.C():
+		t.Fatal("timer fired early")
+	default:
+	}
+
+	f.Advance(time.Millisecond)
+	select {
+	case now := <-t1.C():
+		if !now.Equal(time.Unix(1, 0)) {
+			t.Fatal("bad fire time", now)
+		}
+	default:
+		t.Fatal("timer should have fired")
+	}
+
+	if !t2.Reset(time.Second) {
+		t.Fatal("t2 should have been pending")
+	}
+	f.Advance(5 * time.Second)
+	select {
+	case now := <-t2.C():
+		if !now.Equal(time.Unix(2, 0)) {
+			t.Fatal("bad fire time", now)
+		}
+	default:
+		t.Fatal("timer should have fired")
+	}
+	select {
+	case <-t3.C():
+		t.Fatal("stopped timer fired")
+	default:
+	}
+	if f.Since(time.Unix(0, 0)) != 6*time.Second {
+		t.Fatal("bad time", f.Now())
+	}
+}
+
+func TestFakeTimerDrain(t *testing.T) {
+	f := NewFake(time.Unix(0, 0))
+
+	t1 := f.NewTimer(time.Second)
+	f.Advance(time.Second)
+	if t1.Stop() {
+		t.Fatal("t1 already fired")
+	}
+	select {
+	case <-t1.C():
+		t.Fatal("Stop should drop the unreceived fire time")
+	default:
+	}
+
+	t2 := f.NewTimer(time.Second)
+	f.Advance(time.Second)
+	t2.Reset(time.Second)
+	select {
+	case <-t2.C():
+		t.Fatal("Reset should drop the unreceived fire time")
+	default:
+	}
+	f.Advance(time.Second)
+	select {
+	case now := <-t2.C():
+		if !now.Equal(time.Unix(3, 0)) {
+			t.Fatal("bad fire time", now)
+		}
+	default:
+		t.Fatal("timer should have fired")
+	}
+}
+
+func TestFakeSleep(t *testing.T) {
+	f := NewFake(time.Unix(0, 0))
+
+	done := make(chan struct{})
+	go func() {
+		f.Sleep(time.Minute)
+		close(done)
+	}()
+
+	f.BlockUntil(1)
+	f.Advance(time.Minute)
+
+	select {
+	case <-done:
+	case <-time.After(5 * time.Second):
+		t.Fatal("sleep did not wake up")
+	}
+	if f.Pending() != 0 {
+		t.Fatal("nothing should be pending")
+	}
+}
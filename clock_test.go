@@ -0,0 +1,86 @@
+package link
+
+import (
+	"mako/serial/link/clock"
+	"testing"
+	"time"
+)
+
+func TestKeepaliveTimeout(t *testing.T) {
+	clk := clock.NewFake(time.Unix(0, 0))
+	rules := newFrameRules(&frameRule{kind: PING, seqnum: -1, action: dropFrame})
+	conf := Config{
+		Clock:             clk,
+		KeepaliveInterval: time.Second,
+		KeepaliveTimeout:  5 * time.Second,
+	}
+	l1, l2 := interceptedLinks(t, conf, rules, rules)
+
+	ev := make(chan StateEvent, 10)
+	l1.Notify(ev)
+
+	s1, _ := connectedSessions(t, l1, l2)
+	expectEvent(t, ev, s1, CONNECTING, ESTABLISHED)
+
+	// The keepalive timers and pings of both sessions.
+	clk.BlockUntil(4)
+	clk.Advance(5*time.Second - time.Millisecond)
+	select {
+	case e := <-ev:
+		t.Fatal("session should still be alive", e.To)
+	case <-time.After(50 * time.Millisecond):
+	}
+
+	clk.Advance(time.Millisecond)
+	e := expectEvent(t, ev, s1, ESTABLISHED, LOST)
+	if e.Err != ErrKeepaliveTimeout {
+		t.Fatal("bad cause", e.Err)
+	}
+}
+
+func TestKeepalivePings(t *testing.T) {
+	clk := clock.NewFake(time.Unix(0, 0))
+	l1, l2 := Pipe(PipeConfig{Link: Config{Clock: clk}})
+	defer l1.Close()
+
+	s1, s2 := connectedSessions(t, l1, l2)
+
+	for i := 0; i < 20; i++ {
+		clk.BlockUntil(4)
+		received := l1.Stats().FramesReceived + l2.Stats().FramesReceived
+		clk.Advance(time.Second)
+		// Wait for both pings, or the clock can run past the keepalive
+		// timeout before they arrive.
+		deadline := time.Now().Add(5 * time.Second)
+		for l1.Stats().FramesReceived+l2.Stats().FramesReceived < received+2 {
+			if time.Now().After(deadline) {
+				t.Fatal("pings not received")
+			}
+			time.Sleep(time.Millisecond)
+		}
+	}
+	if s1.State() != ESTABLISHED || s2.State() != ESTABLISHED {
+		t.Fatal("pings should keep the sessions alive", s1.Err(), s2.Err())
+	}
+}
+
+// Sessions must not leave timers behind on a fake clock, they would
+// throw off BlockUntil.
+func TestNoStrayTimers(t *testing.T) {
+	clk := clock.NewFake(time.Unix(0, 0))
+	l1, l2 := Pipe(PipeConfig{Link: Config{Clock: clk}})
+	defer l1.Close()
+
+	s1, s2 := connectedSessions(t, l1, l2)
+	transfer(t, s2, s1, testData(1000))
+	s1.Close()
+	s2.Close()
+
+	deadline := time.Now().Add(5 * time.Second)
+	for clk.Pending() != 0 {
+		if time.Now().After(deadline) {
+			t.Fatal("timers left pending", clk.Pending())
+		}
+		time.Sleep(time.Millisecond)
+	}
+}
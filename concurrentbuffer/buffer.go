@@ -5,46 +5,180 @@ package concurrentbuffer
 // writes are ready.
 
 import (
+	"context"
 	"errors"
 	"io"
+	"math"
+	"os"
 	"sync"
+	"time"
 )
 
+// store holds the buffered bytes, Buffer does the locking and
+// enforces the size limit.
+type store interface {
+	// Append p, the caller has checked it fits.
+	push(p []byte)
+	// Remove up to len(p) bytes into p, the caller has checked the store
+	// is not empty.
+	pop(p []byte) int
+	// Append p, which the store may keep instead of copying.
+	adopt(p []byte)
+	// Remove and return the first contiguous run of bytes, either handed
+	// over by the store or copied into scratch.
+	take(scratch []byte) []byte
+}
+
 type bufferedData struct {
 	bytes []byte
 	next  *bufferedData
 }
 
-type concurrentBuffer struct {
-	cond   *sync.Cond
-	d      *bufferedData
-	tail   *bufferedData
-	closed bool
-	sz     uint
-	maxsz  uint
+// listStore keeps each write in its own node of a linked list.
+type listStore struct {
+	d    *bufferedData
+	tail *bufferedData
 }
 
+// Buffer is a byte queue safe for concurrent use, reads block until
+// there is data.
+type Buffer struct {
+	lock sync.Mutex
+	// Holds a token when data may have arrived, readers waiting for data
+	// take it. Reused so streaming through the buffer doesn't allocate,
+	// closed once the buffer is closed.
+	readable chan struct{}
+	// Handed out by Wait while the buffer is empty, closed when data
+	// arrives. Nil until someone calls Wait.
+	waitCh chan struct{}
+	// Closed and replaced whenever space frees up or the buffer is
+	// closed, blocked writers select on it.
+	writable     chan struct{}
+	readDeadline deadline
+	s            store
+	mode         WriteMode
+	closed       bool
+	// Returned by Read once the buffer is closed and drained.
+	err   error
+	sz    uint
+	maxsz uint
+}
+
+// Returned by Wait when there is no need to wait.
+var closedChan = func() chan struct{} {
+	c := make(chan struct{})
+	close(c)
+	return c
+}()
+
+// Largest piece moved at once by WriteTo and ReadFrom.
+const copyChunk = 32 * 1024
+
 var BufferFull error = errors.New("buffer full")
 var BufferClosed error = errors.New("buffer closed")
 
+// WriteMode selects what Write does when the data does not fit.
+type WriteMode int
+
+const (
+	// Write nothing and fail with BufferFull.
+	FailWhenFull WriteMode = iota
+	// Wait for readers to make space. Data larger than the buffer is
+	// written in pieces as space frees up. Close wakes blocked writers,
+	// which then fail with BufferClosed.
+	BlockWhenFull
+	// Write as much as fits and fail with BufferFull if that was not
+	// everything.
+	PartialWrite
+)
+
 // Return a new buffer.
-// maxBuffering is the maximum number of bytes the buffer can store.
-// The internal representation may take more space than this.
-func New(maxBuffering uint) io.ReadWriteCloser {
-	ret := &concurrentBuffer{}
+// maxBuffering is the maximum number of bytes the buffer can store, zero
+// means no limit. The internal representation may take more space than
+// this.
+func New(maxBuffering uint) *Buffer {
+	return newBuffer(maxBuffering, FailWhenFull, &listStore{})
+}
+
+// Return a new buffer, as New, with the given behaviour when full.
+// In BlockWhenFull and PartialWrite modes writes fail with BufferClosed
+// once the buffer is closed.
+func NewWithMode(maxBuffering uint, mode WriteMode) *Buffer {
+	return newBuffer(maxBuffering, mode, &listStore{})
+}
+
+func newBuffer(maxBuffering uint, mode WriteMode, s store) *Buffer {
+	ret := &Buffer{}
+	ret.s = s
+	ret.mode = mode
 	ret.maxsz = maxBuffering
-	ret.cond = sync.NewCond(&sync.Mutex{})
+	ret.readable = make(chan struct{}, 1)
+	ret.writable = make(chan struct{})
+	ret.readDeadline = makeDeadline()
+	ret.err = BufferClosed
 	return ret
 }
 
-func (b *concurrentBuffer) Read(p []byte) (int, error) {
-	b.cond.L.Lock()
-	for b.sz == 0 {
-		if b.closed {
-			b.cond.L.Unlock()
-			return 0, BufferClosed
-		}
-		b.cond.Wait()
+// Len returns the number of buffered bytes.
+func (b *Buffer) Len() int {
+	b.lock.Lock()
+	defer b.lock.Unlock()
+	return int(b.sz)
+}
+
+// Cap returns the maximum number of bytes the buffer holds, zero if it
+// is unbounded.
+func (b *Buffer) Cap() int {
+	return int(b.maxsz)
+}
+
+// Available returns how many more bytes fit in the buffer, math.MaxInt if
+// it is unbounded.
+func (b *Buffer) Available() int {
+	if b.maxsz == 0 {
+		return math.MaxInt
+	}
+	b.lock.Lock()
+	defer b.lock.Unlock()
+	return int(b.maxsz - b.sz)
+}
+
+// Wait returns a channel that is closed once there is data to read or
+// the buffer is closed.
+func (b *Buffer) Wait() <-chan struct{} {
+	b.lock.Lock()
+	defer b.lock.Unlock()
+	if b.sz != 0 || b.closed {
+		return closedChan
+	}
+	if b.waitCh == nil {
+		b.waitCh = make(chan struct{})
+	}
+	return b.waitCh
+}
+
+// SetReadDeadline makes pending and future reads fail with
+// os.ErrDeadlineExceeded once t has passed and the buffer is empty.
+// The zero time disables the deadline.
+func (b *Buffer) SetReadDeadline(t time.Time) error {
+	b.readDeadline.set(t)
+	return nil
+}
+
+// ReadContext is like Read but gives up with ctx.Err() if ctx is done
+// while waiting for data.
+func (b *Buffer) ReadContext(ctx context.Context, p []byte) (int, error) {
+	return b.read(ctx, p)
+}
+
+func (b *Buffer) Read(p []byte) (int, error) {
+	return b.read(context.Background(), p)
+}
+
+func (b *Buffer) read(ctx context.Context, p []byte) (int, error) {
+	err := b.waitReadable(ctx)
+	if err != nil {
+		return 0, err
 	}
 
 	amntToRead := len(p)
@@ -55,72 +189,312 @@ func (b *concurrentBuffer) Read(p []byte) (int, error) {
 		}
 	}
 
-	n := 0
-	for n != amntToRead {
-		nToCopy := amntToRead - n
-		switch {
-		case nToCopy >= len(b.d.bytes):
-			for i := 0; i < len(b.d.bytes); i++ {
-				p[n+i] = b.d.bytes[i]
-			}
-			n += len(b.d.bytes)
-			b.d = b.d.next
-			if b.d == nil {
-				b.tail = nil
-			}
-		case nToCopy < len(b.d.bytes):
-			for i := 0; i < nToCopy; i++ {
-				p[n+i] = b.d.bytes[i]
-			}
-			b.d.bytes = b.d.bytes[nToCopy:]
-			n += nToCopy
-		default:
-			panic("unreachable")
+	n := b.s.pop(p[:amntToRead])
+	b.removed(n)
+	b.lock.Unlock()
+
+	return n, nil
+}
+
+// Wait for data, on success the lock is held.
+func (b *Buffer) waitReadable(ctx context.Context) error {
+	b.lock.Lock()
+	for b.sz == 0 {
+		if b.closed {
+			b.lock.Unlock()
+			return b.err
 		}
+		b.lock.Unlock()
+		// Data is only taken with the lock held, so giving up here
+		// never loses anything.
+		select {
+		case <-b.readable:
+		case <-b.readDeadline.wait():
+			return os.ErrDeadlineExceeded
+		case <-ctx.Done():
+			return ctx.Err()
+		}
+		b.lock.Lock()
 	}
+	return nil
+}
 
+// Account for n bytes leaving the store, lock must be held.
+func (b *Buffer) removed(n int) {
 	b.sz -= uint(n)
-	b.cond.L.Unlock()
-
-	return n, nil
+	if b.sz != 0 {
+		// Pass the wakeup on to any other reader.
+		b.signalReadable()
+	}
+	if b.mode == BlockWhenFull {
+		// Wake writers waiting for space.
+		close(b.writable)
+		b.writable = make(chan struct{})
+	}
 }
 
-func (b *concurrentBuffer) Write(p []byte) (int, error) {
+// WriteTo writes buffered data to w until the buffer is closed and
+// drained, or an error occurs. Data is removed from the buffer before it
+// is written, so it is lost if w fails. A close with io.EOF is reported
+// as success, as is a plain Close; otherwise the close error is returned.
+func (b *Buffer) WriteTo(w io.Writer) (int64, error) {
+	var total int64
+	var scratch []byte
+	for {
+		err := b.waitReadable(context.Background())
+		if err == BufferClosed || err == io.EOF {
+			return total, nil
+		} else if err != nil {
+			return total, err
+		}
+		if scratch == nil {
+			scratch = make([]byte, copyChunk)
+		}
+		p := b.s.take(scratch)
+		b.removed(len(p))
+		b.lock.Unlock()
 
-	b.cond.L.Lock()
+		n, err := w.Write(p)
+		total += int64(n)
+		if err != nil {
+			return total, err
+		}
+		if n != len(p) {
+			return total, io.ErrShortWrite
+		}
+	}
+}
+
+// ReadFrom stores data read from r until r returns io.EOF. Reads are
+// sized to the free space, so r is never read further than the buffer
+// can hold; in FailWhenFull and PartialWrite modes a full buffer stops
+// the copy with BufferFull.
+func (b *Buffer) ReadFrom(r io.Reader) (int64, error) {
+	var total int64
+	var buf []byte
+	_, ring := b.s.(*ringStore)
+	for {
+		space, err := b.waitWritable()
+		if err != nil {
+			return total, err
+		}
+		if space > copyChunk {
+			space = copyChunk
+		}
+		if len(buf) < space {
+			buf = make([]byte, copyChunk)
+		}
 
-	if b.maxsz != 0 && b.sz+uint(len(p)) > b.maxsz {
-		b.cond.L.Unlock()
-		return 0, BufferFull
+		n, err := r.Read(buf[:space])
+		if n > 0 {
+			// A mostly full buf is handed to the list store as is, the
+			// ring always copies so buf can be reused.
+			owned := !ring && n >= len(buf)/2
+			// Normally this fits, but another writer may have used the
+			// space in the meantime.
+			wn, werr := b.write(buf[:n], owned)
+			total += int64(wn)
+			if owned {
+				buf = nil
+			}
+			if werr != nil {
+				return total, werr
+			}
+		}
+		if err == io.EOF {
+			return total, nil
+		} else if err != nil {
+			return total, err
+		}
 	}
+}
 
-	//XXX alot of allocations, could be improved.
-	node := &bufferedData{}
-	node.bytes = make([]byte, len(p))
-	n := copy(node.bytes, p)
-	if b.d == nil {
-		if b.sz != 0 || b.tail != nil {
-			panic("internal error")
+// Wait for free space according to the write mode and return how much
+// there is.
+func (b *Buffer) waitWritable() (int, error) {
+	b.lock.Lock()
+	defer b.lock.Unlock()
+	for {
+		if b.closed {
+			return 0, BufferClosed
+		}
+		if b.maxsz == 0 {
+			return math.MaxInt, nil
 		}
-		b.d = node
-		b.tail = node
+		if b.sz < b.maxsz {
+			return int(b.maxsz - b.sz), nil
+		}
+		if b.mode != BlockWhenFull {
+			return 0, BufferFull
+		}
+		writable := b.writable
+		b.lock.Unlock()
+		<-writable
+		b.lock.Lock()
+	}
+}
+
+// Add p to the store, lock must be held. If owned the store may keep p.
+func (b *Buffer) push(p []byte, owned bool) {
+	if len(p) == 0 {
+		return
+	}
+	if owned {
+		b.s.adopt(p)
 	} else {
-		b.tail.next = node
-		b.tail = node
+		b.s.push(p)
+	}
+	b.sz += uint(len(p))
+	b.signalReadable()
+}
+
+// Wake a reader waiting for data, lock must be held.
+func (b *Buffer) signalReadable() {
+	if b.closed {
+		// readable is closed, everyone wakes anyway.
+		return
+	}
+	select {
+	case b.readable <- struct{}{}:
+	default:
+	}
+	if b.waitCh != nil {
+		close(b.waitCh)
+		b.waitCh = nil
 	}
+}
 
-	b.sz += uint(n)
+func (b *Buffer) Write(p []byte) (int, error) {
+	return b.write(p, false)
+}
 
-	b.cond.L.Unlock()
-	b.cond.Broadcast()
+func (b *Buffer) write(p []byte, owned bool) (int, error) {
+
+	b.lock.Lock()
+
+	if b.maxsz == 0 || b.mode == FailWhenFull {
+		if b.closed && b.mode != FailWhenFull {
+			b.lock.Unlock()
+			return 0, BufferClosed
+		}
+		if b.maxsz != 0 && b.sz+uint(len(p)) > b.maxsz {
+			b.lock.Unlock()
+			return 0, BufferFull
+		}
+		b.push(p, owned)
+		b.lock.Unlock()
+		return len(p), nil
+	}
+
+	n := 0
+	for {
+		if b.closed {
+			b.lock.Unlock()
+			return n, BufferClosed
+		}
+		free := int(b.maxsz - b.sz)
+		if free > len(p)-n {
+			free = len(p) - n
+		}
+		b.push(p[n:n+free], owned)
+		n += free
+		if n == len(p) {
+			break
+		}
+		if b.mode == PartialWrite {
+			b.lock.Unlock()
+			return n, BufferFull
+		}
+		writable := b.writable
+		b.lock.Unlock()
+		<-writable
+		b.lock.Lock()
+	}
+	b.lock.Unlock()
 
 	return n, nil
 }
 
-func (b *concurrentBuffer) Close() error {
-	b.cond.L.Lock()
+func (b *Buffer) Close() error {
+	return b.CloseWithError(nil)
+}
+
+// CloseWithError closes the buffer. Once the buffered data has been read,
+// reads fail with err, or BufferClosed if err is nil. Only the first
+// close sets the error.
+func (b *Buffer) CloseWithError(err error) error {
+	b.lock.Lock()
+	defer b.lock.Unlock()
+	if b.closed {
+		return nil
+	}
+	if err != nil {
+		b.err = err
+	}
 	b.closed = true
-	b.cond.L.Unlock()
-	b.cond.Broadcast()
+	close(b.readable)
+	if b.waitCh != nil {
+		close(b.waitCh)
+		b.waitCh = nil
+	}
+	close(b.writable)
 	return nil
 }
+
+func (l *listStore) push(p []byte) {
+	//XXX alot of allocations, could be improved. See ringStore.
+	data := make([]byte, len(p))
+	copy(data, p)
+	l.adopt(data)
+}
+
+func (l *listStore) adopt(p []byte) {
+	node := &bufferedData{bytes: p}
+	if l.d == nil {
+		if l.tail != nil {
+			panic("internal error")
+		}
+		l.d = node
+		l.tail = node
+	} else {
+		l.tail.next = node
+		l.tail = node
+	}
+}
+
+func (l *listStore) take(scratch []byte) []byte {
+	p := l.d.bytes
+	l.d = l.d.next
+	if l.d == nil {
+		l.tail = nil
+	}
+	return p
+}
+
+func (l *listStore) pop(p []byte) int {
+	amntToRead := len(p)
+	n := 0
+	for n != amntToRead {
+		nToCopy := amntToRead - n
+		switch {
+		case nToCopy >= len(l.d.bytes):
+			for i := 0; i < len(l.d.bytes); i++ {
+				p[n+i] = l.d.bytes[i]
+			}
+			n += len(l.d.bytes)
+			l.d = l.d.next
+			if l.d == nil {
+				l.tail = nil
+			}
+		case nToCopy < len(l.d.bytes):
+			for i := 0; i < nToCopy; i++ {
+				p[n+i] = l.d.bytes[i]
+			}
+			l.d.bytes = l.d.bytes[nToCopy:]
+			n += nToCopy
+		default:
+			panic("unreachable")
+		}
+	}
+	return n
+}
@@ -2,7 +2,13 @@ package concurrentbuffer
 
 import (
 	"bufio"
+	"bytes"
+	"context"
+	"errors"
 	"fmt"
+	"io"
+	"math"
+	"os"
 	"testing"
 	"time"
 )
@@ -91,11 +97,13 @@ func TestBufferConcurrent(t *testing.T) {
 		for i := 0; i < 32; i++ {
 			s, err := b.ReadString('\n')
 			if err != nil {
-				t.Fatal(err)
+				t.Error(err)
+				return
 			}
 			exp := fmt.Sprintf("foo %d\n", i)
 			if s != exp {
-				t.Fatalf("lines do not match")
+				t.Errorf("lines do not match")
+				return
 			}
 
 		}
@@ -112,7 +120,7 @@ func TestBufferClose(t *testing.T) {
 	go func() {
 		n, err := buff.Read(make([]byte, 16))
 		if n != 0 || err == nil {
-			t.Fatal("read should have failed.")
+			t.Error("read should have failed.")
 		}
 		signal <- struct{}{}
 	}()
@@ -126,3 +134,313 @@ func TestBufferClose(t *testing.T) {
 	}
 
 }
+
+func TestBufferPartialWrite(t *testing.T) {
+
+	buff := NewWithMode(8, PartialWrite)
+
+	n, err := buff.Write([]byte("hello"))
+	if n != 5 || err != nil {
+		t.Fatal("failed write.")
+	}
+
+	n, err = buff.Write([]byte("world"))
+	if n != 3 || err != BufferFull {
+		t.Fatal("write should be partial", n, err)
+	}
+
+	data := make([]byte, 16)
+	n, err = buff.Read(data)
+	if err != nil || string(data[:n]) != "hellowor" {
+		t.Fatal("read failed.", string(data[:n]), err)
+	}
+
+	buff.Close()
+	_, err = buff.Write([]byte("hello"))
+	if err != BufferClosed {
+		t.Fatal("write should fail once closed", err)
+	}
+}
+
+func TestBufferUnboundedWriteAfterClose(t *testing.T) {
+
+	for _, mode := range []WriteMode{BlockWhenFull, PartialWrite} {
+		buff := NewWithMode(0, mode)
+		buff.Close()
+		n, err := buff.Write([]byte("hello"))
+		if n != 0 || err != BufferClosed {
+			t.Fatal("write should fail once closed", mode, n, err)
+		}
+	}
+}
+
+func TestBufferBlockingWrite(t *testing.T) {
+
+	for _, buff := range []io.ReadWriteCloser{
+		NewWithMode(4, BlockWhenFull),
+		NewRingWithMode(4, BlockWhenFull),
+	} {
+		data := make([]byte, 1000)
+		for idx := range data {
+			data[idx] = byte(idx)
+		}
+
+		written := make(chan error, 1)
+		go func() {
+			_, err := buff.Write(data)
+			written <- err
+		}()
+
+		got := make([]byte, len(data))
+		_, err := io.ReadFull(buff, got)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if !bytes.Equal(got, data) {
+			t.Fatal("data corrupted")
+		}
+		if err := <-written; err != nil {
+			t.Fatal(err)
+		}
+	}
+}
+
+func TestBufferCloseWakesWriter(t *testing.T) {
+
+	buff := NewWithMode(4, BlockWhenFull)
+
+	written := make(chan int, 1)
+	go func() {
+		n, err := buff.Write([]byte("hello"))
+		if err != BufferClosed {
+			t.Error("write should have failed.", err)
+		}
+		written <- n
+	}()
+
+	time.Sleep(10 * time.Millisecond)
+	buff.Close()
+
+	select {
+	case n := <-written:
+		if n != 4 {
+			t.Fatal("expected the bytes that fit to be written", n)
+		}
+	case <-time.After(5 * time.Second):
+		t.Fatal("time out")
+	}
+}
+
+func TestBufferReadDeadline(t *testing.T) {
+
+	buff := New(1024)
+
+	buff.SetReadDeadline(time.Now().Add(10 * time.Millisecond))
+	_, err := buff.Read(make([]byte, 16))
+	if err != os.ErrDeadlineExceeded {
+		t.Fatal("read should time out", err)
+	}
+
+	// Data is still returned after the deadline has passed.
+	buff.Write([]byte("hello"))
+	data := make([]byte, 16)
+	n, err := buff.Read(data)
+	if err != nil || string(data[:n]) != "hello" {
+		t.Fatal("read failed.", n, err)
+	}
+
+	// Clearing the deadline blocks again until data arrives.
+	buff.SetReadDeadline(time.Time{})
+	go func() {
+		time.Sleep(10 * time.Millisecond)
+		buff.Write([]byte("world"))
+	}()
+	n, err = buff.Read(data)
+	if err != nil || string(data[:n]) != "world" {
+		t.Fatal("read failed.", n, err)
+	}
+
+	// A deadline in the past wakes a pending read.
+	done := make(chan error, 1)
+	go func() {
+		_, err := buff.Read(data)
+		done <- err
+	}()
+	time.Sleep(10 * time.Millisecond)
+	buff.SetReadDeadline(time.Now().Add(-time.Second))
+	select {
+	case err := <-done:
+		if err != os.ErrDeadlineExceeded {
+			t.Fatal("read should time out", err)
+		}
+	case <-time.After(5 * time.Second):
+		t.Fatal("time out")
+	}
+}
+
+func TestBufferReadContext(t *testing.T) {
+
+	buff := New(1024)
+
+	ctx, cancel := context.WithCancel(context.Background())
+	go func() {
+		time.Sleep(10 * time.Millisecond)
+		cancel()
+	}()
+	_, err := buff.ReadContext(ctx, make([]byte, 16))
+	if err != context.Canceled {
+		t.Fatal("read should be cancelled", err)
+	}
+}
+
+// Reads timing out while a writer is busy must not lose any data.
+func TestBufferDeadlineNoLoss(t *testing.T) {
+
+	buff := New(0)
+
+	const total = 100000
+	go func() {
+		for i := 0; i < total; i++ {
+			buff.Write([]byte{byte(i)})
+		}
+	}()
+
+	data := make([]byte, 7)
+	got := 0
+	for got < total {
+		buff.SetReadDeadline(time.Now().Add(time.Microsecond))
+		n, err := buff.Read(data)
+		if err != nil && err != os.ErrDeadlineExceeded {
+			t.Fatal(err)
+		}
+		for _, v := range data[:n] {
+			if v != byte(got) {
+				t.Fatal("lost data at", got)
+			}
+			got++
+		}
+	}
+}
+
+func TestBufferIntrospection(t *testing.T) {
+
+	buff := New(8)
+	if buff.Len() != 0 || buff.Cap() != 8 || buff.Available() != 8 {
+		t.Fatal("bad empty buffer", buff.Len(), buff.Cap(), buff.Available())
+	}
+
+	select {
+	case <-buff.Wait():
+		t.Fatal("empty buffer should not be ready")
+	default:
+	}
+	ready := buff.Wait()
+	buff.Write([]byte("hello"))
+	select {
+	case <-ready:
+	case <-time.After(5 * time.Second):
+		t.Fatal("write should signal waiters")
+	}
+	if buff.Len() != 5 || buff.Available() != 3 {
+		t.Fatal("bad fill level", buff.Len(), buff.Available())
+	}
+
+	buff.Read(make([]byte, 5))
+	select {
+	case <-buff.Wait():
+		t.Fatal("drained buffer should not be ready")
+	default:
+	}
+
+	if New(0).Available() != math.MaxInt {
+		t.Fatal("unbounded buffer should always have space")
+	}
+}
+
+func TestBufferCloseWithError(t *testing.T) {
+
+	buff := New(8)
+	myErr := errors.New("my error")
+
+	buff.Write([]byte("hi"))
+	buff.CloseWithError(myErr)
+	buff.CloseWithError(errors.New("ignored"))
+
+	select {
+	case <-buff.Wait():
+	default:
+		t.Fatal("closed buffer should be ready")
+	}
+
+	data := make([]byte, 8)
+	n, err := buff.Read(data)
+	if n != 2 || err != nil {
+		t.Fatal("buffered data should still be readable", n, err)
+	}
+	_, err = buff.Read(data)
+	if err != myErr {
+		t.Fatal("expected the close error", err)
+	}
+}
+
+func TestBufferWriteToReadFrom(t *testing.T) {
+
+	data := make([]byte, 100000)
+	for idx := range data {
+		data[idx] = byte(idx * 7)
+	}
+
+	for _, buff := range []*Buffer{
+		NewWithMode(1000, BlockWhenFull),
+		NewRingWithMode(1000, BlockWhenFull),
+		New(0),
+	} {
+		filled := make(chan error, 1)
+		go func() {
+			n, err := buff.ReadFrom(bytes.NewReader(data))
+			if n != int64(len(data)) {
+				t.Error("short ReadFrom", n)
+			}
+			buff.Close()
+			filled <- err
+		}()
+
+		var out bytes.Buffer
+		n, err := buff.WriteTo(&out)
+		if err != nil || n != int64(len(data)) {
+			t.Fatal("WriteTo failed", n, err)
+		}
+		if !bytes.Equal(out.Bytes(), data) {
+			t.Fatal("data corrupted")
+		}
+		if err := <-filled; err != nil {
+			t.Fatal(err)
+		}
+	}
+}
+
+func TestBufferReadFromFull(t *testing.T) {
+
+	buff := New(10)
+	n, err := buff.ReadFrom(bytes.NewReader(make([]byte, 25)))
+	if n != 10 || err != BufferFull {
+		t.Fatal("ReadFrom should stop when full", n, err)
+	}
+	if buff.Len() != 10 {
+		t.Fatal("nothing read should be lost", buff.Len())
+	}
+}
+
+func TestBufferWriteToError(t *testing.T) {
+
+	buff := New(0)
+	myErr := errors.New("my error")
+	buff.Write([]byte("hello"))
+	buff.CloseWithError(myErr)
+
+	var out bytes.Buffer
+	n, err := buff.WriteTo(&out)
+	if n != 5 || err != myErr || out.String() != "hello" {
+		t.Fatal("WriteTo should drain then fail", n, err)
+	}
+}
@@ -0,0 +1,68 @@
+package concurrentbuffer
+
+import (
+	"sync"
+	"time"
+)
+
+// deadline is a channel that is closed once a point in time has passed.
+type deadline struct {
+	lock    sync.Mutex
+	timer   *time.Timer
+	expired chan struct{}
+}
+
+func makeDeadline() deadline {
+	return deadline{expired: make(chan struct{})}
+}
+
+// set moves the deadline, the zero time means no deadline.
+func (d *deadline) set(t time.Time) {
+	d.lock.Lock()
+	defer d.lock.Unlock()
+
+	if d.timer != nil && !d.timer.Stop() {
+		// The timer already fired, wait for it to close the channel.
+		<-d.expired
+	}
+	d.timer = nil
+
+	closed := isClosed(d.expired)
+	if t.IsZero() {
+		if closed {
+			d.expired = make(chan struct{})
+		}
+		return
+	}
+
+	dur := time.Until(t)
+	if dur <= 0 {
+		if !closed {
+			close(d.expired)
+		}
+		return
+	}
+	if closed {
+		d.expired = make(chan struct{})
+	}
+	expired := d.expired
+	d.timer = time.AfterFunc(dur, func() {
+		close(expired)
+	})
+}
+
+// wait returns a channel that is closed when the deadline passes.
+func (d *deadline) wait() chan struct{} {
+	d.lock.Lock()
+	defer d.lock.Unlock()
+	return d.expired
+}
+
+func isClosed(c chan struct{}) bool {
+	select {
+	case <-c:
+		return true
+	default:
+		return false
+	}
+}
@@ -0,0 +1,59 @@
+package concurrentbuffer
+
+// ringStore keeps the buffered bytes in a fixed array, so writes never
+// allocate and both directions are plain copies.
+type ringStore struct {
+	buf []byte
+	// Index of the first buffered byte.
+	start int
+	// Number of buffered bytes.
+	n int
+}
+
+// Return a new buffer backed by a fixed size ring.
+// capacity is the maximum number of bytes the buffer can store, all of
+// it is allocated up front. Reads, writes and Close behave as for New.
+func NewRing(capacity uint) *Buffer {
+	return NewRingWithMode(capacity, FailWhenFull)
+}
+
+// Return a new ring buffer, as NewRing, with the given behaviour when
+// full.
+func NewRingWithMode(capacity uint, mode WriteMode) *Buffer {
+	if capacity == 0 {
+		panic("ring buffer capacity must be non zero")
+	}
+	return newBuffer(capacity, mode, &ringStore{buf: make([]byte, capacity)})
+}
+
+func (r *ringStore) push(p []byte) {
+	end := r.start + r.n
+	if end >= len(r.buf) {
+		// The buffered bytes wrap, the free space is in one piece.
+		copy(r.buf[end-len(r.buf):], p)
+	} else {
+		copied := copy(r.buf[end:], p)
+		copy(r.buf, p[copied:])
+	}
+	r.n += len(p)
+}
+
+func (r *ringStore) pop(p []byte) int {
+	end := r.start + r.n
+	if end > len(r.buf) {
+		end = len(r.buf)
+	}
+	n := copy(p, r.buf[r.start:end])
+	n += copy(p[n:], r.buf[:r.n-n])
+	r.start = (r.start + n) % len(r.buf)
+	r.n -= n
+	return n
+}
+
+func (r *ringStore) adopt(p []byte) {
+	r.push(p)
+}
+
+func (r *ringStore) take(scratch []byte) []byte {
+	return scratch[:r.pop(scratch)]
+}
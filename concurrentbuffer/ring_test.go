@@ -0,0 +1,171 @@
+package concurrentbuffer
+
+import (
+	"bytes"
+	"io"
+	"math/rand"
+	"testing"
+)
+
+func TestRing(t *testing.T) {
+	buff := NewRing(8)
+
+	n, err := buff.Write([]byte("hello"))
+	if n != 5 || err != nil {
+		t.Fatal("failed write.")
+	}
+	_, err = buff.Write([]byte("hello"))
+	if err != BufferFull {
+		t.Fatal("buffer should be full", err)
+	}
+
+	data := make([]byte, 3)
+	n, err = buff.Read(data)
+	if n != 3 || err != nil || string(data) != "hel" {
+		t.Fatal("read failed.", n, err)
+	}
+
+	// Wraps around the end of the ring.
+	n, err = buff.Write([]byte("world!"))
+	if n != 6 || err != nil {
+		t.Fatal("failed write.", err)
+	}
+	data = make([]byte, 16)
+	n, err = buff.Read(data)
+	if err != nil || string(data[:n]) != "loworld!" {
+		t.Fatal("read failed.", string(data[:n]), err)
+	}
+
+	buff.Close()
+	_, err = buff.Read(data)
+	if err != BufferClosed {
+		t.Fatal("read should fail once closed", err)
+	}
+}
+
+// Random sized reads and writes against a ring and a list buffer of the
+// same size should succeed and fail alike and produce the same stream.
+func TestRingMatchesList(t *testing.T) {
+	rng := rand.New(rand.NewSource(1))
+	for _, mode := range []WriteMode{FailWhenFull, PartialWrite} {
+		ring := NewRingWithMode(64, mode)
+		list := NewWithMode(64, mode)
+		next := byte(0)
+
+		for i := 0; i < 10000; i++ {
+			if rng.Intn(2) == 0 {
+				p := make([]byte, rng.Intn(32))
+				for idx := range p {
+					p[idx] = next
+					next++
+				}
+				rn, rerr := ring.Write(p)
+				ln, lerr := list.Write(p)
+				if rn != ln || rerr != lerr {
+					t.Fatal("writes differ", rn, rerr, ln, lerr)
+				}
+				next -= byte(len(p) - rn)
+			} else if list.Len() != 0 {
+				size := rng.Intn(48) + 1
+				rp := make([]byte, size)
+				lp := make([]byte, size)
+				rn, rerr := ring.Read(rp)
+				ln, lerr := list.Read(lp)
+				if rn != ln || rerr != lerr || !bytes.Equal(rp[:rn], lp[:ln]) {
+					t.Fatal("reads differ", rn, rerr, ln, lerr)
+				}
+			}
+			if ring.Len() != list.Len() {
+				t.Fatal("lengths differ", ring.Len(), list.Len())
+			}
+		}
+	}
+}
+
+func benchmarkBuffer(b *testing.B, buff io.ReadWriteCloser, chunk int) {
+	p := make([]byte, chunk)
+	b.SetBytes(int64(chunk))
+	b.ReportAllocs()
+	for i := 0; i < b.N; i++ {
+		_, err := buff.Write(p)
+		if err != nil {
+			b.Fatal(err)
+		}
+		_, err = io.ReadFull(buff, p)
+		if err != nil {
+			b.Fatal(err)
+		}
+	}
+}
+
+func BenchmarkList128(b *testing.B) {
+	benchmarkBuffer(b, New(1024*1024), 128)
+}
+
+func BenchmarkRing128(b *testing.B) {
+	benchmarkBuffer(b, NewRing(1024*1024), 128)
+}
+
+func BenchmarkList4096(b *testing.B) {
+	benchmarkBuffer(b, New(1024*1024), 4096)
+}
+
+func BenchmarkRing4096(b *testing.B) {
+	benchmarkBuffer(b, NewRing(1024*1024), 4096)
+}
+
+func benchmarkConcurrent(b *testing.B, buff io.ReadWriteCloser) {
+	const chunk = 512
+	b.SetBytes(chunk)
+	b.ReportAllocs()
+	done := make(chan struct{})
+	go func() {
+		_, err := io.ReadFull(buff, make([]byte, chunk*b.N))
+		if err != nil {
+			b.Error(err)
+		}
+		close(done)
+	}()
+	p := make([]byte, chunk)
+	for i := 0; i < b.N; i++ {
+		_, err := buff.Write(p)
+		if err != nil {
+			b.Fatal(err)
+		}
+	}
+	<-done
+}
+
+func BenchmarkListConcurrent(b *testing.B) {
+	benchmarkConcurrent(b, NewWithMode(64*1024, BlockWhenFull))
+}
+
+func BenchmarkRingConcurrent(b *testing.B) {
+	benchmarkConcurrent(b, NewRingWithMode(64*1024, BlockWhenFull))
+}
+
+func benchmarkCopy(b *testing.B, buff *Buffer) {
+	const chunk = 64 * 1024
+	b.SetBytes(chunk)
+	b.ReportAllocs()
+	src := bytes.NewReader(make([]byte, chunk))
+	for i := 0; i < b.N; i++ {
+		src.Seek(0, io.SeekStart)
+		_, err := buff.ReadFrom(src)
+		if err != nil {
+			b.Fatal(err)
+		}
+		_, err = io.CopyN(io.Discard, buff, chunk)
+		if err != nil {
+			b.Fatal(err)
+		}
+	}
+}
+
+func BenchmarkListCopy(b *testing.B) {
+	benchmarkCopy(b, New(1024*1024))
+}
+
+func BenchmarkRingCopy(b *testing.B) {
+	benchmarkCopy(b, NewRing(1024*1024))
+}
@@ -0,0 +1,119 @@
+package link
+
+import (
+	"io"
+	"log/slog"
+	"mako/serial/link/clock"
+	"time"
+)
+
+// Config holds the tunable parameters of a Link and the sessions that
+// run over it. Zero fields are replaced with the values from
+// DefaultConfig, so callers only need to set what they care about.
+type Config struct {
+	// LinkSession.Write splits its input into DATA segments. The segment
+	// size starts at InitialSegmentSize and adapts between MinSegmentSize
+	// and MaxSegmentSize: it grows while segments are acked on the first
+	// attempt and shrinks when frames are lost or fail their checksum.
+	MinSegmentSize     int
+	MaxSegmentSize     int
+	InitialSegmentSize int
+
+	// A session pings its peer every KeepaliveInterval, and gives up on
+	// it after hearing nothing for KeepaliveTimeout.
+	KeepaliveInterval time.Duration
+	KeepaliveTimeout  time.Duration
+	// How long Dial and Accept wait for each step of the handshake.
+	HandshakeTimeout time.Duration
+	// The shortest time a session waits for an ack before resending a
+	// segment, and the first. The wait follows the measured round trip
+	// time and doubles after every resend, see SessionStats.
+	RetransmitTimeout time.Duration
+
+	// Datagrams larger than MaxDatagramSize are refused, they are never
+	// split. An association with no datagrams either way for
+	// DatagramIdleTimeout is closed.
+	MaxDatagramSize     int
+	DatagramIdleTimeout time.Duration
+
+	// All timers go through Clock, tests can substitute a clock.Fake.
+	// Nil uses the real time. Session read and write deadlines are the
+	// exception, they are absolute times and use the wall clock.
+	Clock clock.Clock
+
+	// Logger receives structured events about handshakes, corrupt frames,
+	// retransmissions, keepalive timeouts and why links and sessions
+	// closed. Nil discards everything.
+	Logger *slog.Logger
+
+	// If set, every frame sent or received is written to Capture in
+	// pcapng format, see ReadCapture.
+	Capture io.Writer
+
+	// Tests use this to tamper with outgoing messages, see interceptor.
+	intercept interceptor
+}
+
+// DefaultConfig returns the configuration used by CreateLink.
+func DefaultConfig() Config {
+	return Config{
+		MinSegmentSize:      16,
+		MaxSegmentSize:      1024,
+		InitialSegmentSize:  128,
+		KeepaliveInterval:   1 * time.Second,
+		KeepaliveTimeout:    5 * time.Second,
+		HandshakeTimeout:    1 * time.Second,
+		RetransmitTimeout:   5 * time.Millisecond,
+		MaxDatagramSize:     1500,
+		DatagramIdleTimeout: 60 * time.Second,
+	}
+}
+
+// withDefaults fills in any unset fields and makes sure the segment
+// bounds are consistent.
+func (conf Config) withDefaults() Config {
+	def := DefaultConfig()
+	if conf.MinSegmentSize <= 0 {
+		conf.MinSegmentSize = def.MinSegmentSize
+	}
+	if conf.MaxSegmentSize <= 0 {
+		conf.MaxSegmentSize = def.MaxSegmentSize
+	}
+	if conf.MaxSegmentSize < conf.MinSegmentSize {
+		conf.MaxSegmentSize = conf.MinSegmentSize
+	}
+	if conf.InitialSegmentSize <= 0 {
+		conf.InitialSegmentSize = def.InitialSegmentSize
+	}
+	if conf.InitialSegmentSize < conf.MinSegmentSize {
+		conf.InitialSegmentSize = conf.MinSegmentSize
+	}
+	if conf.InitialSegmentSize > conf.MaxSegmentSize {
+		conf.InitialSegmentSize = conf.MaxSegmentSize
+	}
+	if conf.KeepaliveInterval <= 0 {
+		conf.KeepaliveInterval = def.KeepaliveInterval
+	}
+	if conf.KeepaliveTimeout <= 0 {
+		conf.KeepaliveTimeout = def.KeepaliveTimeout
+	}
+	if conf.HandshakeTimeout <= 0 {
+		conf.HandshakeTimeout = def.HandshakeTimeout
+	}
+	if conf.RetransmitTimeout <= 0 {
+		conf.RetransmitTimeout = def.RetransmitTimeout
+	}
+	if conf.MaxDatagramSize <= 0 {
+		conf.MaxDatagramSize = def.MaxDatagramSize
+	}
+	if conf.DatagramIdleTimeout <= 0 {
+		conf.DatagramIdleTimeout = def.DatagramIdleTimeout
+	}
+	if conf.Clock == nil {
+		conf.Clock = clock.Real()
+	}
+	if conf.Logger == nil {
+		conf.Logger = slog.New(slog.DiscardHandler)
+	}
+	return conf
+}
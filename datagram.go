@@ -0,0 +1,242 @@
+package link
+
+// Datagrams travel as single DATAGRAM messages, without the handshake,
+// acks and retransmissions of a session. An association groups the
+// datagrams of one flow, it is keyed like a session but lives in its own
+// table. The dialer names the association's target on every datagram it
+// sends, so the far end can set the association up again from any of
+// them if the first was lost or the association had gone idle.
+
+import (
+	"fmt"
+	"log/slog"
+	"sync"
+)
+
+// Datagrams queued for Receive, further ones are dropped.
+const associationInboxSize = 64
+
+// Association carries datagrams to and from the peer. Datagrams may be
+// lost or, on a lossy link, arrive out of order; none arrive corrupted.
+type Association struct {
+	key sessionKey
+	// What the dialer asked for, may be empty.
+	target string
+	link   *Link
+	inbox  chan []byte
+	// Signalled on every datagram sent or received, see handleIdle.
+	active chan struct{}
+
+	closeOnce sync.Once
+	closed    chan struct{}
+	// Why the association closed, set before closed is closed.
+	err error
+
+	log *slog.Logger
+}
+
+// DialDatagram starts an association with the peer for target. No
+// handshake takes place, the peer learns of it from the first datagram.
+func (link *Link) DialDatagram(target string) (*Association, error) {
+	if link.IsDown() {
+		return nil, link.err
+	}
+	a := newAssociation(link, sessionKey{id: link.newSessionID(), dialed: true})
+	a.target = target
+	if !link.registerAssociation(a) {
+		// Only possible once the ids have wrapped around.
+		return nil, errSessionIDInUse
+	}
+	a.log.Debug("association started", "target", target)
+	go a.handleIdle()
+	return a, nil
+}
+
+// AcceptDatagram waits for the peer to start an association.
+func (link *Link) AcceptDatagram() (*Association, error) {
+	select {
+	case a := <-link.associationAccepts:
+		return a, nil
+	case <-link.closed:
+		return nil, link.err
+	}
+}
+
+func newAssociation(link *Link, key sessionKey) *Association {
+	a := &Association{}
+	a.link = link
+	a.key = key
+	a.log = link.log.With("association", key.id, "dialed", key.dialed)
+	a.inbox = make(chan []byte, associationInboxSize)
+	a.active = make(chan struct{}, 1)
+	a.closed = make(chan struct{})
+	return a
+}
+
+func (link *Link) registerAssociation(a *Association) bool {
+	link.sessionsLock.Lock()
+	defer link.sessionsLock.Unlock()
+	if _, ok := link.associations[a.key]; ok {
+		return false
+	}
+	link.associations[a.key] = a
+	return true
+}
+
+func (link *Link) unregisterAssociation(a *Association) {
+	link.sessionsLock.Lock()
+	defer link.sessionsLock.Unlock()
+	if link.associations[a.key] == a {
+		delete(link.associations, a.key)
+	}
+}
+
+// dispatchDatagram hands a DATAGRAM message to its association, starting
+// a new one if the message names a target. It never blocks readMessages,
+// datagrams nobody has room for are dropped.
+func (link *Link) dispatchDatagram(key sessionKey, m linkMessage) {
+	link.sessionsLock.Lock()
+	a := link.associations[key]
+	link.sessionsLock.Unlock()
+	if a == nil && m.Initiator && m.Target != "" {
+		a = newAssociation(link, key)
+		a.target = m.Target
+		select {
+		case link.associationAccepts <- a:
+			link.registerAssociation(a)
+			a.log.Debug("association started by peer", "target", a.target)
+			go a.handleIdle()
+		default:
+			a.log.Debug("accept queue full, dropped DATAGRAM")
+			a = nil
+		}
+	}
+	if a == nil {
+		link.log.Debug("dropped datagram for unknown association", "association", m.Session)
+		link.updateStats(func(st *LinkStats) { st.DatagramsDropped++ })
+		return
+	}
+	select {
+	case a.inbox <- m.Data:
+		a.markActive()
+		link.updateStats(func(st *LinkStats) { st.DatagramsReceived++ })
+	default:
+		a.log.Debug("receive queue full, dropped datagram", "len", len(m.Data))
+		link.updateStats(func(st *LinkStats) { st.DatagramsDropped++ })
+	}
+}
+
+// Target returns the target the association was dialed with.
+func (a *Association) Target() string {
+	return a.target
+}
+
+// Send sends p to the peer as a single datagram. A nil error only means
+// it was handed to the link, not that it arrived.
+func (a *Association) Send(p []byte) error {
+	if len(p) > a.link.conf.MaxDatagramSize {
+		return fmt.Errorf("%w: %d bytes, at most %d", ErrDatagramTooLarge, len(p), a.link.conf.MaxDatagramSize)
+	}
+	select {
+	case <-a.closed:
+		return a.err
+	default:
+	}
+	m := linkMessage{}
+	m.Kind = DATAGRAM
+	m.Data = append([]byte(nil), p...)
+	m.Session = a.key.id
+	m.Initiator = a.key.dialed
+	if a.key.dialed {
+		m.Target = a.target
+	}
+	err := a.link.Write(a.closed, -1, m)
+	if err == ErrCancelled {
+		return a.err
+	} else if err != nil {
+		return err
+	}
+	a.markActive()
+	a.link.updateStats(func(st *LinkStats) { st.DatagramsSent++ })
+	return nil
+}
+
+// Receive waits for the next datagram from the peer. Datagrams that
+// arrived before the association closed are still returned.
+func (a *Association) Receive() ([]byte, error) {
+	select {
+	case p := <-a.inbox:
+		return p, nil
+	default:
+	}
+	select {
+	case p := <-a.inbox:
+		return p, nil
+	case <-a.closed:
+		return nil, a.err
+	case <-a.link.closed:
+		return nil, a.link.err
+	}
+}
+
+// Close ends the association on this end. The peer is not told, its end
+// closes once it has been idle for long enough.
+func (a *Association) Close() error {
+	a.closeWithError(nil)
+	return nil
+}
+
+func (a *Association) closeWithError(err error) {
+	f := func() {
+		if err != nil {
+			a.log.Debug("association closed", "reason", err)
+		} else {
+			a.log.Debug("association closed", "reason", "closed locally")
+			err = ErrAssociationClosed
+		}
+		a.err = err
+		close(a.closed)
+		a.link.unregisterAssociation(a)
+	}
+	a.closeOnce.Do(f)
+}
+
+// Err returns nil while the association is open, and why it closed after.
+func (a *Association) Err() error {
+	select {
+	case <-a.closed:
+		return a.err
+	default:
+		return nil
+	}
+}
+
+// markActive tells handleIdle a datagram went by.
+func (a *Association) markActive() {
+	select {
+	case a.active <- struct{}{}:
+	default:
+	}
+}
+
+// handleIdle closes the association once no datagram has gone either way
+// for the idle timeout, or when the link goes down.
+func (a *Association) handleIdle() {
+	duration := a.link.conf.DatagramIdleTimeout
+	timer := a.link.clock.NewTimer(duration)
+	defer timer.Stop()
+	for {
+		select {
+		case <-a.active:
+			timer.Reset(duration)
+		case <-timer.C():
+			a.closeWithError(ErrIdleTimeout)
+			return
+		case <-a.link.closed:
+			a.closeWithError(a.link.err)
+			return
+		case <-a.closed:
+			return
+		}
+	}
+}
@@ -0,0 +1,93 @@
+package link
+
+import (
+	"errors"
+	"testing"
+	"time"
+)
+
+func TestDatagrams(t *testing.T) {
+	l1, l2 := Pipe(PipeConfig{})
+	defer l1.Close()
+	defer l2.Close()
+
+	a1, err := l1.DialDatagram("dns")
+	if err != nil {
+		t.Fatal(err)
+	}
+	err = a1.Send([]byte("query"))
+	if err != nil {
+		t.Fatal(err)
+	}
+	a2, err := l2.AcceptDatagram()
+	if err != nil {
+		t.Fatal(err)
+	}
+	if a2.Target() != "dns" {
+		t.Fatal("bad target", a2.Target())
+	}
+	p, err := a2.Receive()
+	if err != nil || string(p) != "query" {
+		t.Fatal("bad datagram", string(p), err)
+	}
+
+	err = a2.Send([]byte("answer"))
+	if err != nil {
+		t.Fatal(err)
+	}
+	p, err = a1.Receive()
+	if err != nil || string(p) != "answer" {
+		t.Fatal("bad reply", string(p), err)
+	}
+
+	err = a1.Send(make([]byte, DefaultConfig().MaxDatagramSize+1))
+	if !errors.Is(err, ErrDatagramTooLarge) {
+		t.Fatal("expected ErrDatagramTooLarge", err)
+	}
+
+	st := l1.Stats()
+	if st.DatagramsSent != 1 || st.DatagramsReceived != 1 {
+		t.Fatalf("bad stats %+v", st)
+	}
+}
+
+// Both ends close an association nothing goes through, and a datagram
+// sent later starts a new one.
+func TestDatagramIdleTimeout(t *testing.T) {
+	l1, l2 := Pipe(PipeConfig{Link: Config{DatagramIdleTimeout: 50 * time.Millisecond}})
+	defer l1.Close()
+	defer l2.Close()
+
+	a1, _ := l1.DialDatagram("x")
+	a1.Send([]byte("1"))
+	a2, err := l2.AcceptDatagram()
+	if err != nil {
+		t.Fatal(err)
+	}
+	_, err = a2.Receive()
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	for _, a := range []*Association{a1, a2} {
+		_, err = a.Receive()
+		if err != ErrIdleTimeout {
+			t.Fatal("expected ErrIdleTimeout", err)
+		}
+	}
+	err = a1.Send([]byte("2"))
+	if err != ErrIdleTimeout {
+		t.Fatal("expected ErrIdleTimeout", err)
+	}
+
+	a1, _ = l1.DialDatagram("x")
+	a1.Send([]byte("3"))
+	a2, err = l2.AcceptDatagram()
+	if err != nil {
+		t.Fatal(err)
+	}
+	p, err := a2.Receive()
+	if err != nil || string(p) != "3" {
+		t.Fatal("bad datagram", string(p), err)
+	}
+}
@@ -1,6 +1,7 @@
 package link
 
 import (
+	"errors"
 	"testing"
 )
 
@@ -32,4 +33,7 @@ func TestEncDec(t *testing.T) {
 	if err == nil {
 		t.Fatal("checksum should have failed")
 	}
+	if !errors.Is(err, ErrChecksum) {
+		t.Fatal("expected a checksum error", err)
+	}
 }
@@ -0,0 +1,54 @@
+package link
+
+import (
+	"errors"
+)
+
+// Errors returned by Link and LinkSession. Errors that end a link or a
+// session are recorded as its cause, see Link.Err and LinkSession.Err,
+// and may wrap a more specific error, so compare them with errors.Is.
+var (
+	ErrTimeout = errors.New("timeout")
+	// Returned by Link.Write when its cancel channel is closed.
+	ErrCancelled = errors.New("cancelled")
+	// Every error that ends a link wraps ErrLinkDown. A link closed with
+	// Link.Close ends with exactly ErrLinkDown.
+	ErrLinkDown = errors.New("link down")
+	// Dial gave up because the peer did not answer the handshake.
+	ErrHandshakeFailed = errors.New("failed to establish connection")
+	// The session was closed with LinkSession.Close.
+	ErrSessionClosed = errors.New("session closed")
+	// The peer closed the session.
+	ErrPeerClosed = errors.New("session closed by peer")
+	// Nothing was heard from the peer for longer than the keepalive
+	// timeout.
+	ErrKeepaliveTimeout = errors.New("keepalive timeout")
+	// An association saw no datagrams for longer than the idle timeout.
+	ErrIdleTimeout = errors.New("idle timeout")
+	// Association.Send was given more than the link's MaxDatagramSize.
+	ErrDatagramTooLarge = errors.New("datagram too large")
+	// The association was closed with Association.Close.
+	ErrAssociationClosed = errors.New("association closed")
+	// A frame failed its checksum.
+	ErrChecksum = errors.New("checksum failed")
+	// The peer sent a message without a session id, it runs a version
+	// from before sessions were multiplexed and can't be talked to.
+	ErrIncompatiblePeer = errors.New("peer runs an incompatible protocol version")
+)
+
+var errSessionIDInUse = errors.New("session id in use")
+
+// IOError records a failure of the transport underneath a link.
+type IOError struct {
+	// "read" or "write".
+	Op  string
+	Err error
+}
+
+func (e *IOError) Error() string {
+	return e.Op + " failed: " + e.Err.Error()
+}
+
+func (e *IOError) Unwrap() error {
+	return e.Err
+}
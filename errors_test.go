@@ -0,0 +1,68 @@
+package link
+
+import (
+	"errors"
+	"io"
+	"mako/serial/link/concurrentbuffer"
+	"testing"
+)
+
+func TestPeerCloseErrors(t *testing.T) {
+	l1, l2 := Pipe(PipeConfig{})
+	defer l1.Close()
+	defer l2.Close()
+
+	ev := make(chan StateEvent, 10)
+	l1.Notify(ev)
+
+	s1, s2 := connectedSessions(t, l1, l2)
+	expectEvent(t, ev, s1, CONNECTING, ESTABLISHED)
+
+	_, err := s2.Write([]byte("bye"))
+	if err != nil {
+		t.Fatal(err)
+	}
+	s2.Close()
+	expectEvent(t, ev, s1, ESTABLISHED, CLOSED)
+
+	data, err := io.ReadAll(s1)
+	if err != nil || string(data) != "bye" {
+		t.Fatal("expected remaining data then EOF", string(data), err)
+	}
+	if s1.Err() != ErrPeerClosed {
+		t.Fatal("bad cause", s1.Err())
+	}
+	_, err = s1.Write([]byte("hello?"))
+	if err != ErrPeerClosed {
+		t.Fatal("bad write error", err)
+	}
+	if s2.Err() != ErrSessionClosed {
+		t.Fatal("bad cause", s2.Err())
+	}
+}
+
+func TestLinkIOError(t *testing.T) {
+	b1 := concurrentbuffer.New(0)
+	b2 := concurrentbuffer.New(0)
+
+	l := CreateLink(b1, b2)
+	if l.Err() != nil {
+		t.Fatal("link should be up")
+	}
+	b1.Close()
+	<-l.Done()
+
+	err := l.Err()
+	var ioerr *IOError
+	if !errors.Is(err, ErrLinkDown) || !errors.As(err, &ioerr) || ioerr.Op != "read" {
+		t.Fatal("expected a read failure", err)
+	}
+	if !errors.Is(err, concurrentbuffer.BufferClosed) {
+		t.Fatal("expected the transport error to be wrapped", err)
+	}
+
+	_, err = l.Dial()
+	if !errors.Is(err, ErrLinkDown) {
+		t.Fatal("dial on a dead link should fail with the cause", err)
+	}
+}
@@ -8,20 +8,37 @@ import (
 type faultyReader struct {
 	errPoint uint32
 	rc       io.ReadCloser
+	// nil uses the global source.
+	rng *rand.Rand
 }
 
+// NewFaultyReader corrupts bytes read from rc at a uniform rate. The
+// channelsim package simulates loss, bursts, bandwidth and delay as well.
 func NewFaultyReader(byteErrorRate float64, rc io.ReadCloser) io.ReadCloser {
+	return NewFaultyReaderRand(byteErrorRate, nil, rc)
+}
+
+// NewFaultyReaderRand is like NewFaultyReader but draws from rng, so the
+// same seed corrupts the same input the same way.
+func NewFaultyReaderRand(byteErrorRate float64, rng *rand.Rand, rc io.ReadCloser) io.ReadCloser {
 
 	errPoint := uint32(byteErrorRate * float64(0xffffffff))
 
-	return &faultyReader{errPoint, rc}
+	return &faultyReader{errPoint, rc, rng}
+}
+
+func (fr *faultyReader) uint32() uint32 {
+	if fr.rng == nil {
+		return rand.Uint32()
+	}
+	return fr.rng.Uint32()
 }
 
 func (fr *faultyReader) Read(b []byte) (int, error) {
 	n, err := fr.rc.Read(b)
 	for i := 0; i < n; i++ {
-		if rand.Uint32() <= fr.errPoint {
-			b[i] = byte(int(rand.Uint32()))
+		if fr.uint32() <= fr.errPoint {
+			b[i] = byte(int(fr.uint32()))
 		}
 	}
 	return n, err
@@ -0,0 +1,30 @@
+package link
+
+import (
+	"bytes"
+	"io"
+	"math/rand"
+	"testing"
+)
+
+func TestFaultyReaderSeed(t *testing.T) {
+	data := make([]byte, 4096)
+
+	read := func(seed int64) []byte {
+		rc := io.NopCloser(bytes.NewReader(data))
+		out, err := io.ReadAll(NewFaultyReaderRand(0.1, rand.New(rand.NewSource(seed)), rc))
+		if err != nil {
+			t.Fatal(err)
+		}
+		return out
+	}
+
+	out1 := read(42)
+	out2 := read(42)
+	if !bytes.Equal(out1, out2) {
+		t.Fatal("the same seed should corrupt data the same way")
+	}
+	if bytes.Equal(out1, data) {
+		t.Fatal("data should have been corrupted")
+	}
+}
@@ -0,0 +1,20 @@
+package link
+
+// An interceptor sits between writeMessages and the wire so tests can
+// drop, delay, reorder, duplicate or rewrite individual messages.
+//
+// It is called with every message the link is about to send, and passes
+// whatever should really go out to send. send may be called any number
+// of times, from any goroutine, now or later.
+type interceptor func(m linkMessage, send func(linkMessage))
+
+// sendIntercepted is the send function handed to interceptors.
+func (link *Link) sendIntercepted(m linkMessage) {
+	if link.IsDown() {
+		return
+	}
+	err := link.writeMessage(m)
+	if err != nil {
+		link.closeWithError(err)
+	}
+}
@@ -0,0 +1,329 @@
+package link
+
+import (
+	"bytes"
+	"io"
+	"mako/serial/link/clock"
+	"mako/serial/link/concurrentbuffer"
+	"sync"
+	"testing"
+	"time"
+)
+
+type frameAction int
+
+const (
+	dropFrame frameAction = iota
+	duplicateFrame
+	delayFrame
+	// Send the frame after the next one.
+	holdFrame
+	rewriteFrame
+)
+
+// frameRule applies an action to outgoing messages of a given kind.
+type frameRule struct {
+	kind uint8
+	// Only match this sequence number, -1 matches any.
+	seqnum int
+	// Only apply to the nth match, counting from 1. Zero applies to all.
+	nth    int
+	action frameAction
+	// For delayFrame.
+	delay time.Duration
+	// For rewriteFrame.
+	rewrite func(m *linkMessage)
+
+	matched int
+}
+
+// frameRules is an interceptor applying the first matching rule to
+// each message.
+type frameRules struct {
+	lock  sync.Mutex
+	rules []*frameRule
+	held  []linkMessage
+	// Number of times any rule was applied.
+	applied int
+}
+
+func newFrameRules(rules ...*frameRule) *frameRules {
+	return &frameRules{rules: rules}
+}
+
+func (fr *frameRules) count() int {
+	fr.lock.Lock()
+	defer fr.lock.Unlock()
+	return fr.applied
+}
+
+func (fr *frameRules) match(m linkMessage) *frameRule {
+	for _, r := range fr.rules {
+		if r.kind != m.Kind || (r.seqnum >= 0 && uint(r.seqnum) != m.Seqnum) {
+			continue
+		}
+		r.matched++
+		if r.nth == 0 || r.nth == r.matched {
+			fr.applied++
+			return r
+		}
+	}
+	return nil
+}
+
+func (fr *frameRules) intercept(m linkMessage, send func(linkMessage)) {
+	fr.lock.Lock()
+	r := fr.match(m)
+	held := fr.held
+	fr.held = nil
+	if r != nil && r.action == holdFrame {
+		fr.held = append(fr.held, m)
+	}
+	fr.lock.Unlock()
+
+	switch {
+	case r == nil:
+		send(m)
+	case r.action == dropFrame:
+	case r.action == duplicateFrame:
+		send(m)
+		send(m)
+	case r.action == delayFrame:
+		go func() {
+			time.Sleep(r.delay)
+			send(m)
+		}()
+	case r.action == rewriteFrame:
+		r.rewrite(&m)
+		send(m)
+	}
+	for _, h := range held {
+		send(h)
+	}
+}
+
+// interceptedLinks returns a connected pair of links configured with
+// conf, the first one sending its messages through rules1, the second
+// through rules2. Either may be nil.
+func interceptedLinks(t *testing.T, conf Config, rules1, rules2 *frameRules) (*Link, *Link) {
+	b1 := concurrentbuffer.New(0)
+	b2 := concurrentbuffer.New(0)
+
+	conf1 := conf
+	if rules1 != nil {
+		conf1.intercept = rules1.intercept
+	}
+	conf2 := conf
+	if rules2 != nil {
+		conf2.intercept = rules2.intercept
+	}
+	l1 := CreateLinkWithConfig(b1, b2, conf1)
+	l2 := CreateLinkWithConfig(b2, b1, conf2)
+	t.Cleanup(func() {
+		l1.Close()
+		l2.Close()
+	})
+	return l1, l2
+}
+
+// transfer writes data from one session and checks it arrives intact.
+func transfer(t *testing.T, from, to *LinkSession, data []byte) {
+	written := make(chan error, 1)
+	go func() {
+		_, err := from.Write(data)
+		written <- err
+	}()
+	got := make([]byte, len(data))
+	_, err := io.ReadFull(to, got)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if !bytes.Equal(got, data) {
+		t.Fatal("data corrupted in transit")
+	}
+	err = <-written
+	if err != nil {
+		t.Fatal(err)
+	}
+}
+
+func testData(n int) []byte {
+	data := make([]byte, n)
+	for idx := range data {
+		data[idx] = byte(idx)
+	}
+	return data
+}
+
+// handshakeWithTimeout connects l1 and l2, moving clk past the handshake
+// timeout once the given number of ends are waiting for a reply that
+// will not come.
+func handshakeWithTimeout(t *testing.T, clk *clock.Fake, waiting int, l1, l2 *Link) (*LinkSession, *LinkSession) {
+	go func() {
+		clk.BlockUntil(waiting)
+		clk.Advance(DefaultConfig().HandshakeTimeout)
+	}()
+	return connectedSessions(t, l1, l2)
+}
+
+func TestHandshakeLostAck(t *testing.T) {
+	clk := clock.NewFake(time.Unix(0, 0))
+	rules := newFrameRules(&frameRule{kind: ACK, seqnum: -1, nth: 1, action: dropFrame})
+	l1, l2 := interceptedLinks(t, Config{Clock: clk}, rules, nil)
+
+	s1, s2 := handshakeWithTimeout(t, clk, 2, l1, l2)
+	if rules.count() != 1 {
+		t.Fatal("the first ACK should have been dropped")
+	}
+	transfer(t, s2, s1, []byte("hello"))
+}
+
+func TestHandshakeLostConnect(t *testing.T) {
+	clk := clock.NewFake(time.Unix(0, 0))
+	rules := newFrameRules(&frameRule{kind: CONNECT, seqnum: -1, nth: 1, action: dropFrame})
+	l1, l2 := interceptedLinks(t, Config{Clock: clk}, nil, rules)
+
+	s1, s2 := handshakeWithTimeout(t, clk, 1, l1, l2)
+	if rules.count() != 1 {
+		t.Fatal("the first CONNECT should have been dropped")
+	}
+	transfer(t, s2, s1, []byte("hello"))
+}
+
+func TestHandshakeLostAckAck(t *testing.T) {
+	// Dial sends ACKACK twice, so losing one is harmless.
+	rules := newFrameRules(&frameRule{kind: ACKACK, seqnum: -1, nth: 1, action: dropFrame})
+	l1, l2 := interceptedLinks(t, Config{}, nil, rules)
+
+	s1, s2 := connectedSessions(t, l1, l2)
+	transfer(t, s2, s1, []byte("hello"))
+}
+
+// Without any ACKACK the acceptor finishes its handshake on the first
+// thing the established dialer sends.
+func TestHandshakeAllAckAcksLost(t *testing.T) {
+	rules := newFrameRules(&frameRule{kind: ACKACK, seqnum: -1, action: dropFrame})
+	l1, l2 := interceptedLinks(t, Config{}, nil, rules)
+
+	s1, s2 := connectedSessions(t, l1, l2)
+	if rules.count() < 2 {
+		t.Fatal("the ACKACKs should have been dropped", rules.count())
+	}
+	transfer(t, s2, s1, []byte("hello"))
+	transfer(t, s1, s2, []byte("world"))
+}
+
+func TestHandshakeDuplicateAckAck(t *testing.T) {
+	rules := newFrameRules(&frameRule{kind: ACKACK, seqnum: -1, action: duplicateFrame})
+	l1, l2 := interceptedLinks(t, Config{}, nil, rules)
+
+	s1, s2 := connectedSessions(t, l1, l2)
+	transfer(t, s2, s1, []byte("hello"))
+	transfer(t, s1, s2, []byte("world"))
+}
+
+func TestLostDataAck(t *testing.T) {
+	rules := newFrameRules(&frameRule{kind: ACK, seqnum: 2, nth: 1, action: dropFrame})
+	l1, l2 := interceptedLinks(t, Config{}, rules, nil)
+
+	s1, s2 := connectedSessions(t, l1, l2)
+	for i := 0; i < 5; i++ {
+		transfer(t, s2, s1, []byte("hello"))
+	}
+	if rules.count() != 1 {
+		t.Fatal("the ack should have been dropped")
+	}
+	if s2.Stats().Retransmissions == 0 {
+		t.Fatal("the segment should have been resent")
+	}
+	if s1.Stats().DuplicateFrames == 0 {
+		t.Fatal("the resent segment should have been seen as a duplicate")
+	}
+}
+
+func TestLostData(t *testing.T) {
+	rules := newFrameRules(&frameRule{kind: DATA, seqnum: 1, nth: 1, action: dropFrame})
+	l1, l2 := interceptedLinks(t, Config{}, nil, rules)
+
+	s1, s2 := connectedSessions(t, l1, l2)
+	for i := 0; i < 3; i++ {
+		transfer(t, s2, s1, []byte("hello"))
+	}
+	if s2.Stats().Retransmissions == 0 {
+		t.Fatal("the segment should have been resent")
+	}
+	if s1.Stats().DuplicateFrames != 0 {
+		t.Fatal("no duplicate should have arrived")
+	}
+}
+
+// The ack names the copy it answers, so a resent segment still gives a
+// round trip sample and undoes the backoff.
+func TestResentSegmentIsTimed(t *testing.T) {
+	rules := newFrameRules(&frameRule{kind: DATA, seqnum: 1, nth: 1, action: dropFrame})
+	l1, l2 := interceptedLinks(t, Config{}, nil, rules)
+
+	s1, s2 := connectedSessions(t, l1, l2)
+	transfer(t, s2, s1, []byte("hello"))
+	st := s2.Stats()
+	if st.Retransmissions != 1 {
+		t.Fatal("the segment should have been resent once", st)
+	}
+	if st.RTT == 0 || st.RetransmitTimeout >= 2*l2.conf.RetransmitTimeout {
+		t.Fatal("the resent segment should have been timed", st)
+	}
+}
+
+func TestDuplicateData(t *testing.T) {
+	rules := newFrameRules(&frameRule{kind: DATA, seqnum: -1, action: duplicateFrame})
+	l1, l2 := interceptedLinks(t, Config{}, nil, rules)
+
+	s1, s2 := connectedSessions(t, l1, l2)
+	transfer(t, s2, s1, testData(1000))
+	if s1.Stats().DuplicateFrames == 0 {
+		t.Fatal("duplicates should have been counted")
+	}
+}
+
+func TestReorderedData(t *testing.T) {
+	// Hold back the first copy of segment 1 until its resend has gone out.
+	rules := newFrameRules(&frameRule{kind: DATA, seqnum: 1, nth: 1, action: holdFrame})
+	l1, l2 := interceptedLinks(t, Config{}, nil, rules)
+
+	s1, s2 := connectedSessions(t, l1, l2)
+	transfer(t, s2, s1, testData(1000))
+}
+
+func TestFutureData(t *testing.T) {
+	// A segment from the future must be ignored, not delivered.
+	rules := newFrameRules(&frameRule{kind: DATA, seqnum: 1, nth: 1, action: rewriteFrame,
+		rewrite: func(m *linkMessage) {
+			m.Seqnum += 5
+		},
+	})
+	l1, l2 := interceptedLinks(t, Config{}, nil, rules)
+
+	s1, s2 := connectedSessions(t, l1, l2)
+	transfer(t, s2, s1, []byte("hello"))
+	if s2.Stats().Retransmissions == 0 {
+		t.Fatal("the segment should have been resent")
+	}
+}
+
+func TestDelayedAck(t *testing.T) {
+	// An ack arriving after the segment was resent must not confuse the
+	// next write.
+	rules := newFrameRules(&frameRule{kind: ACK, seqnum: 1, nth: 1, action: delayFrame, delay: 50 * time.Millisecond})
+	l1, l2 := interceptedLinks(t, Config{}, rules, nil)
+
+	s1, s2 := connectedSessions(t, l1, l2)
+	for i := 0; i < 5; i++ {
+		transfer(t, s2, s1, []byte("hello"))
+	}
+	if s2.Stats().Retransmissions == 0 {
+		t.Fatal("the segment should have been resent")
+	}
+	if s2.Stats().SendSeqnum != firstSeqnum+5 {
+		t.Fatal("bad seqnum", s2.Stats().SendSeqnum)
+	}
+}
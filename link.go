@@ -5,74 +5,199 @@ import (
 	"errors"
 	"fmt"
 	"io"
+	"log/slog"
+	"mako/serial/link/clock"
 	"mako/serial/link/concurrentbuffer"
 	"net"
+	"os"
 	"sync"
 	"time"
 )
 
-type linkSessionState int
+// Acks queued for the writer, further ones are dropped.
+const ackQueueSize = 16
 
-const (
-	CONNECTED = iota
-	DISCONNECTED
-)
+// Times a handshake message is sent before giving up.
+const handshakeAttempts = 5
+
+// DATA frames are numbered from 1. The handshake ACK carries 0, so a
+// resent one that reaches an established dialer isn't taken for the ack
+// of the first segment.
+const firstSeqnum = 1
 
 type LinkSession struct {
-	readBuff io.ReadWriteCloser
+	key sessionKey
+	// The address the dialer asked for, may be empty.
+	target string
+	// Messages from dispatch.
+	inbox chan linkMessage
+
+	readBuff *concurrentbuffer.Buffer
 	// Must be held while sending data.
 	writeLock sync.Mutex
 
-	ackChannel chan uint
+	// ACKs for handleMessages to pass to the writer.
+	ackChannel chan linkMessage
 
 	keepAliveChannel chan struct{}
 
 	closeOnce sync.Once
 	closed    chan struct{}
+	// Why the session closed, set before closed is closed.
+	err error
+
+	stateLock sync.Mutex
+	state     SessionState
 
-	state          int
 	curSeqnum      uint
 	expectedSeqnum uint
 	link           *Link
-}
 
-var ErrTimeout = fmt.Errorf("timeout")
+	// Only used while holding writeLock.
+	seg *segmenter
+	rto *rtoEstimator
+	// Set once a write timed out with a segment unacknowledged, the peer
+	// may or may not have it so the stream can't be continued. Only used
+	// while holding writeLock.
+	writeErr error
+
+	deadlineLock  sync.Mutex
+	writeDeadline time.Time
+
+	statsLock sync.Mutex
+	stats     SessionStats
+
+	log *slog.Logger
+}
 
 type Link struct {
 	r          io.ReadCloser
 	w          io.WriteCloser
-	messageIn  <-chan linkMessage
 	messageOut chan<- linkMessage
 
+	// Open sessions, see dispatch.
+	sessionsLock  sync.Mutex
+	sessions      map[sessionKey]*LinkSession
+	nextSessionID uint32
+	// Sessions waiting for Accept, and the number of those plus the ones
+	// still in their handshake. pendingAccepts is guarded by
+	// sessionsLock.
+	connects       chan *LinkSession
+	pendingAccepts int
+	// When sessions the peer dialed were closed, see unregister. Guarded
+	// by sessionsLock.
+	recentlyClosed map[sessionKey]time.Time
+	// Datagram associations, see dispatchDatagram, and the ones waiting
+	// for AcceptDatagram. Also guarded by sessionsLock.
+	associations       map[sessionKey]*Association
+	associationAccepts chan *Association
+
 	// This channel is closed on shutdown...
 	closeOnce sync.Once
 	// Closed on shutdown, don't send anything to this.
 	closed  chan struct{}
+	// Why the link went down, set before closed is closed.
+	err error
+
+	conf  Config
+	log   *slog.Logger
+	clock clock.Clock
+
+	// Held while writing to w.
+	wireLock sync.Mutex
+
+	// Nil unless capturing.
+	captureWriter *captureWriter
+
+	notifyLock sync.Mutex
+	notify     []chan<- StateEvent
+
+	statsLock sync.Mutex
+	stats     LinkStats
 }
 
+// Close takes the link down. The reader and writer the link was created
+// with are left open, see CreateLink.
 func (link *Link) Close() {
+	link.closeWithError(nil)
+}
+
+// closeWithError shuts the link down, err says why and is nil for an
+// explicit Close. Only the first call has any effect, its err is recorded
+// as the cause.
+func (link *Link) closeWithError(err error) {
 	f := func() {
+		if err != nil {
+			link.log.Info("link closed", "reason", err)
+			link.err = fmt.Errorf("%w: %w", ErrLinkDown, err)
+		} else {
+			link.log.Info("link closed", "reason", "closed locally")
+			link.err = ErrLinkDown
+		}
 		close(link.closed)
 	}
 	link.closeOnce.Do(f)
 }
 
+// Err returns nil while the link is up, and why it went down after.
+// The error always wraps ErrLinkDown.
+func (link *Link) Err() error {
+	select {
+	case <-link.closed:
+		return link.err
+	default:
+		return nil
+	}
+}
+
+// CreateLink starts a link over r and w. The caller owns them: closing
+// the link does not close them. Once the link is down it reads nothing
+// more from r, but a Read that is already waiting only returns when r
+// delivers or fails, so close r to end it.
 func CreateLink(r io.ReadCloser, w io.WriteCloser) *Link {
-	in := make(chan linkMessage)
+	return CreateLinkWithConfig(r, w, DefaultConfig())
+}
+
+func CreateLinkWithConfig(r io.ReadCloser, w io.WriteCloser, conf Config) *Link {
 	out := make(chan linkMessage)
 	ret := &Link{
-		r:          r,
-		w:          w,
-		messageIn:  in,
-		messageOut: out,
+		r:                  r,
+		w:                  w,
+		messageOut:         out,
+		sessions:           make(map[sessionKey]*LinkSession),
+		recentlyClosed:     make(map[sessionKey]time.Time),
+		connects:           make(chan *LinkSession, acceptQueueSize),
+		associations:       make(map[sessionKey]*Association),
+		associationAccepts: make(chan *Association, acceptQueueSize),
 		closed:  make(chan struct{}),
+		conf:       conf.withDefaults(),
 	}
-	go ret.readMessages(in)
+	ret.log = ret.conf.Logger
+	ret.clock = ret.conf.Clock
+	if ret.conf.Capture != nil {
+		ret.captureWriter = newCaptureWriter(ret.conf.Capture, ret.log)
+	}
+	go ret.readMessages()
 	go ret.writeMessages(out)
 	return ret
 }
 
 
+// closeWhenDown closes each of closers once the link has gone down.
+func (link *Link) closeWhenDown(closers ...io.Closer) {
+	go func() {
+		<-link.closed
+		for _, c := range closers {
+			c.Close()
+		}
+	}()
+}
+
+// Done returns a channel that is closed when the link goes down.
+func (link *Link) Done() <-chan struct{} {
+	return link.closed
+}
+
 func (link *Link) IsDown() bool {
     select {
         case <- link.closed:
@@ -82,36 +207,21 @@ func (link *Link) IsDown() bool {
     }
 }
 
-func (link *Link) Read(cancel chan struct{},timeout time.Duration) (linkMessage, error) {
-
-	var timeoutChan <-chan time.Time = make(chan time.Time)
-
-	if timeout > 0 {
-		ticker := time.NewTicker(timeout)
-		timeoutChan = ticker.C
-		defer ticker.Stop()
-	}
-
-	select {
-	case m := <-link.messageIn:
-		return m, nil
-	case <-timeoutChan:
-		return linkMessage{}, ErrTimeout
-	case <-link.closed:
-		return linkMessage{}, fmt.Errorf("link down.")
-	case <-cancel:
-		return linkMessage{}, fmt.Errorf("read cancelled")
-	}
-}
-
+// Write queues m for the wire. It fails with ErrTimeout after timeout,
+// if that is positive, ErrCancelled once cancel is closed, or the link's
+// error once it is down.
+//
+// There is no Link.Read any more. Since sessions are multiplexed every
+// message that arrives belongs to a session and is handed to it, use
+// Accept and Dial and read from the sessions instead.
 func (link *Link) Write(cancel chan struct{},timeout time.Duration, m linkMessage) error {
 
 	var timeoutChan <-chan time.Time
 
 	if timeout > 0 {
-		ticker := time.NewTicker(timeout)
-		timeoutChan = ticker.C
-		defer ticker.Stop()
+		timer := link.clock.NewTimer(timeout)
+		timeoutChan = timer.C()
+		defer timer.Stop()
 	} else {
 		timeoutChan = make(chan time.Time)
 	}
@@ -122,44 +232,63 @@ func (link *Link) Write(cancel chan struct{},timeout time.Duration, m linkMessag
 	case <-timeoutChan:
 		return ErrTimeout
 	case <-cancel:
-	    return fmt.Errorf("write cancelled")
+	    return ErrCancelled
 	case <-link.closed:
-		return fmt.Errorf("link down.")
+		return link.err
 	}
 }
 
-func (link *Link) readMessages(ch chan<- linkMessage) {
+func (link *Link) readMessages() {
 	reader := bufio.NewReader(link.r)
-	defer link.Close()
-	for {
-		line, err := reader.ReadBytes('~')
+	for !link.IsDown() {
+		line, err := ReadFrame(reader)
+		// Whatever arrives after the link went down is left unread.
+		if link.IsDown() {
+			return
+		}
 		if err != nil {
+			link.closeWithError(&IOError{Op: "read", Err: err})
 			return
 		}
 		m, err := decodeMessage(line)
+		link.capture(Inbound, line, err)
+		link.updateStats(func(st *LinkStats) {
+			st.WireBytesReceived += uint64(len(line))
+			switch {
+			case errors.Is(err, ErrChecksum):
+				st.ChecksumFailures++
+			case err != nil:
+				st.DecodeErrors++
+			default:
+				st.FramesReceived++
+				if m.Kind == DATA {
+					st.PayloadBytesReceived += uint64(len(m.Data))
+				}
+			}
+		})
 		if err != nil {
+			if errors.Is(err, ErrChecksum) {
+				link.log.Debug("dropped frame with bad checksum", "err", err, "len", len(line))
+			} else {
+				link.log.Debug("dropped undecodable frame", "err", err, "len", len(line))
+			}
 			continue
 		}
-		select {
-		case ch <- m:
-			// Sent...
-		case <-link.closed:
-			return
-		}
+		link.dispatch(m)
 	}
 }
 
 func (link *Link) writeMessages(ch <-chan linkMessage) {
-	defer link.Close()
 	for {
 		select {
 		case m := <-ch:
-			encoded, err := encodeMessage(&m)
-			if err != nil {
-				return
+			if link.conf.intercept != nil {
+				link.conf.intercept(m, link.sendIntercepted)
+				continue
 			}
-			_, err = link.w.Write(encoded)
+			err := link.writeMessage(m)
 			if err != nil {
+				link.closeWithError(err)
 				return
 			}
 		case <-link.closed:
@@ -168,62 +297,132 @@ func (link *Link) writeMessages(ch <-chan linkMessage) {
 	}
 }
 
+// writeMessage encodes m and writes it to the wire.
+func (link *Link) writeMessage(m linkMessage) error {
+	encoded, err := encodeMessage(&m)
+	if err != nil {
+		return fmt.Errorf("encoding message failed: %w", err)
+	}
+	link.wireLock.Lock()
+	_, err = link.w.Write(encoded)
+	if err == nil {
+		link.capture(Outbound, encoded, nil)
+	}
+	link.wireLock.Unlock()
+	if err != nil {
+		return &IOError{Op: "write", Err: err}
+	}
+	link.updateStats(func(st *LinkStats) {
+		st.FramesSent++
+		st.WireBytesSent += uint64(len(encoded))
+		if m.Kind == DATA {
+			st.PayloadBytesSent += uint64(len(m.Data))
+		}
+	})
+	return nil
+}
+
+// Accept waits for the peer to dial a session. Target on the returned
+// session says what the peer asked to be connected to. Handshakes run
+// as the CONNECTs arrive, so the session is already established.
 func (link *Link) Accept() (net.Conn, error) {
-    cancel := make(chan struct{})
-	for {
-		m, err := link.Read(cancel,-1)
+	return link.nextConnect(nil)
+}
+
+// acceptHandshake completes the handshake of a session created by a
+// CONNECT and queues it for Accept.
+func (s *LinkSession) acceptHandshake() {
+	s.log.Debug("handshake: received CONNECT, sending ACK", "target", s.target)
+	err := s.answerConnect(s.closed)
+	if err != nil {
+		s.closeWithError(err)
+		s.link.accepted()
+		return
+	}
+	s.log.Info("handshake: session accepted")
+	s.start()
+	// Never blocks, there are at most acceptQueueSize pending sessions.
+	s.link.connects <- s
+}
+
+// answerConnect answers a CONNECT with ACK until the dialer confirms
+// with ACKACK, or with anything that shows it is established. The ACK is resent when it may have been lost: if the
+// dialer sends CONNECT again or nothing arrives for a while.
+func (s *LinkSession) answerConnect(cancel chan struct{}) error {
+	ack := linkMessage{}
+	ack.Kind = ACK
+	for i := 0; i < handshakeAttempts; i++ {
+		err := s.sendMessage(cancel,-1, ack)
 		if err != nil {
-			return nil, err
+			return err
 		}
-		if m.Kind == CONNECT {
-			ack := linkMessage{}
-			ack.Kind = ACK
-			err = link.Write(cancel,-1, ack)
-			if err != nil {
-				return nil, err
-			}
-			ackack, err := link.Read(cancel,1 * time.Second)
-			if err != nil {
-				if err == ErrTimeout {
-					continue
-				}
-				return nil, err
-			}
-			if ackack.Kind == ACKACK {
-				break
-			}
+		ackack, err := s.readMessage(cancel, s.link.conf.HandshakeTimeout)
+		if err == ErrTimeout {
+			s.log.Debug("handshake: timed out waiting for ACKACK", "attempt", i+1)
+			continue
+		} else if err != nil {
+			return err
+		}
+		switch ackack.Kind {
+		case ACKACK:
+			return nil
+		case CONNECT:
+			s.log.Debug("handshake: received CONNECT again, resending ACK")
+		default:
+			// Both ACKACKs were lost, but the dialer only sends anything
+			// else once it has the ACK. The message is dropped, DATA is
+			// resent.
+			s.log.Debug("handshake: dialer established without ACKACK", "kind", messageKind(ackack.Kind))
+			return nil
 		}
 	}
-
-	ret := newSession(link)
-
-	return ret, nil
+	return ErrHandshakeFailed
 }
 
+// Dial opens a session to the peer without a target.
 func (link *Link) Dial() (net.Conn, error) {
+	return link.DialTarget("")
+}
+
+// DialTarget opens a session to the peer, asking it to connect the
+// session to target. What target means is up to the accepting side.
+func (link *Link) DialTarget(target string) (net.Conn, error) {
     cancel := make(chan struct{})
+	ret := newSession(link, sessionKey{id: link.newSessionID(), dialed: true})
+	ret.target = target
+	if !link.register(ret) {
+		// Only possible once the ids have wrapped around.
+		return nil, errSessionIDInUse
+	}
 	connected := false
-	for i := 0; i < 5; i++ {
+	for i := 0; i < handshakeAttempts; i++ {
+		ret.log.Debug("handshake: sending CONNECT", "attempt", i+1)
 		m := linkMessage{}
 		m.Kind = CONNECT
-		link.Write(cancel,-1, m)
+		m.Data = []byte(target)
+		ret.sendMessage(cancel,-1, m)
 
-		ack, err := link.Read(cancel,1 * time.Second)
+		ack, err := ret.readMessage(cancel, link.conf.HandshakeTimeout)
 		if err != nil {
 			if err == ErrTimeout {
+				ret.log.Debug("handshake: timed out waiting for ACK", "attempt", i+1)
 				continue
 			}
+			ret.closeWithError(err)
 			return nil, err
 		}
 		if ack.Kind == ACK {
+			ret.log.Debug("handshake: received ACK, sending ACKACK")
 			ackack := linkMessage{}
 			ackack.Kind = ACKACK
-			err := link.Write(cancel,-1, ackack)
+			err := ret.sendMessage(cancel,-1, ackack)
 			if err != nil {
+				ret.closeWithError(err)
 				return nil, err
 			}
-			err = link.Write(cancel,-1, ackack)
+			err = ret.sendMessage(cancel,-1, ackack)
 			if err != nil {
+				ret.closeWithError(err)
 				return nil, err
 			}
 			connected = true
@@ -233,26 +432,54 @@ func (link *Link) Dial() (net.Conn, error) {
 		}
 	}
 	if !connected {
-		return nil, fmt.Errorf("failed to establish connection.")
+		ret.log.Info("handshake: failed to establish connection")
+		ret.closeWithError(ErrHandshakeFailed)
+		return nil, ErrHandshakeFailed
 	}
-	ret := newSession(link)
+	ret.log.Info("handshake: session established")
+	ret.start()
 	return ret, nil
 }
 
-func newSession(link *Link) *LinkSession {
+// newSession returns a session in the CONNECTING state, call start once
+// the handshake has completed.
+func newSession(link *Link, key sessionKey) *LinkSession {
 	ret := &LinkSession{}
 	ret.link = link
+	ret.key = key
+	ret.log = link.log.With("session", key.id, "dialed", key.dialed)
+	ret.state = CONNECTING
+	ret.seg = newSegmenter(link.conf)
+	ret.rto = newRTOEstimator(link.conf)
+	ret.stats.SegmentSize = ret.seg.size
+	ret.stats.RetransmitTimeout = ret.rto.rto
+	ret.curSeqnum = firstSeqnum
+	ret.expectedSeqnum = firstSeqnum
+	ret.stats.SendSeqnum = firstSeqnum
+	ret.stats.RecvSeqnum = firstSeqnum
 	// Max buff is 1 meg for now.
 	ret.readBuff = concurrentbuffer.New(1024 * 1024)
-	ret.ackChannel = make(chan uint)
+	ret.inbox = make(chan linkMessage, sessionInboxSize)
+	ret.ackChannel = make(chan linkMessage, ackQueueSize)
 	ret.keepAliveChannel = make(chan struct{})
 	ret.closed = make(chan struct{})
-	go ret.handleMessages()
-	go ret.handleTimeout()
-	go ret.handlePings()
 	return ret
 }
 
+// Target returns the target the session was dialed with.
+func (s *LinkSession) Target() string {
+	return s.target
+}
+
+func (s *LinkSession) start() {
+	if !s.transition(CONNECTING, ESTABLISHED, nil) {
+		return
+	}
+	go s.handleMessages()
+	go s.handleTimeout()
+	go s.handlePings()
+}
+
 type dummyLinkAddr struct{}
 
 func (*dummyLinkAddr) Network() string {
@@ -263,58 +490,68 @@ func (*dummyLinkAddr) String() string {
 	return "link"
 }
 
-func (s *LinkSession) sendAck(seqnum uint) error {
+func (s *LinkSession) sendAck(seqnum, attempt uint) error {
 	ackmessage := linkMessage{}
 	ackmessage.Kind = ACK
 	ackmessage.Seqnum = seqnum
-	err := s.link.Write(s.closed,-1, ackmessage)
+	ackmessage.Attempt = attempt
+	err := s.sendMessage(s.closed,-1, ackmessage)
 	if err != nil {
-		s.Close()
+		s.closeWithError(fmt.Errorf("sending ack failed: %w", err))
 	}
 	return err
 }
 
-func (s *LinkSession) sendData(seqnum uint, data []byte) error {
+// sendData queues a DATA frame. It fails with ErrCancelled, leaving the
+// session open, once cancel is closed.
+func (s *LinkSession) sendData(cancel chan struct{}, seqnum, attempt uint, data []byte) error {
 	d := linkMessage{}
 	d.Kind = DATA
 	d.Seqnum = seqnum
+	d.Attempt = attempt
 	d.Data = data
-	err := s.link.Write(s.closed,-1, d)
-	if err != nil {
-		s.Close()
+	err := s.sendMessage(cancel,-1, d)
+	if err == ErrCancelled {
+		return err
+	} else if err != nil {
+		s.closeWithError(fmt.Errorf("sending data failed: %w", err))
 	}
 	return err
 }
 
 func (s *LinkSession) handlePings() {
-	defer s.Close()
 	p := linkMessage{}
 	p.Kind = PING
+	timer := s.link.clock.NewTimer(s.link.conf.KeepaliveInterval)
+	defer timer.Stop()
 	for {
-		if s.isClosed() {
+		select {
+		case <-timer.C():
+			timer.Reset(s.link.conf.KeepaliveInterval)
+		case <-s.closed:
 			return
 		}
-		time.Sleep(1 * time.Second)
-		err := s.link.Write(s.closed,-1, p)
+		err := s.sendMessage(s.closed,-1, p)
 		if err != nil {
+			s.closeWithError(fmt.Errorf("sending ping failed: %w", err))
 			return
 		}
 	}
 }
 
 func (s *LinkSession) handleTimeout() {
-	defer s.Close()
-
-	duration := 5 * time.Second
+	duration := s.link.conf.KeepaliveTimeout
 
-	timer := time.NewTimer(duration)
+	timer := s.link.clock.NewTimer(duration)
 	defer timer.Stop() // Might not be needed....
 
 	for {
 		select {
 		case <-s.keepAliveChannel:
 			timer.Reset(duration)
-		case <-timer.C:
+		case <-timer.C():
+			s.log.Warn("keepalive timeout", "silence", duration)
+			s.closeWithError(ErrKeepaliveTimeout)
 			return
 		case <-s.closed:
 			return
@@ -324,45 +561,73 @@ func (s *LinkSession) handleTimeout() {
 
 }
 
+// keepAlive tells handleTimeout the peer is still there.
+func (s *LinkSession) keepAlive() {
+	select {
+	case s.keepAliveChannel <- struct{}{}:
+	case <-s.closed:
+	}
+}
+
 func (s *LinkSession) handleMessages() {
-	defer s.Close()
 	for {
-		m, err := s.link.Read(s.closed,-1)
+		m, err := s.readMessage(s.closed,-1)
 		if err != nil {
+			s.closeWithError(err)
 			return
 		}
 		switch m.Kind {
 		case PING:
-			s.keepAliveChannel <- struct{}{}
+			s.keepAlive()
+		case CLOSE:
+			s.log.Debug("peer closed session")
+			s.closeWithError(ErrPeerClosed)
+			return
 		case ACK:
-			s.keepAliveChannel <- struct{}{}
-			// asynchronously send the ack
-			go func() {
-			    select {
-			    case s.ackChannel <- m.Seqnum:
-			    case <-time.After(10 * time.Millisecond):
-				    // Noone is listening, discard ack.
-				    // They will have to try again.
-			    }
-			} ()
+			s.keepAlive()
+			if m.Seqnum < firstSeqnum {
+				// The handshake ACK again, the acceptor has not seen an
+				// ACKACK yet.
+				if s.key.dialed {
+					s.sendMessage(s.closed,-1, linkMessage{Kind: ACKACK})
+				}
+				continue
+			}
+			select {
+			case s.ackChannel <- m:
+			default:
+				// Nobody has taken the earlier acks, discard this one.
+				// The writer will have to try again.
+			}
 		case DATA:
-			s.keepAliveChannel <- struct{}{}
+			s.keepAlive()
 			switch {
 			case m.Seqnum == s.expectedSeqnum:
 				_, err := s.readBuff.Write(m.Data)
 				if err == concurrentbuffer.BufferFull {
 					// Drop packet.
+					s.updateStats(func(st *SessionStats) {
+						st.BufferFullDrops++
+					})
 				} else if err != nil {
+					s.closeWithError(err)
 					return
 				} else if err == nil {
 					s.expectedSeqnum++
-					err := s.sendAck(m.Seqnum)
+					s.updateStats(func(st *SessionStats) {
+						st.PayloadBytesReceived += uint64(len(m.Data))
+						st.RecvSeqnum = s.expectedSeqnum
+					})
+					err := s.sendAck(m.Seqnum, m.Attempt)
 					if err != nil {
 						return
 					}
 				}
 			case m.Seqnum < s.expectedSeqnum:
-				err := s.sendAck(m.Seqnum)
+				s.updateStats(func(st *SessionStats) {
+					st.DuplicateFrames++
+				})
+				err := s.sendAck(m.Seqnum, m.Attempt)
 				if err != nil {
 					return
 				}
@@ -374,61 +639,187 @@ func (s *LinkSession) handleMessages() {
 	}
 }
 
+// Read returns io.EOF once the peer has closed the session and all the
+// data it sent has been read. Otherwise, after the session has closed,
+// it returns the cause reported by Err.
 func (s *LinkSession) Read(b []byte) (int, error) {
 	return s.readBuff.Read(b)
 }
 
+// WriteTo writes received data to w until the peer closes the session,
+// handing over whole buffered segments rather than copying them.
+func (s *LinkSession) WriteTo(w io.Writer) (int64, error) {
+	return s.readBuff.WriteTo(w)
+}
+
+// ReadFrom sends data read from r until it returns io.EOF. Each read is
+// sized to the current segment size, so it goes out as a single DATA
+// frame without being copied or chunked again.
+// writeLock is only held while sending, not while r blocks, so other
+// writers can interleave whole segments.
+func (s *LinkSession) ReadFrom(r io.Reader) (int64, error) {
+	var total int64
+	buf := make([]byte, s.link.conf.MaxSegmentSize)
+	for {
+		s.writeLock.Lock()
+		size := s.seg.size
+		s.writeLock.Unlock()
+		n, err := r.Read(buf[:size])
+		if n > 0 {
+			s.writeLock.Lock()
+			nsent, werr := s._write(buf[:n])
+			s.writeLock.Unlock()
+			total += int64(nsent)
+			if werr != nil {
+				return total, werr
+			}
+		}
+		if err == io.EOF {
+			return total, nil
+		} else if err != nil {
+			return total, err
+		}
+	}
+}
+
 
 // Actual write logic, chunking is done in Write which defers to here.
+// writeLock must be held.
 func (s *LinkSession) _write(b []byte) (int, error) {
-	s.writeLock.Lock()
-	defer s.writeLock.Unlock()
-
+	if s.writeErr != nil {
+		return 0, s.writeErr
+	}
 	seqnum := s.curSeqnum
-
+	full := len(b) == s.seg.size
+	frameErrors := s.link.Stats().frameErrors()
+	attempts := 0
+	// Timeouts that were based on a measured round trip, only those say
+	// the segment was lost rather than the link being slower than
+	// thought.
+	lost := 0
+	// When each copy was sent.
+	var sentAt []time.Time
+
+	// Whether a copy made it to the link, the peer may have it.
+	sent := false
+
+	s.updateStats(func(st *SessionStats) {
+		st.Unacked = len(b)
+	})
+	defer s.updateStats(func(st *SessionStats) {
+		st.Unacked = 0
+	})
+
+	cancel, stop := s.writeCancel()
+	defer func() { stop() }()
 	for {
 		if s.isClosed() {
-			return 0, errors.New("session closed")
+			return 0, s.err
 		}
-		err := s.sendData(seqnum, b)
-		if err != nil {
-			s.Close()
-			return 0, err
+		if s.writeDeadlinePassed() {
+			if sent {
+				s.writeErr = os.ErrDeadlineExceeded
+			}
+			return 0, os.ErrDeadlineExceeded
 		}
-		select {
-		case recievedSeqnum := <-s.ackChannel:
-			// if we have recieved an ack we aren't expecting, then
-			// keep reading all the useless acks to clear them away.
-			// Maybe we will find the correct ack blocked on the channel.
-			// In normal operation I don't think this will happen.
-		    for recievedSeqnum != seqnum {
-		        select {
-		            case recievedSeqnum = <-s.ackChannel:
-		            default:
-		                goto exit
-		        }
-		    }
-		    exit:
-			
-			if recievedSeqnum == seqnum {
-				s.curSeqnum++
-				return len(b), nil
+		if isDone(cancel) {
+			// The deadline was moved after it was read.
+			stop()
+			cancel, stop = s.writeCancel()
+		}
+		attempts++
+		if attempts > 1 {
+			s.log.Debug("retransmitting segment", "seqnum", seqnum, "attempt", attempts, "len", len(b))
+		}
+		sentAt = append(sentAt, s.link.clock.Now())
+		s.updateStats(func(st *SessionStats) {
+			st.DataFramesSent++
+			if attempts > 1 {
+				st.Retransmissions++
 			}
-		case <-time.After(5 * time.Millisecond): // XXX make this based of round trip.
-			//Resend via looping.
-		case <-s.closed:
-			//will quit on loop
+		})
+		err := s.sendData(cancel, seqnum, uint(attempts), b)
+		if err == ErrCancelled {
+			// The deadline passed or the session closed, see above.
+			continue
+		} else if err != nil {
+			// sendData has closed the session.
+			return 0, s.err
+		}
+		sent = true
+		ack, ok := s.waitAck(cancel, seqnum, s.rto.rto)
+		if ok {
+			s.curSeqnum++
+			corrupt := s.link.Stats().frameErrors() != frameErrors
+			switch {
+			case corrupt || lost > 1:
+				s.seg.update(full, false)
+			case attempts == 1:
+				s.seg.update(full, true)
+			}
+			switch {
+			case ack.Attempt >= 1 && ack.Attempt <= uint(len(sentAt)):
+				s.rto.sample(s.link.clock.Since(sentAt[ack.Attempt-1]))
+			case attempts == 1:
+				// An older peer that doesn't echo the attempt, the ack
+				// of a resent segment could be for any copy.
+				s.rto.sample(s.link.clock.Since(sentAt[0]))
+			}
+			s.updateStats(func(st *SessionStats) {
+				st.RTT = s.rto.srtt
+				st.RetransmitTimeout = s.rto.rto
+				st.PayloadBytesSent += uint64(len(b))
+				st.SegmentSize = s.seg.size
+				st.SendSeqnum = s.curSeqnum
+			})
+			return len(b), nil
+		}
+		if isDone(cancel) {
+			continue
+		}
+		if s.rto.sampled() {
+			lost++
 		}
+		s.rto.backoff()
+		s.updateStats(func(st *SessionStats) {
+			st.RetransmitTimeout = s.rto.rto
+		})
+		// Resend via looping.
 	}
 
 }
 
+// waitAck waits up to wait for the ack of seqnum and returns it, ok
+// reports whether it arrived. It gives up early once cancel is closed.
+func (s *LinkSession) waitAck(cancel chan struct{}, seqnum uint, wait time.Duration) (linkMessage, bool) {
+	timeout := s.link.clock.NewTimer(wait)
+	defer timeout.Stop()
+	for {
+		select {
+		case ack := <-s.ackChannel:
+			if ack.Seqnum == seqnum {
+				return ack, true
+			}
+			// An ack for an earlier segment that was sent more than
+			// once. Resending now would only cause more stray acks, keep
+			// waiting for the right one.
+		case <-timeout.C():
+			return linkMessage{}, false
+		case <-cancel:
+			return linkMessage{}, false
+		}
+	}
+}
+
 func (s *LinkSession) Write(b []byte) (int, error) {
+	s.writeLock.Lock()
+	defer s.writeLock.Unlock()
+
 	n := 0
 	idx := 0
 	for n != len(b) {
-	    // lets send in 128 byte chunks so link errors don't cause things to never succeed.
-	    endIdx := idx + 128
+	    // send in segments sized to the link quality so link errors don't cause things to never succeed.
+	    endIdx := idx + s.seg.size
 	    if endIdx > len(b) {
 	        endIdx = len(b)
 	    }
@@ -444,12 +835,55 @@ func (s *LinkSession) Write(b []byte) (int, error) {
 }
 
 func (s *LinkSession) Close() error {
+	if s.transition(ESTABLISHED, CLOSING, nil) {
+		// Best effort, if the CLOSE is lost the peer will notice
+		// through its keepalive timeout.
+		c := linkMessage{}
+		c.Kind = CLOSE
+		s.sendMessage(s.closed, 100*time.Millisecond, c)
+	}
+	s.closeWithError(nil)
+	return nil
+}
+
+// closeWithError shuts the session down, err says why and is nil for an
+// explicit Close. Only the first call has any effect, its err is recorded
+// as the cause.
+func (s *LinkSession) closeWithError(err error) {
 	f := func() {
+		if err != nil {
+			s.log.Info("session closed", "reason", err)
+		} else {
+			s.log.Info("session closed", "reason", "closed locally")
+			err = ErrSessionClosed
+		}
+		s.err = err
+		// Sessions that never got going, or were closed cleanly by
+		// either end, are CLOSED. Anything else was lost.
+		to := LOST
+		if err == ErrSessionClosed || err == ErrPeerClosed || s.State() == CONNECTING {
+			to = CLOSED
+		}
+		s.finish(to, err)
 		close(s.closed)
-		s.readBuff.Close()
+		s.link.unregister(s)
+		if err == ErrPeerClosed {
+			s.readBuff.CloseWithError(io.EOF)
+		} else {
+			s.readBuff.CloseWithError(err)
+		}
 	}
 	s.closeOnce.Do(f)
-	return nil
+}
+
+// Err returns nil while the session is open, and why it closed after.
+func (s *LinkSession) Err() error {
+	select {
+	case <-s.closed:
+		return s.err
+	default:
+		return nil
+	}
 }
 
 func (s *LinkSession) isClosed() bool {
@@ -469,14 +903,73 @@ func (s *LinkSession) RemoteAddr() net.Addr {
 	return &dummyLinkAddr{}
 }
 
+// SetDeadline sets both the read and the write deadline.
 func (s *LinkSession) SetDeadline(t time.Time) error {
-	panic("unimplemented")
+	err := s.SetReadDeadline(t)
+	if err != nil {
+		return err
+	}
+	return s.SetWriteDeadline(t)
 }
 
+// SetReadDeadline makes Read fail with os.ErrDeadlineExceeded once t has
+// passed, the zero time removes the deadline. Deadlines use the wall
+// clock, not the configured Clock.
 func (s *LinkSession) SetReadDeadline(t time.Time) error {
-	panic("unimplemented")
+	return s.readBuff.SetReadDeadline(t)
 }
 
+// SetWriteDeadline makes Write and ReadFrom fail with
+// os.ErrDeadlineExceeded once t has passed, the zero time removes the
+// deadline. A write fails as soon as the deadline passes, also while the
+// wire is stalled, and a new deadline applies from the next segment it
+// sends. If it passes while a segment is waiting for its ack, every
+// later write fails too, as the peer may or may not have received it.
+// Like read deadlines this uses the wall clock.
 func (s *LinkSession) SetWriteDeadline(t time.Time) error {
-	panic("unimplemented")
+	s.deadlineLock.Lock()
+	defer s.deadlineLock.Unlock()
+	s.writeDeadline = t
+	return nil
+}
+
+// writeCancel returns a channel that is closed once the session closes
+// or the write deadline passes. Call stop when done with it.
+func (s *LinkSession) writeCancel() (cancel chan struct{}, stop func()) {
+	s.deadlineLock.Lock()
+	deadline := s.writeDeadline
+	s.deadlineLock.Unlock()
+	if deadline.IsZero() {
+		return s.closed, func() {}
+	}
+	cancel = make(chan struct{})
+	done := make(chan struct{})
+	timer := time.NewTimer(time.Until(deadline))
+	go func() {
+		defer close(cancel)
+		select {
+		case <-timer.C:
+		case <-s.closed:
+		case <-done:
+		}
+	}()
+	return cancel, func() {
+		timer.Stop()
+		close(done)
+	}
+}
+
+func isDone(ch chan struct{}) bool {
+	select {
+	case <-ch:
+		return true
+	default:
+		return false
+	}
+}
+
+func (s *LinkSession) writeDeadlinePassed() bool {
+	s.deadlineLock.Lock()
+	defer s.deadlineLock.Unlock()
+	return !s.writeDeadline.IsZero() && !time.Now().Before(s.writeDeadline)
 }
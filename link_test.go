@@ -1,26 +1,33 @@
 package link
 
 import (
+	"bytes"
+	"errors"
+	"flag"
+	"io"
+	"log/slog"
+	"mako/serial/link/channelsim"
 	"mako/serial/link/concurrentbuffer"
+	"os"
+	"strings"
+	"sync"
+	"sync/atomic"
 	"testing"
 	"time"
 )
 
 func TestLinkChat(t *testing.T) {
 
-	b1 := concurrentbuffer.New(0)
-	b2 := concurrentbuffer.New(0)
-
-	l1 := CreateLink(b1, b2)
-	l2 := CreateLink(b2, b1)
+	l1, l2 := Pipe(PipeConfig{})
 
 	done := make(chan struct{})
 
 	// server
 	go func() {
-		con, err := l1.Listen()
+		con, err := l1.Accept()
 		if err != nil {
-			t.Fatal("listen failed...")
+			t.Error("accept failed...")
+			return
 		}
 		_, err = con.Write([]byte("olleh"))
 		if err != nil {
@@ -62,7 +69,8 @@ func TestLinkChat(t *testing.T) {
 	go func() {
 		con, err := l2.Dial()
 		if err != nil {
-			t.Fatal("listen failed...")
+			t.Error("dial failed...")
+			return
 		}
 
 		_, err = con.Write([]byte("hello"))
@@ -110,3 +118,302 @@ func TestLinkChat(t *testing.T) {
 		}
 	}
 }
+
+// chunkReader returns one chunk from its channel per Read and counts the
+// calls.
+type chunkReader struct {
+	chunks chan string
+	reads  atomic.Int32
+}
+
+func (r *chunkReader) Read(b []byte) (int, error) {
+	r.reads.Add(1)
+	return copy(b, <-r.chunks), nil
+}
+
+func (r *chunkReader) Close() error {
+	return nil
+}
+
+func TestNoReadsAfterClose(t *testing.T) {
+	r := &chunkReader{chunks: make(chan string)}
+	l := CreateLink(r, concurrentbuffer.New(0))
+
+	r.chunks <- "garbage~"
+	deadline := time.Now().Add(5 * time.Second)
+	for l.Stats().DecodeErrors == 0 {
+		if time.Now().After(deadline) {
+			t.Fatal("frame not read")
+		}
+		time.Sleep(time.Millisecond)
+	}
+	l.Close()
+
+	// Completes the read that was waiting when the link closed.
+	r.chunks <- "garbage~"
+	time.Sleep(50 * time.Millisecond)
+	if n := r.reads.Load(); n != 2 {
+		t.Fatal("read after close", n)
+	}
+	if n := l.Stats().DecodeErrors; n != 1 {
+		t.Fatal("frame handled after close", n)
+	}
+}
+
+type lockedBuffer struct {
+	sync.Mutex
+	b bytes.Buffer
+}
+
+func (lb *lockedBuffer) Write(p []byte) (int, error) {
+	lb.Lock()
+	defer lb.Unlock()
+	return lb.b.Write(p)
+}
+
+func (lb *lockedBuffer) String() string {
+	lb.Lock()
+	defer lb.Unlock()
+	return lb.b.String()
+}
+
+func TestLinkLogging(t *testing.T) {
+	var logs lockedBuffer
+	conf := DefaultConfig()
+	conf.Logger = slog.New(slog.NewTextHandler(&logs, &slog.HandlerOptions{Level: slog.LevelDebug}))
+
+	l1, l2 := Pipe(PipeConfig{Link: conf})
+	defer l2.Close()
+
+	// The dialed end is left open, so the accepted one is the first to
+	// close. Accepted sessions are running before Accept returns.
+	go l2.Dial()
+
+	con, err := l1.Accept()
+	if err != nil {
+		t.Fatal(err)
+	}
+	con.Close()
+	l1.Close()
+
+	for _, msg := range []string{
+		"handshake: received CONNECT",
+		"handshake: session accepted",
+		`msg="session closed" session=1 dialed=false reason="closed locally"`,
+		`msg="link closed" reason="closed locally"`,
+	} {
+		if !strings.Contains(logs.String(), msg) {
+			t.Errorf("expected %q in logs:\n%s", msg, logs.String())
+		}
+	}
+}
+
+var channelSeed = flag.Int64("channelseed", 0, "seed for simulated channels, zero picks one")
+
+// testChannels creates the simulated channels for a test. Their seeds
+// are derived from one base seed, which is logged if the test fails so
+// the failure can be reproduced with -channelseed.
+type testChannels struct {
+	seed int64
+	n    int64
+}
+
+func newTestChannels(t *testing.T) *testChannels {
+	seed := *channelSeed
+	if seed == 0 {
+		seed = time.Now().UnixNano()
+	}
+	t.Cleanup(func() {
+		if t.Failed() {
+			t.Logf("rerun with -channelseed=%d", seed)
+		}
+	})
+	return &testChannels{seed: seed}
+}
+
+// config returns conf seeded for the next channel of the test.
+func (tc *testChannels) config(conf channelsim.Config) *channelsim.Config {
+	conf.Seed = tc.seed + tc.n
+	tc.n++
+	return &conf
+}
+
+func TestLinkNoisyChannel(t *testing.T) {
+	conf := channelsim.Config{
+		ByteErrorRate: 0.0002,
+		LossRate:      0.0001,
+		InsertRate:    0.0001,
+		DuplicateRate: 0.0001,
+	}
+	channels := newTestChannels(t)
+	l1, l2 := Pipe(PipeConfig{
+		Forward:  channels.config(conf),
+		Backward: channels.config(conf),
+	})
+	defer l1.Close()
+	defer l2.Close()
+
+	s1, s2 := connectedSessions(t, l1, l2)
+
+	data := make([]byte, 16*1024)
+	for idx := range data {
+		data[idx] = byte(idx)
+	}
+
+	written := make(chan error, 1)
+	go func() {
+		_, err := s2.Write(data)
+		written <- err
+	}()
+
+	got := make([]byte, len(data))
+	_, err := io.ReadFull(s1, got)
+	if err != nil {
+		t.Fatal(err)
+	}
+	err = <-written
+	if err != nil {
+		t.Fatal(err)
+	}
+	if !bytes.Equal(data, got) {
+		t.Fatal("data corrupted in transit")
+	}
+}
+
+func TestSessionReadDeadline(t *testing.T) {
+	l1, l2 := Pipe(PipeConfig{})
+	defer l1.Close()
+	defer l2.Close()
+	s1, s2 := connectedSessions(t, l1, l2)
+
+	s1.SetReadDeadline(time.Now().Add(20 * time.Millisecond))
+	_, err := s1.Read(make([]byte, 16))
+	if !errors.Is(err, os.ErrDeadlineExceeded) {
+		t.Fatal("read should time out", err)
+	}
+	if s1.State() != ESTABLISHED {
+		t.Fatal("a timed out read should not close the session")
+	}
+
+	s1.SetReadDeadline(time.Time{})
+	transfer(t, s2, s1, []byte("hello"))
+}
+
+func TestSessionReadFromDoesNotBlockWrites(t *testing.T) {
+	l1, l2 := Pipe(PipeConfig{})
+	defer l1.Close()
+	defer l2.Close()
+	s1, s2 := connectedSessions(t, l1, l2)
+
+	// ReadFrom waits on r with nothing to send.
+	r, w := io.Pipe()
+	defer w.Close()
+	go s1.ReadFrom(r)
+	time.Sleep(10 * time.Millisecond)
+	transfer(t, s1, s2, []byte("hello"))
+}
+
+func TestSessionWriteDeadline(t *testing.T) {
+	l1, l2 := Pipe(PipeConfig{})
+	defer l1.Close()
+	defer l2.Close()
+	s1, s2 := connectedSessions(t, l1, l2)
+
+	s1.SetWriteDeadline(time.Now().Add(-time.Second))
+	n, err := s1.Write([]byte("hello"))
+	if n != 0 || !errors.Is(err, os.ErrDeadlineExceeded) {
+		t.Fatal("write should time out", n, err)
+	}
+	// Nothing was sent, so the session can carry on.
+	s1.SetWriteDeadline(time.Time{})
+	transfer(t, s1, s2, []byte("hello"))
+
+	s1.SetDeadline(time.Now().Add(-time.Second))
+	_, err = s1.Read(make([]byte, 16))
+	if !errors.Is(err, os.ErrDeadlineExceeded) {
+		t.Fatal("SetDeadline should set the read deadline", err)
+	}
+}
+
+func TestSessionWriteDeadlineUnacked(t *testing.T) {
+	rules := newFrameRules(&frameRule{kind: DATA, seqnum: -1, action: dropFrame})
+	l1, l2 := interceptedLinks(t, Config{}, rules, nil)
+	s1, _ := connectedSessions(t, l1, l2)
+
+	s1.SetWriteDeadline(time.Now().Add(20 * time.Millisecond))
+	_, err := s1.Write([]byte("hello"))
+	if !errors.Is(err, os.ErrDeadlineExceeded) {
+		t.Fatal("write should time out", err)
+	}
+	// The peer may or may not have the segment, later writes can't
+	// continue the stream.
+	s1.SetWriteDeadline(time.Time{})
+	_, err = s1.Write([]byte("again"))
+	if !errors.Is(err, os.ErrDeadlineExceeded) {
+		t.Fatal("writes after a timed out segment should fail", err)
+	}
+}
+
+// stallWriter blocks every Write while stall is held.
+type stallWriter struct {
+	io.WriteCloser
+	stall sync.Mutex
+}
+
+func (w *stallWriter) Write(b []byte) (int, error) {
+	w.stall.Lock()
+	w.stall.Unlock()
+	return w.WriteCloser.Write(b)
+}
+
+func TestSessionWriteDeadlineStalledWire(t *testing.T) {
+	b1 := concurrentbuffer.New(0)
+	b2 := concurrentbuffer.New(0)
+	w := &stallWriter{WriteCloser: b2}
+	l1 := CreateLink(b1, w)
+	l2 := CreateLink(b2, b1)
+	defer l1.Close()
+	defer l2.Close()
+	s1, _ := connectedSessions(t, l1, l2)
+
+	w.stall.Lock()
+	defer w.stall.Unlock()
+	start := time.Now()
+	s1.SetWriteDeadline(start.Add(50 * time.Millisecond))
+	_, err := s1.Write([]byte("hello"))
+	if !errors.Is(err, os.ErrDeadlineExceeded) {
+		t.Fatal("write should time out", err)
+	}
+	if d := time.Since(start); d > time.Second {
+		t.Fatal("the deadline was overrun", d)
+	}
+}
+
+func TestSessionCopy(t *testing.T) {
+	l1, l2 := Pipe(PipeConfig{})
+	defer l1.Close()
+	defer l2.Close()
+	s1, s2 := connectedSessions(t, l1, l2)
+
+	data := testData(100000)
+	sent := make(chan error, 1)
+	go func() {
+		// ReadFrom is picked up by io.Copy.
+		_, err := io.Copy(s2, bytes.NewReader(data))
+		s2.Close()
+		sent <- err
+	}()
+
+	var got bytes.Buffer
+	// As is WriteTo, which returns once the peer has closed.
+	n, err := io.Copy(&got, s1)
+	if err != nil || n != int64(len(data)) {
+		t.Fatal("copy failed", n, err)
+	}
+	if !bytes.Equal(got.Bytes(), data) {
+		t.Fatal("data corrupted in transit")
+	}
+	if err := <-sent; err != nil {
+		t.Fatal(err)
+	}
+}
@@ -1,6 +1,7 @@
 package link
 
 import (
+	"bufio"
 	"bytes"
 	"encoding/base64"
 	"encoding/binary"
@@ -17,12 +18,68 @@ const (
 	ACKACK
 	PING
 	DATA
+	CLOSE
+	DATAGRAM
 )
 
+var messageKindNames = []string{"CONNECT", "ACK", "ACKACK", "PING", "DATA", "CLOSE", "DATAGRAM"}
+
+func (k messageKind) String() string {
+	if k < 0 || int(k) >= len(messageKindNames) {
+		return fmt.Sprintf("KIND(%d)", int(k))
+	}
+	return messageKindNames[k]
+}
+
+// KindName returns the name of a message kind, such as "DATA".
+func KindName(kind uint8) string {
+	return messageKind(kind).String()
+}
+
 type linkMessage struct {
 	Kind   uint8
 	Seqnum uint
-	Data   []byte
+	// Which copy of a DATA frame this is, counting from 1. Its ACK echoes
+	// it, so resent segments can be timed too. Zero from older peers.
+	Attempt uint
+	Data    []byte
+	// The session the message belongs to, see dispatch.
+	Session   uint32
+	Initiator bool
+	// Set on DATAGRAM messages from the initiator, see Association.
+	Target string
+}
+
+// Frame is a decoded link message, for tools that inspect link traffic.
+type Frame struct {
+	Kind   uint8
+	Seqnum uint
+	// Which copy of a DATA frame this is, or which copy an ACK answers.
+	Attempt uint
+	Data    []byte
+	// Session id, and whether the frame came from the side that dialed
+	// the session.
+	Session   uint32
+	Initiator bool
+	// What a DATAGRAM frame's association is for.
+	Target string
+}
+
+// Every frame on the wire ends with this.
+const frameDelimiter = '~'
+
+// ReadFrame reads the next raw frame from r, delimiter included, using
+// the same framing as Link. A final frame missing its delimiter is
+// returned along with the error.
+func ReadFrame(r *bufio.Reader) ([]byte, error) {
+	return r.ReadBytes(frameDelimiter)
+}
+
+// DecodeFrame decodes a raw frame returned by ReadFrame. Frames that
+// arrived corrupted fail with an error wrapping ErrChecksum.
+func DecodeFrame(raw []byte) (Frame, error) {
+	m, err := decodeMessage(raw)
+	return Frame(m), err
 }
 
 func Init() {
@@ -31,7 +88,7 @@ func Init() {
 
 func decodeMessage(b64data []byte) (linkMessage, error) {
 
-	if b64data[len(b64data)-1] == '~' {
+	if len(b64data) != 0 && b64data[len(b64data)-1] == frameDelimiter {
 		b64data = b64data[0 : len(b64data)-1]
 	}
 
@@ -52,7 +109,7 @@ func decodeMessage(b64data []byte) (linkMessage, error) {
 	gobbuff := bytes.NewBuffer(data[4:])
 	actualchecksum := adler32.Checksum(gobbuff.Bytes())
 	if wantedchecksum != actualchecksum {
-		return linkMessage{}, fmt.Errorf("checksum failed - expected %X got %X", wantedchecksum, actualchecksum)
+		return linkMessage{}, fmt.Errorf("%w - expected %X got %X", ErrChecksum, wantedchecksum, actualchecksum)
 	}
 
 	dec := gob.NewDecoder(gobbuff)
@@ -82,6 +139,6 @@ func encodeMessage(m *linkMessage) ([]byte, error) {
 	var b64encoded []byte = make([]byte, base64.StdEncoding.EncodedLen(len(cksumWithGobBytes))+1)
 	base64.StdEncoding.Encode(b64encoded, cksumWithGobBytes)
 	// Add delimiter
-	b64encoded[len(b64encoded)-1] = '~'
+	b64encoded[len(b64encoded)-1] = frameDelimiter
 	return b64encoded, nil
 }
@@ -0,0 +1,199 @@
+package link
+
+// A link carries any number of sessions at once. Every message names its
+// session with an id picked by the side that dialed it, and the Initiator
+// flag says which side sent it, so ids picked by both ends never clash.
+// readMessages hands each message to dispatch, which passes it to its
+// session without waiting, so a slow session can't hold up the others. A CONNECT for a new id creates the session and answers the
+// handshake on its own goroutine, then queues the session for Accept.
+// Session ids start at 1, a message for session 0 comes from a peer that
+// predates sessions and takes the link down with ErrIncompatiblePeer.
+
+import (
+	"time"
+)
+
+// Messages queued for a session, further ones are dropped rather than
+// holding up the other sessions on the link.
+const sessionInboxSize = 16
+
+// Sessions in their handshake or queued for Accept, further CONNECTs are
+// dropped and have to be resent.
+const acceptQueueSize = 16
+
+type sessionKey struct {
+	id uint32
+	// Whether this end dialed the session.
+	dialed bool
+}
+
+// register adds s to the session table, it fails if the key is taken.
+func (link *Link) register(s *LinkSession) bool {
+	link.sessionsLock.Lock()
+	defer link.sessionsLock.Unlock()
+	if _, ok := link.sessions[s.key]; ok {
+		return false
+	}
+	link.sessions[s.key] = s
+	return true
+}
+
+// unregister removes s from the session table. The keys of sessions the
+// peer dialed are remembered for as long as it may resend their CONNECT,
+// so a late copy doesn't start the session again.
+func (link *Link) unregister(s *LinkSession) {
+	link.sessionsLock.Lock()
+	defer link.sessionsLock.Unlock()
+	if link.sessions[s.key] != s {
+		return
+	}
+	delete(link.sessions, s.key)
+	if s.key.dialed {
+		return
+	}
+	now := link.clock.Now()
+	for key, closed := range link.recentlyClosed {
+		if now.Sub(closed) > link.connectLifetime() {
+			delete(link.recentlyClosed, key)
+		}
+	}
+	link.recentlyClosed[s.key] = now
+}
+
+// connectLifetime is how long after the first copy a dialer may still be
+// resending a CONNECT.
+func (link *Link) connectLifetime() time.Duration {
+	return handshakeAttempts * link.conf.HandshakeTimeout
+}
+
+// acceptConnect creates and registers a session for a new CONNECT, it
+// returns nil if the CONNECT is a late copy for a closed session, too
+// many sessions are waiting for Accept or the link is down.
+func (link *Link) acceptConnect(key sessionKey) *LinkSession {
+	link.sessionsLock.Lock()
+	defer link.sessionsLock.Unlock()
+	if link.IsDown() {
+		return nil
+	}
+	if closed, ok := link.recentlyClosed[key]; ok && link.clock.Since(closed) <= link.connectLifetime() {
+		link.log.Debug("dropped CONNECT for a closed session", "session", key.id)
+		return nil
+	}
+	if link.pendingAccepts >= acceptQueueSize {
+		link.log.Debug("accept queue full, dropped CONNECT", "session", key.id)
+		return nil
+	}
+	if _, ok := link.sessions[key]; ok {
+		return nil
+	}
+	s := newSession(link, key)
+	link.sessions[key] = s
+	link.pendingAccepts++
+	return s
+}
+
+// accepted is called once a session from acceptConnect has been taken by
+// Accept or failed its handshake.
+func (link *Link) accepted() {
+	link.sessionsLock.Lock()
+	defer link.sessionsLock.Unlock()
+	link.pendingAccepts--
+}
+
+// newSessionID returns an id for a session dialed from this end.
+func (link *Link) newSessionID() uint32 {
+	link.sessionsLock.Lock()
+	defer link.sessionsLock.Unlock()
+	link.nextSessionID++
+	return link.nextSessionID
+}
+
+// dispatch routes a received message.
+func (link *Link) dispatch(m linkMessage) {
+	if m.Session == 0 {
+		link.closeWithError(ErrIncompatiblePeer)
+		return
+	}
+	key := sessionKey{id: m.Session, dialed: !m.Initiator}
+	if m.Kind == DATAGRAM {
+		link.dispatchDatagram(key, m)
+		return
+	}
+
+	link.sessionsLock.Lock()
+	s := link.sessions[key]
+	link.sessionsLock.Unlock()
+	if s == nil && m.Kind == CONNECT && m.Initiator {
+		s = link.acceptConnect(key)
+		if s != nil {
+			s.target = string(m.Data)
+			go s.acceptHandshake()
+		}
+		return
+	}
+	if s == nil {
+		link.log.Debug("dropped message for unknown session", "session", m.Session, "kind", messageKind(m.Kind))
+		return
+	}
+	select {
+	case s.inbox <- m:
+	default:
+		// The session has fallen behind. Dropping is safe, DATA and
+		// handshake messages are resent and a lost CLOSE is noticed by
+		// the keepalive.
+		s.updateStats(func(st *SessionStats) {
+			st.InboxDrops++
+		})
+		s.log.Debug("session inbox full, dropped message", "kind", messageKind(m.Kind))
+	}
+}
+
+// nextConnect waits for a session that has completed its handshake.
+func (link *Link) nextConnect(cancel chan struct{}) (*LinkSession, error) {
+	select {
+	case s := <-link.connects:
+		link.accepted()
+		return s, nil
+	case <-link.closed:
+		return nil, link.err
+	case <-cancel:
+		return nil, ErrCancelled
+	}
+}
+
+// readMessage returns the next message for the session, failing like
+// Link.Write.
+func (s *LinkSession) readMessage(cancel chan struct{}, timeout time.Duration) (linkMessage, error) {
+	var timeoutChan <-chan time.Time
+
+	if timeout > 0 {
+		timer := s.link.clock.NewTimer(timeout)
+		timeoutChan = timer.C()
+		defer timer.Stop()
+	}
+
+	// Messages that arrived before the link went down still count.
+	select {
+	case m := <-s.inbox:
+		return m, nil
+	default:
+	}
+
+	select {
+	case m := <-s.inbox:
+		return m, nil
+	case <-timeoutChan:
+		return linkMessage{}, ErrTimeout
+	case <-s.link.closed:
+		return linkMessage{}, s.link.err
+	case <-cancel:
+		return linkMessage{}, ErrCancelled
+	}
+}
+
+// sendMessage sends m as part of the session.
+func (s *LinkSession) sendMessage(cancel chan struct{}, timeout time.Duration, m linkMessage) error {
+	m.Session = s.key.id
+	m.Initiator = s.key.dialed
+	return s.link.Write(cancel, timeout, m)
+}
@@ -0,0 +1,241 @@
+package link
+
+import (
+	"bytes"
+	"errors"
+	"io"
+	"net"
+	"sync"
+	"testing"
+	"time"
+)
+
+// Sessions dialed from both ends at once start with the same ids, they
+// must not be confused with each other.
+func TestConcurrentSessions(t *testing.T) {
+	l1, l2 := Pipe(PipeConfig{})
+	defer l1.Close()
+	defer l2.Close()
+
+	const n = 4
+	var wg sync.WaitGroup
+	for _, pair := range [][2]*Link{{l1, l2}, {l2, l1}} {
+		dialer, acceptor := pair[0], pair[1]
+		wg.Add(2)
+		go func() {
+			defer wg.Done()
+			for i := 0; i < n; i++ {
+				con, err := acceptor.Accept()
+				if err != nil {
+					t.Error(err)
+					return
+				}
+				// Echo everything back.
+				go func() {
+					io.Copy(con, con)
+					con.Close()
+				}()
+			}
+		}()
+		go func() {
+			defer wg.Done()
+			var sessions sync.WaitGroup
+			for i := 0; i < n; i++ {
+				sessions.Add(1)
+				go func(i int) {
+					defer sessions.Done()
+					con, err := dialer.Dial()
+					if err != nil {
+						t.Error(err)
+						return
+					}
+					defer con.Close()
+					data := bytes.Repeat([]byte{byte(i)}, 1000)
+					go con.Write(data)
+					got := make([]byte, len(data))
+					_, err = io.ReadFull(con, got)
+					if err != nil {
+						t.Error(err)
+						return
+					}
+					if !bytes.Equal(got, data) {
+						t.Error("sessions mixed up")
+					}
+				}(i)
+			}
+			sessions.Wait()
+		}()
+	}
+	wg.Wait()
+}
+
+func TestDialTarget(t *testing.T) {
+	l1, l2 := Pipe(PipeConfig{})
+	defer l1.Close()
+	defer l2.Close()
+
+	accepted := make(chan net.Conn, 1)
+	go func() {
+		con, err := l1.Accept()
+		if err != nil {
+			t.Error(err)
+		}
+		accepted <- con
+	}()
+	con, err := l2.DialTarget("10.0.0.1:22")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer con.Close()
+	acon := <-accepted
+	if acon == nil {
+		t.FailNow()
+	}
+	defer acon.Close()
+	if acon.(*LinkSession).Target() != "10.0.0.1:22" || con.(*LinkSession).Target() != "10.0.0.1:22" {
+		t.Fatal("target not carried in CONNECT")
+	}
+}
+
+func TestClosedSessionLeavesTable(t *testing.T) {
+	l1, l2 := Pipe(PipeConfig{})
+	defer l1.Close()
+	defer l2.Close()
+
+	s1, s2 := connectedSessions(t, l1, l2)
+	s2.Close()
+	<-s1.closed
+	for _, l := range []*Link{l1, l2} {
+		l.sessionsLock.Lock()
+		n := len(l.sessions)
+		l.sessionsLock.Unlock()
+		if n != 0 {
+			t.Fatal("closed sessions should be forgotten", n)
+		}
+	}
+}
+
+// acceptWithin returns the next session l accepts within d, or nil.
+func acceptWithin(t *testing.T, l *Link, d time.Duration) net.Conn {
+	accepted := make(chan net.Conn, 1)
+	go func() {
+		conn, _ := l.Accept()
+		accepted <- conn
+	}()
+	select {
+	case conn := <-accepted:
+		return conn
+	case <-time.After(d):
+		return nil
+	}
+}
+
+func TestStalledHandshakeDoesNotBlockAccept(t *testing.T) {
+	l1, l2 := Pipe(PipeConfig{})
+	defer l1.Close()
+	defer l2.Close()
+
+	// A dialer that never answers the ACK.
+	err := l2.Write(nil, -1, linkMessage{Kind: CONNECT, Session: 1000, Initiator: true})
+	if err != nil {
+		t.Fatal(err)
+	}
+	go l2.Dial()
+	if acceptWithin(t, l1, l1.conf.HandshakeTimeout/2) == nil {
+		t.Fatal("accept waited for the stalled handshake")
+	}
+}
+
+func TestLateConnectAfterClose(t *testing.T) {
+	l1, l2 := Pipe(PipeConfig{})
+	defer l1.Close()
+	defer l2.Close()
+
+	s1, s2 := connectedSessions(t, l1, l2)
+	s2.Close()
+	<-s1.closed
+
+	// A copy of the CONNECT that was delayed on the way.
+	err := l2.Write(nil, -1, linkMessage{Kind: CONNECT, Session: s2.key.id, Initiator: true})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if conn := acceptWithin(t, l1, 100*time.Millisecond); conn != nil {
+		t.Fatal("a late CONNECT started the closed session again")
+	}
+}
+
+// A session that stops taking messages must not hold up the others.
+func TestStalledSessionDoesNotBlockLink(t *testing.T) {
+	l1, l2 := Pipe(PipeConfig{})
+	defer l1.Close()
+	defer l2.Close()
+
+	// Registered but never started, nothing reads its inbox.
+	stalled := newSession(l1, sessionKey{id: 1000, dialed: true})
+	if !l1.register(stalled) {
+		t.Fatal("register failed")
+	}
+	for i := 0; i < 2*sessionInboxSize; i++ {
+		err := l2.Write(nil, -1, linkMessage{Kind: PING, Session: 1000})
+		if err != nil {
+			t.Fatal(err)
+		}
+	}
+
+	s1, s2 := connectedSessions(t, l1, l2)
+	data := testData(1000)
+	go s2.Write(data)
+	got := make([]byte, len(data))
+	done := make(chan error, 1)
+	go func() {
+		_, err := io.ReadFull(s1, got)
+		done <- err
+	}()
+	select {
+	case err := <-done:
+		if err != nil {
+			t.Fatal(err)
+		}
+	case <-time.After(5 * time.Second):
+		t.Fatal("the stalled session blocked the link")
+	}
+	if st := stalled.Stats(); st.InboxDrops != sessionInboxSize {
+		t.Fatal("messages beyond the inbox should be dropped", st.InboxDrops)
+	}
+}
+
+func TestNoAcceptAfterClose(t *testing.T) {
+	l1, l2 := Pipe(PipeConfig{})
+	defer l2.Close()
+	l1.Close()
+
+	if s := l1.acceptConnect(sessionKey{id: 1}); s != nil {
+		t.Fatal("a closed link accepted a session")
+	}
+	l1.sessionsLock.Lock()
+	defer l1.sessionsLock.Unlock()
+	if len(l1.sessions) != 0 || l1.pendingAccepts != 0 {
+		t.Fatal("a closed link should not track new sessions")
+	}
+}
+
+func TestIncompatiblePeer(t *testing.T) {
+	l1, l2 := Pipe(PipeConfig{})
+	defer l1.Close()
+	defer l2.Close()
+
+	// Peers from before sessions send everything without a session id.
+	err := l2.Write(nil, -1, linkMessage{Kind: CONNECT})
+	if err != nil {
+		t.Fatal(err)
+	}
+	select {
+	case <-l1.Done():
+	case <-time.After(2 * time.Second):
+		t.Fatal("link should go down")
+	}
+	if !errors.Is(l1.Err(), ErrIncompatiblePeer) {
+		t.Fatal("expected ErrIncompatiblePeer", l1.Err())
+	}
+}
@@ -0,0 +1,41 @@
+package link
+
+import (
+	"io"
+	"mako/serial/link/channelsim"
+	"mako/serial/link/concurrentbuffer"
+)
+
+// PipeConfig configures the links returned by Pipe.
+type PipeConfig struct {
+	// Configuration for both links.
+	Link Config
+	// Impairments applied to data travelling from the first link to the
+	// second, and from the second back to the first. Nil is a perfect
+	// channel.
+	Forward  *channelsim.Config
+	Backward *channelsim.Config
+}
+
+// Pipe returns two links connected to each other in memory, so code
+// using a link can be tested without serial hardware. Closing either
+// link takes the other one down too, like unplugging a cable.
+func Pipe(conf PipeConfig) (*Link, *Link) {
+	forward := pipeDirection(conf.Forward)
+	backward := pipeDirection(conf.Backward)
+	l1 := CreateLinkWithConfig(backward, forward, conf.Link)
+	l2 := CreateLinkWithConfig(forward, backward, conf.Link)
+	// The pipe belongs to the links, so either going down cuts it.
+	l1.closeWhenDown(forward, backward)
+	l2.closeWhenDown(forward, backward)
+	return l1, l2
+}
+
+// pipeDirection returns an in memory channel carrying data one way.
+func pipeDirection(impair *channelsim.Config) io.ReadWriteCloser {
+	buff := concurrentbuffer.New(0)
+	if impair == nil {
+		return buff
+	}
+	return channelsim.New(buff, *impair)
+}
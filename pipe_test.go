@@ -0,0 +1,36 @@
+package link
+
+import (
+	"errors"
+	"mako/serial/link/channelsim"
+	"testing"
+	"time"
+)
+
+func TestPipe(t *testing.T) {
+	l1, l2 := Pipe(PipeConfig{
+		Forward: &channelsim.Config{Delay: 20 * time.Millisecond},
+	})
+	defer l2.Close()
+
+	s1, s2 := connectedSessions(t, l1, l2)
+
+	// Either the data or its ack crosses the delayed direction.
+	for _, dir := range [][2]*LinkSession{{s1, s2}, {s2, s1}} {
+		start := time.Now()
+		transfer(t, dir[0], dir[1], []byte("hello"))
+		if time.Since(start) < 20*time.Millisecond {
+			t.Fatal("traffic from the first link should be delayed")
+		}
+	}
+
+	l1.Close()
+	select {
+	case <-l2.Done():
+	case <-time.After(time.Second):
+		t.Fatal("closing one end of a pipe should take the other down")
+	}
+	if !errors.Is(l2.Err(), ErrLinkDown) {
+		t.Fatal("bad cause", l2.Err())
+	}
+}
@@ -0,0 +1,84 @@
+package link
+
+import "time"
+
+// Largest retransmit timeout, however slow the link seems.
+const maxRetransmitTimeout = 10 * time.Second
+
+// Once the round trip is known, how far timeouts back off past the
+// estimate. A segment that keeps timing out is then taken to be lost on
+// a noisy line rather than held up by a slower one, each resend of a
+// long segment can easily be hit again.
+const maxBackoff = 8
+
+// rtoEstimator picks how long a session waits for an ack before resending
+// a segment, the way TCP does (RFC 6298): the smoothed round trip time
+// plus four times its mean deviation, never less than the configured
+// RetransmitTimeout. Each timeout doubles it, see maxBackoff, until a new
+// sample arrives.
+// ACKs name the copy of a segment they answer, so every acked segment
+// is sampled. From older peers that don't, only segments acked on their
+// first attempt are, as the ack for a resent one could be for any copy.
+type rtoEstimator struct {
+	min    time.Duration
+	srtt   time.Duration
+	rttvar time.Duration
+	rto    time.Duration
+}
+
+func newRTOEstimator(conf Config) *rtoEstimator {
+	return &rtoEstimator{min: conf.RetransmitTimeout, rto: conf.RetransmitTimeout}
+}
+
+// sampled reports whether the timeout is based on a measured round trip.
+func (e *rtoEstimator) sampled() bool {
+	return e.srtt != 0
+}
+
+// sample folds in the round trip time of a copy of a segment that was
+// acked.
+func (e *rtoEstimator) sample(rtt time.Duration) {
+	if rtt <= 0 {
+		rtt = 1
+	}
+	if e.srtt == 0 {
+		e.srtt = rtt
+		e.rttvar = rtt / 2
+	} else {
+		diff := e.srtt - rtt
+		if diff < 0 {
+			diff = -diff
+		}
+		e.rttvar = (3*e.rttvar + diff) / 4
+		e.srtt = (7*e.srtt + rtt) / 8
+	}
+	e.rto = e.estimate()
+	e.clamp()
+}
+
+// estimate is the timeout the measured round trip calls for.
+func (e *rtoEstimator) estimate() time.Duration {
+	rto := e.srtt + 4*e.rttvar
+	if rto < e.min {
+		rto = e.min
+	}
+	return rto
+}
+
+// backoff doubles the timeout after it expired without an ack.
+func (e *rtoEstimator) backoff() {
+	e.rto *= 2
+	if e.sampled() && e.rto > maxBackoff*e.estimate() {
+		e.rto = maxBackoff * e.estimate()
+	}
+	e.clamp()
+}
+
+func (e *rtoEstimator) clamp() {
+	if e.rto < e.min {
+		e.rto = e.min
+	}
+	if e.rto > maxRetransmitTimeout && e.min <= maxRetransmitTimeout {
+		e.rto = maxRetransmitTimeout
+	}
+}
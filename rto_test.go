@@ -0,0 +1,42 @@
+package link
+
+import (
+	"testing"
+	"time"
+)
+
+func TestRTOEstimator(t *testing.T) {
+	e := newRTOEstimator(DefaultConfig())
+	if e.rto != DefaultConfig().RetransmitTimeout || e.sampled() {
+		t.Fatal("should start at RetransmitTimeout", e.rto)
+	}
+	// Backs off until a sample arrives.
+	e.backoff()
+	e.backoff()
+	if e.rto != 4*DefaultConfig().RetransmitTimeout {
+		t.Fatal("should double on every timeout", e.rto)
+	}
+
+	for i := 0; i < 50; i++ {
+		e.sample(100 * time.Millisecond)
+	}
+	if e.srtt != 100*time.Millisecond || e.rto < 100*time.Millisecond || e.rto > 150*time.Millisecond {
+		t.Fatal("should follow a steady round trip", e.srtt, e.rto)
+	}
+
+	for i := 0; i < 20; i++ {
+		e.backoff()
+	}
+	if e.rto != maxBackoff*e.estimate() {
+		t.Fatal("backoff should stop short of the estimate", e.rto)
+	}
+
+	// Without a sample only the overall limit applies.
+	e = newRTOEstimator(DefaultConfig())
+	for i := 0; i < 20; i++ {
+		e.backoff()
+	}
+	if e.rto != maxRetransmitTimeout {
+		t.Fatal("backoff should be bounded", e.rto)
+	}
+}
@@ -0,0 +1,49 @@
+package link
+
+// segmenter picks the size of the DATA segments a session sends.
+//
+// Small segments survive noisy links because a single corrupt byte only
+// costs a short resend, large segments waste less of a clean link on
+// framing and acks. The size grows by a quarter after each full segment
+// that was acked on the first attempt, and halves whenever the link saw
+// corrupt frames while a segment was in flight or it was resent more than
+// once after timeouts based on the measured round trip. A single resend,
+// or ones while the round trip is still unknown, change nothing: they
+// only say the link is slower than thought.
+type segmenter struct {
+	min  int
+	max  int
+	size int
+}
+
+func newSegmenter(conf Config) *segmenter {
+	return &segmenter{
+		min:  conf.MinSegmentSize,
+		max:  conf.MaxSegmentSize,
+		size: conf.InitialSegmentSize,
+	}
+}
+
+// update adjusts the segment size after a segment has been acked.
+// full is true if the segment was as large as the current size allowed,
+// a short segment says nothing about whether a larger one would get
+// through. clean is true if it was acked on the first attempt, false if
+// it was lost or corrupted, see _write.
+func (sg *segmenter) update(full bool, clean bool) {
+	switch {
+	case !clean:
+		sg.size /= 2
+		if sg.size < sg.min {
+			sg.size = sg.min
+		}
+	case full:
+		grow := sg.size / 4
+		if grow == 0 {
+			grow = 1
+		}
+		sg.size += grow
+		if sg.size > sg.max {
+			sg.size = sg.max
+		}
+	}
+}
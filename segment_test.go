@@ -0,0 +1,100 @@
+package link
+
+import (
+	"bytes"
+	"io"
+	"mako/serial/link/channelsim"
+	"testing"
+	"time"
+)
+
+func TestSegmenterBounds(t *testing.T) {
+	sg := newSegmenter(Config{
+		MinSegmentSize:     16,
+		MaxSegmentSize:     256,
+		InitialSegmentSize: 64,
+	}.withDefaults())
+
+	for i := 0; i < 100; i++ {
+		sg.update(true, true)
+	}
+	if sg.size != 256 {
+		t.Fatal("segment size should grow to the max on a clean link", sg.size)
+	}
+
+	sg.update(true, false)
+	if sg.size != 128 {
+		t.Fatal("segment size should halve on errors", sg.size)
+	}
+
+	for i := 0; i < 100; i++ {
+		sg.update(true, false)
+	}
+	if sg.size != 16 {
+		t.Fatal("segment size should shrink to the min on a noisy link", sg.size)
+	}
+}
+
+func TestSegmenterShortWrites(t *testing.T) {
+	sg := newSegmenter(DefaultConfig())
+	initial := sg.size
+
+	for i := 0; i < 100; i++ {
+		sg.update(false, true)
+	}
+	if sg.size != initial {
+		t.Fatal("short segments should not grow the segment size", sg.size)
+	}
+}
+
+func TestConfigDefaults(t *testing.T) {
+	conf := Config{MinSegmentSize: 512, MaxSegmentSize: 64}.withDefaults()
+	if conf.MaxSegmentSize != 512 || conf.InitialSegmentSize != 512 {
+		t.Fatal("bad segment bounds", conf)
+	}
+}
+
+// A serial line's round trip is far longer than the initial retransmit
+// timeout, that must not be mistaken for loss.
+func TestSlowLink(t *testing.T) {
+	line := channelsim.Config{BaudRate: 115200}
+	l1, l2 := Pipe(PipeConfig{Forward: &line, Backward: &line})
+	defer l1.Close()
+	defer l2.Close()
+	s1, s2 := connectedSessions(t, l1, l2)
+
+	data := testData(20000)
+	sent := make(chan error, 1)
+	go func() {
+		_, err := s2.Write(data)
+		sent <- err
+	}()
+	got := make([]byte, len(data))
+	done := make(chan error, 1)
+	go func() {
+		_, err := io.ReadFull(s1, got)
+		done <- err
+	}()
+	select {
+	case err := <-done:
+		if err != nil || !bytes.Equal(got, data) {
+			t.Fatal("bad transfer", err)
+		}
+	case <-time.After(20 * time.Second):
+		t.Fatal("transfer too slow", s2.Stats())
+	}
+	if err := <-sent; err != nil {
+		t.Fatal(err)
+	}
+
+	st := s2.Stats()
+	if st.Retransmissions*4 > st.DataFramesSent {
+		t.Fatal("too many retransmissions", st)
+	}
+	if st.SegmentSize <= DefaultConfig().InitialSegmentSize {
+		t.Fatal("the segment size should grow on a clean slow link", st)
+	}
+	if st.RTT == 0 || st.RetransmitTimeout < st.RTT {
+		t.Fatal("bad round trip estimate", st)
+	}
+}
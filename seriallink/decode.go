@@ -0,0 +1,193 @@
+package main
+
+import (
+	"bufio"
+	"encoding/hex"
+	"errors"
+	"flag"
+	"fmt"
+	"io"
+	"mako/serial/link"
+	"os"
+	"sort"
+	"strings"
+)
+
+// Captures start with a pcapng section header block, whose type reads the
+// same in either byte order.
+const pcapngMagic = "\x0a\x0d\x0d\x0a"
+
+// decodeSummary counts what decodeStream saw.
+type decodeSummary struct {
+	frames           int
+	ok               int
+	checksumFailures int
+	decodeErrors     int
+	// Bytes after the last delimiter, an incomplete frame.
+	trailing int
+	kinds    map[string]int
+	errors   map[string]int
+}
+
+func (s *decodeSummary) print(w io.Writer) {
+	fmt.Fprintf(w, "%d frames, %d ok, %d checksum failures, %d other decode errors\n",
+		s.frames, s.ok, s.checksumFailures, s.decodeErrors)
+	if s.trailing != 0 {
+		fmt.Fprintf(w, "%d trailing bytes without a delimiter\n", s.trailing)
+	}
+	printCounts(w, "kinds", s.kinds)
+	printCounts(w, "decode errors", s.errors)
+}
+
+func printCounts(w io.Writer, title string, counts map[string]int) {
+	if len(counts) == 0 {
+		return
+	}
+	var keys []string
+	for k := range counts {
+		keys = append(keys, k)
+	}
+	sort.Strings(keys)
+	fmt.Fprintf(w, "%s:\n", title)
+	for _, k := range keys {
+		fmt.Fprintf(w, "  %6d %s\n", counts[k], k)
+	}
+}
+
+// dumpFrame prints a frame's payload in the chosen format.
+func dumpFrame(w io.Writer, data []byte, dump string) {
+	if len(data) == 0 {
+		return
+	}
+	switch dump {
+	case "hex":
+		fmt.Fprint(w, hex.Dump(data))
+	case "ascii":
+		fmt.Fprintf(w, "  %q\n", data)
+	}
+}
+
+// decodeFrame prints a single frame and adds it to the summary.
+func decodeFrame(w io.Writer, s *decodeSummary, desc string, raw []byte, dump string) {
+	s.frames++
+	f, err := link.DecodeFrame(raw)
+	switch {
+	case errors.Is(err, link.ErrChecksum):
+		s.checksumFailures++
+		fmt.Fprintf(w, "%s len=%d BAD CHECKSUM: %s\n", desc, len(raw), err)
+		dumpFrame(w, raw, dump)
+	case err != nil:
+		s.decodeErrors++
+		s.errors[err.Error()]++
+		fmt.Fprintf(w, "%s len=%d UNDECODABLE: %s\n", desc, len(raw), err)
+		dumpFrame(w, raw, dump)
+	default:
+		s.ok++
+		kind := link.KindName(f.Kind)
+		s.kinds[kind]++
+		// Both ends number the sessions they dial from 1, the sender's
+		// side tells them apart.
+		from := "acceptor"
+		if f.Initiator {
+			from = "dialer"
+		}
+		target := ""
+		if f.Target != "" {
+			target = fmt.Sprintf(" target=%q", f.Target)
+		}
+		fmt.Fprintf(w, "%s %s session=%d from=%s%s seq=%d payload=%d ok\n",
+			desc, kind, f.Session, from, target, f.Seqnum, len(f.Data))
+		dumpFrame(w, f.Data, dump)
+	}
+}
+
+// decodeStream splits a raw link byte stream into frames the same way
+// Link does and prints each one.
+func decodeStream(r io.Reader, w io.Writer, dump string) (*decodeSummary, error) {
+	s := &decodeSummary{kinds: map[string]int{}, errors: map[string]int{}}
+	reader := bufio.NewReader(r)
+	offset := 0
+	for idx := 0; ; idx++ {
+		raw, err := link.ReadFrame(reader)
+		if err == io.EOF {
+			s.trailing = len(raw)
+			return s, nil
+		}
+		if err != nil {
+			return s, err
+		}
+		decodeFrame(w, s, fmt.Sprintf("#%d @%d", idx, offset), raw, dump)
+		offset += len(raw)
+	}
+}
+
+// decodeCapture prints the frames of a pcapng capture written by a link.
+func decodeCapture(records []link.CaptureRecord, w io.Writer, dump string) *decodeSummary {
+	s := &decodeSummary{kinds: map[string]int{}, errors: map[string]int{}}
+	for idx, rec := range records {
+		desc := fmt.Sprintf("#%d %s %-3s", idx, rec.Time.Format("15:04:05.000000"), rec.Direction)
+		decodeFrame(w, s, desc, rec.Frame, dump)
+	}
+	return s
+}
+
+func decodeUsage(fs *flag.FlagSet) {
+	fmt.Fprintln(os.Stderr, "usage: seriallink decode [-dump hex|ascii|none] [file]")
+	fmt.Fprintln(os.Stderr, "")
+	fmt.Fprintln(os.Stderr, "Splits a raw link byte stream, or a pcapng capture written by a link,")
+	fmt.Fprintln(os.Stderr, "into frames and prints each frame's kind, session, the side of the session")
+	fmt.Fprintln(os.Stderr, "that sent it, sequence number, payload length and checksum verdict.")
+	fmt.Fprintln(os.Stderr, "Reads stdin if no file is given.")
+	fmt.Fprintln(os.Stderr, "")
+	fs.PrintDefaults()
+}
+
+func decode(args []string) error {
+	fs := flag.NewFlagSet("decode", flag.ExitOnError)
+	dump := fs.String("dump", "hex", "payload dump format: hex, ascii or none")
+	fs.Usage = func() { decodeUsage(fs) }
+	fs.Parse(args)
+
+	switch *dump {
+	case "hex", "ascii", "none":
+	default:
+		return fmt.Errorf("unknown dump format %q", *dump)
+	}
+
+	var in io.Reader = os.Stdin
+	switch fs.NArg() {
+	case 0:
+	case 1:
+		f, err := os.Open(fs.Arg(0))
+		if err != nil {
+			return err
+		}
+		defer f.Close()
+		in = f
+	default:
+		fs.Usage()
+		return errors.New("expected at most one file")
+	}
+
+	// Raw streams are decoded as they arrive, so a serial port or a pipe
+	// can be watched live. Captures are read whole.
+	reader := bufio.NewReader(in)
+	var summary *decodeSummary
+	head, _ := reader.Peek(len(pcapngMagic))
+	if string(head) == pcapngMagic {
+		records, err := link.ReadCapture(reader)
+		if err != nil {
+			return err
+		}
+		summary = decodeCapture(records, os.Stdout, *dump)
+	} else {
+		var err error
+		summary, err = decodeStream(reader, os.Stdout, *dump)
+		if err != nil {
+			return err
+		}
+	}
+	fmt.Println(strings.Repeat("-", 40))
+	summary.print(os.Stdout)
+	return nil
+}
@@ -0,0 +1,169 @@
+package main
+
+import (
+	"bufio"
+	"bytes"
+	"io"
+	"mako/serial/link"
+	"mako/serial/link/concurrentbuffer"
+	"net"
+	"strings"
+	"sync"
+	"testing"
+	"time"
+)
+
+// connectFrame returns the raw CONNECT frame a link sends when dialing.
+func connectFrame(t *testing.T) []byte {
+	wire := concurrentbuffer.New(0)
+	l := link.CreateLink(concurrentbuffer.New(0), wire)
+	defer l.Close()
+	go l.Dial()
+	frame, err := link.ReadFrame(bufio.NewReader(wire))
+	if err != nil {
+		t.Fatal(err)
+	}
+	return frame
+}
+
+func TestDecodeStream(t *testing.T) {
+	frame := connectFrame(t)
+	corrupt := append([]byte(nil), frame...)
+	if corrupt[0] == 'A' {
+		corrupt[0] = 'B'
+	} else {
+		corrupt[0] = 'A'
+	}
+
+	var stream bytes.Buffer
+	stream.Write(frame)
+	stream.Write(corrupt)
+	stream.WriteString("garbage~")
+	stream.Write(frame)
+	stream.WriteString("partial")
+
+	var out bytes.Buffer
+	s, err := decodeStream(&stream, &out, "hex")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if s.frames != 4 || s.ok != 2 || s.checksumFailures != 1 || s.decodeErrors != 1 {
+		t.Fatalf("bad summary %+v", s)
+	}
+	if s.trailing != len("partial") || s.kinds["CONNECT"] != 2 {
+		t.Fatalf("bad summary %+v", s)
+	}
+	if !strings.Contains(out.String(), "#0 @0 CONNECT session=1 from=dialer seq=0 payload=0 ok") {
+		t.Fatal("bad output", out.String())
+	}
+	if !strings.Contains(out.String(), "BAD CHECKSUM") {
+		t.Fatal("bad output", out.String())
+	}
+}
+
+// Frames are printed as they arrive, not once the input ends.
+func TestDecodeStreamLive(t *testing.T) {
+	r, w := io.Pipe()
+	var out lockedBuffer
+	done := make(chan struct{})
+	go func() {
+		decodeStream(r, &out, "none")
+		close(done)
+	}()
+
+	w.Write(connectFrame(t))
+	deadline := time.Now().Add(5 * time.Second)
+	for !strings.Contains(out.String(), "CONNECT") {
+		if time.Now().After(deadline) {
+			t.Fatal("frame not printed before the end of the input")
+		}
+		time.Sleep(time.Millisecond)
+	}
+	w.Close()
+	<-done
+}
+
+// Sessions dialed from each end share ids, the decoder has to keep them
+// apart.
+func TestDecodeInterleavedSessions(t *testing.T) {
+	var capture lockedBuffer
+	b1 := concurrentbuffer.New(0)
+	b2 := concurrentbuffer.New(0)
+	l1 := link.CreateLinkWithConfig(b1, b2, link.Config{Capture: &capture})
+	l2 := link.CreateLink(b2, b1)
+	defer l2.Close()
+
+	// One session dialed from each end, written to alternately.
+	var sessions [2][2]net.Conn
+	for i, pair := range [][2]*link.Link{{l1, l2}, {l2, l1}} {
+		accepted := make(chan net.Conn, 1)
+		go func() {
+			conn, err := pair[1].Accept()
+			if err != nil {
+				t.Error(err)
+			}
+			accepted <- conn
+		}()
+		conn, err := pair[0].Dial()
+		if err != nil {
+			t.Fatal(err)
+		}
+		sessions[i] = [2]net.Conn{conn, <-accepted}
+		if sessions[i][1] == nil {
+			t.FailNow()
+		}
+	}
+	for round := 0; round < 2; round++ {
+		for i, s := range sessions {
+			msg := []byte(strings.Repeat("x", 10*(i+1)))
+			if _, err := s[0].Write(msg); err != nil {
+				t.Fatal(err)
+			}
+			if _, err := io.ReadFull(s[1], msg); err != nil {
+				t.Fatal(err)
+			}
+		}
+	}
+	l1.Close()
+
+	records, err := link.ReadCapture(strings.NewReader(capture.String()))
+	if err != nil {
+		t.Fatal(err)
+	}
+	var out bytes.Buffer
+	s := decodeCapture(records, &out, "none")
+	if s.ok != s.frames || s.kinds["DATA"] != 4 {
+		t.Fatalf("bad summary %+v", s)
+	}
+	// l1 dialed the session whose data it sends, l2 the one whose data
+	// it receives.
+	for _, want := range []string{
+		"out DATA session=1 from=dialer seq=2 payload=10 ok",
+		"out ACK session=1 from=acceptor seq=1",
+		"in  DATA session=1 from=dialer seq=2 payload=20 ok",
+		"in  ACK session=1 from=acceptor seq=1",
+		"out DATA session=1 from=dialer seq=1 payload=10 ok",
+		"in  DATA session=1 from=dialer seq=1 payload=20 ok",
+	} {
+		if !strings.Contains(out.String(), want) {
+			t.Fatalf("missing %q in\n%s", want, out.String())
+		}
+	}
+}
+
+type lockedBuffer struct {
+	sync.Mutex
+	b bytes.Buffer
+}
+
+func (lb *lockedBuffer) Write(p []byte) (int, error) {
+	lb.Lock()
+	defer lb.Unlock()
+	return lb.b.Write(p)
+}
+
+func (lb *lockedBuffer) String() string {
+	lb.Lock()
+	defer lb.Unlock()
+	return lb.b.String()
+}
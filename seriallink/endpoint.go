@@ -0,0 +1,134 @@
+package main
+
+// Listen and target addresses are either TCP host:port pairs or Unix
+// socket paths. Anything with a slash in it is a path, so a socket in the
+// current directory is written ./name.sock.
+
+import (
+	"errors"
+	"fmt"
+	"io/fs"
+	"net"
+	"os"
+	"path/filepath"
+	"strings"
+	"sync"
+	"syscall"
+	"time"
+)
+
+// Permissions given to the Unix sockets seriallink listens on, see
+// --socket-mode. Only the owner may connect by default.
+var socketMode os.FileMode = 0600
+
+// Addresses link2tcp connects sessions and datagrams to when the far end
+// names them, see --permit. "*" permits any.
+var permittedTargets []string
+
+// targetPermitted reports whether link2tcp may connect to addr for the
+// far end.
+func targetPermitted(addr string) bool {
+	for _, p := range permittedTargets {
+		if p == "*" || p == addr {
+			return true
+		}
+	}
+	return false
+}
+
+// isUnixPath reports whether addr names a Unix socket.
+func isUnixPath(addr string) bool {
+	return strings.Contains(addr, "/")
+}
+
+// endpointNetwork returns the network addr belongs to.
+func endpointNetwork(addr string) string {
+	if isUnixPath(addr) {
+		return "unix"
+	}
+	return "tcp"
+}
+
+// dialEndpoint connects to a TCP address or Unix socket.
+func dialEndpoint(addr string) (net.Conn, error) {
+	return net.Dial(endpointNetwork(addr), addr)
+}
+
+// listenEndpoint listens on a TCP address or Unix socket. A socket left
+// behind by a process that is gone is replaced, one still in use is not.
+// Closing the listener removes the socket.
+func listenEndpoint(addr string) (net.Listener, error) {
+	if !isUnixPath(addr) {
+		return net.Listen("tcp", addr)
+	}
+	err := removeStaleSocket(addr)
+	if err != nil {
+		return nil, err
+	}
+	// The socket is created with the umask applied, so it is made in a
+	// directory only we can enter and linked into place once it has its
+	// permissions. Nobody can connect to it before then.
+	dir, err := os.MkdirTemp(filepath.Dir(addr), ".sl")
+	if err != nil {
+		return nil, err
+	}
+	defer os.RemoveAll(dir)
+	tmp := filepath.Join(dir, "s")
+	l, err := net.Listen("unix", tmp)
+	if err != nil {
+		return nil, err
+	}
+	l.(*net.UnixListener).SetUnlinkOnClose(false)
+	err = os.Chmod(tmp, socketMode)
+	if err == nil {
+		// Unlike a rename this fails if something appeared at addr in
+		// the meantime.
+		err = os.Link(tmp, addr)
+	}
+	if err != nil {
+		l.Close()
+		return nil, err
+	}
+	return &unixListener{Listener: l, path: addr}, nil
+}
+
+// unixListener is a listener whose socket was created under another name,
+// it reports and removes path instead.
+type unixListener struct {
+	net.Listener
+	path  string
+	close sync.Once
+}
+
+func (l *unixListener) Addr() net.Addr {
+	return &net.UnixAddr{Name: l.path, Net: "unix"}
+}
+
+func (l *unixListener) Close() error {
+	err := l.Listener.Close()
+	l.close.Do(func() { os.Remove(l.path) })
+	return err
+}
+
+// removeStaleSocket removes the socket at path if nothing is listening on
+// it. Files that are not sockets are never removed.
+func removeStaleSocket(path string) error {
+	fi, err := os.Lstat(path)
+	if errors.Is(err, fs.ErrNotExist) {
+		return nil
+	} else if err != nil {
+		return err
+	}
+	if fi.Mode().Type() != fs.ModeSocket {
+		return fmt.Errorf("%s exists and is not a socket", path)
+	}
+	conn, err := net.DialTimeout("unix", path, time.Second)
+	if err == nil {
+		conn.Close()
+		return fmt.Errorf("%s is in use", path)
+	}
+	if !errors.Is(err, syscall.ECONNREFUSED) {
+		return fmt.Errorf("checking %s: %w", path, err)
+	}
+	return os.Remove(path)
+}
@@ -0,0 +1,112 @@
+package main
+
+import (
+	"io"
+	"mako/serial/link"
+	"net"
+	"os"
+	"path/filepath"
+	"testing"
+)
+
+// unixServer answers every connection on a new socket in dir with name.
+func unixServer(t *testing.T, dir string, name string) string {
+	path := filepath.Join(dir, name+".sock")
+	l, err := net.Listen("unix", path)
+	if err != nil {
+		t.Fatal(err)
+	}
+	t.Cleanup(func() { l.Close() })
+	go func() {
+		for {
+			conn, err := l.Accept()
+			if err != nil {
+				return
+			}
+			conn.Write([]byte(name))
+			conn.Close()
+		}
+	}()
+	return path
+}
+
+func TestListenEndpoint(t *testing.T) {
+	dir := t.TempDir()
+
+	// A socket left behind by a listener that is gone is replaced.
+	stale := filepath.Join(dir, "stale.sock")
+	l, err := net.Listen("unix", stale)
+	if err != nil {
+		t.Fatal(err)
+	}
+	l.(*net.UnixListener).SetUnlinkOnClose(false)
+	l.Close()
+	l, err = listenEndpoint(stale)
+	if err != nil {
+		t.Fatal(err)
+	}
+	fi, err := os.Stat(stale)
+	if err != nil || fi.Mode().Perm() != 0600 {
+		t.Fatal("bad socket permissions", fi.Mode(), err)
+	}
+	if l.Addr().String() != stale {
+		t.Fatal("bad address", l.Addr())
+	}
+	// Nothing is left of the directory it was created in.
+	entries, _ := os.ReadDir(dir)
+	if len(entries) != 1 {
+		t.Fatal("expected only the socket", entries)
+	}
+
+	// One that is in use is left alone.
+	_, err = listenEndpoint(stale)
+	if err == nil {
+		t.Fatal("expected an error for a socket in use")
+	}
+	l.Close()
+	_, err = os.Stat(stale)
+	if !os.IsNotExist(err) {
+		t.Fatal("socket not removed on close", err)
+	}
+
+	// So are files that aren't sockets.
+	file := filepath.Join(dir, "file")
+	os.WriteFile(file, nil, 0644)
+	_, err = listenEndpoint(file)
+	if err == nil {
+		t.Fatal("expected an error for a regular file")
+	}
+	if _, err := os.Stat(file); err != nil {
+		t.Fatal("regular file removed", err)
+	}
+}
+
+func TestUnixForward(t *testing.T) {
+	dir := t.TempDir()
+	l1, l2 := link.Pipe(link.PipeConfig{})
+	defer l1.Close()
+	defer l2.Close()
+	go serveLink(l1, "")
+
+	rule, err := parseForward(filepath.Join(dir, "local.sock") + ":" + unixServer(t, dir, "remote"))
+	if err != nil {
+		t.Fatal(err)
+	}
+	permitTargets(t, rule.target)
+	l, err := listenEndpoint(rule.listen)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer l.Close()
+	go serveForward(l2, l, rule.target)
+
+	conn, err := dialEndpoint(rule.listen)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer conn.Close()
+	got, err := io.ReadAll(conn)
+	if err != nil || string(got) != "remote" {
+		t.Fatal("bad data", string(got), err)
+	}
+}
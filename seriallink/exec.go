@@ -0,0 +1,335 @@
+package main
+
+// shell and exec run a command on the far end under a pseudo-terminal.
+// The session is dialed with execPrefix followed by a JSON execRequest as
+// its target, and link2tcp only honours it when started with
+// --allow-exec. After that both directions carry packets: a kind byte, a
+// big endian uint32 payload length and the payload. The client sends
+// terminal input, window sizes and signals, the far end sends the
+// terminal output and finally the exit status.
+
+import (
+	"bufio"
+	"encoding/binary"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"net"
+	"os"
+	"os/exec"
+	"os/signal"
+	"sync"
+	"syscall"
+	"time"
+)
+
+// Session target prefix for exec sessions.
+const execPrefix = "exec:"
+
+// Packet kinds.
+const (
+	// Terminal input or output.
+	packetData = 'd'
+	// New window size, rows then columns as big endian uint16s.
+	packetResize = 'r'
+	// A signal for the command, by name, see execSignals.
+	packetSignal = 's'
+	// The input ended.
+	packetEOF = 'z'
+	// The command finished, its exit status as a big endian int32.
+	packetExit = 'x'
+	// The command could not be run, the payload says why.
+	packetError = 'e'
+)
+
+// Largest payload accepted from the peer.
+const maxPacketSize = 64 * 1024
+
+// How long the terminal output is still passed on once the command has
+// exited, after the last of it. Whatever the command left running in the
+// background may keep the terminal open for much longer.
+const outputDrainTimeout = 200 * time.Millisecond
+
+// Whether link2tcp runs commands for exec sessions, see --allow-exec.
+var allowExec bool
+
+// Signals the client passes on to the command.
+var execSignals = map[string]syscall.Signal{
+	"HUP":  syscall.SIGHUP,
+	"INT":  syscall.SIGINT,
+	"QUIT": syscall.SIGQUIT,
+	"TERM": syscall.SIGTERM,
+}
+
+// execRequest is what the client asks the far end to run.
+type execRequest struct {
+	// The command and its arguments, the far end's shell if empty.
+	Argv []string `json:"argv,omitempty"`
+	// TERM for the command.
+	Term string `json:"term,omitempty"`
+	// Initial window size, zero if unknown.
+	Rows uint16 `json:"rows,omitempty"`
+	Cols uint16 `json:"cols,omitempty"`
+}
+
+// packetConn sends and receives packets over a session. send may be
+// called concurrently.
+type packetConn struct {
+	conn  net.Conn
+	r     *bufio.Reader
+	wlock sync.Mutex
+}
+
+func newPacketConn(conn net.Conn) *packetConn {
+	return &packetConn{conn: conn, r: bufio.NewReader(conn)}
+}
+
+func (pc *packetConn) send(kind byte, payload []byte) error {
+	p := make([]byte, 5, 5+len(payload))
+	p[0] = kind
+	binary.BigEndian.PutUint32(p[1:], uint32(len(payload)))
+	p = append(p, payload...)
+	pc.wlock.Lock()
+	defer pc.wlock.Unlock()
+	_, err := pc.conn.Write(p)
+	return err
+}
+
+func (pc *packetConn) receive() (byte, []byte, error) {
+	var head [5]byte
+	_, err := io.ReadFull(pc.r, head[:])
+	if err != nil {
+		return 0, nil, err
+	}
+	n := binary.BigEndian.Uint32(head[1:])
+	if n > maxPacketSize {
+		return 0, nil, fmt.Errorf("packet of %d bytes is too large", n)
+	}
+	payload := make([]byte, n)
+	_, err = io.ReadFull(pc.r, payload)
+	if err == io.EOF {
+		err = io.ErrUnexpectedEOF
+	}
+	return head[0], payload, err
+}
+
+func (pc *packetConn) sendResize(rows, cols uint16) error {
+	var p [4]byte
+	binary.BigEndian.PutUint16(p[0:], rows)
+	binary.BigEndian.PutUint16(p[2:], cols)
+	return pc.send(packetResize, p[:])
+}
+
+// execRemote runs the command of o on the far end, connected to this
+// process's terminal, and returns its exit status.
+func execRemote(o *options) (int, error) {
+	req := execRequest{Argv: o.Command, Term: os.Getenv("TERM")}
+	tty := isTerminal(os.Stdin)
+	if tty {
+		req.Rows, req.Cols, _ = terminalSize(os.Stdin)
+	}
+	target, err := json.Marshal(req)
+	if err != nil {
+		return 0, err
+	}
+
+	lk, closeLink, err := o.createLink()
+	if err != nil {
+		return 0, err
+	}
+	defer closeLink()
+	conn, err := lk.DialTarget(execPrefix + string(target))
+	if err != nil {
+		return 0, err
+	}
+	defer conn.Close()
+	pc := newPacketConn(conn)
+
+	if tty {
+		// Keys such as ^C reach the far end as input and its terminal
+		// acts on them.
+		restore, err := makeRaw(os.Stdin)
+		if err != nil {
+			return 0, err
+		}
+		defer restore()
+		resized := make(chan os.Signal, 1)
+		notifyResize(resized)
+		defer signal.Stop(resized)
+		go func() {
+			for range resized {
+				rows, cols, err := terminalSize(os.Stdin)
+				if err == nil {
+					pc.sendResize(rows, cols)
+				}
+			}
+		}()
+	}
+	signals := make(chan os.Signal, 1)
+	signal.Notify(signals, syscall.SIGHUP, syscall.SIGINT, syscall.SIGQUIT, syscall.SIGTERM)
+	defer signal.Stop(signals)
+	go func() {
+		for sig := range signals {
+			for name, s := range execSignals {
+				if s == sig {
+					pc.send(packetSignal, []byte(name))
+				}
+			}
+		}
+	}()
+
+	return execClient(pc, os.Stdin, os.Stdout)
+}
+
+// execClient copies stdin to the command and its output to stdout until
+// the far end reports the exit status.
+func execClient(pc *packetConn, stdin io.Reader, stdout io.Writer) (int, error) {
+	go func() {
+		buf := make([]byte, 4096)
+		for {
+			n, err := stdin.Read(buf)
+			if n > 0 && pc.send(packetData, buf[:n]) != nil {
+				return
+			}
+			if err != nil {
+				pc.send(packetEOF, nil)
+				return
+			}
+		}
+	}()
+	for {
+		kind, p, err := pc.receive()
+		if err == io.EOF {
+			return 0, errors.New("session closed without an exit status")
+		} else if err != nil {
+			return 0, err
+		}
+		switch kind {
+		case packetData:
+			stdout.Write(p)
+		case packetExit:
+			if len(p) != 4 {
+				return 0, errors.New("bad exit status")
+			}
+			return int(int32(binary.BigEndian.Uint32(p))), nil
+		case packetError:
+			return 0, errors.New(string(p))
+		}
+	}
+}
+
+// serveExec is the link2tcp side of an exec session.
+func serveExec(lconn net.Conn, spec string) {
+	defer lconn.Close()
+	pc := newPacketConn(lconn)
+	if !allowExec {
+		fmt.Fprintln(os.Stderr, "refused exec session, --allow-exec is not set.")
+		pc.send(packetError, []byte("the far end does not allow exec, see link2tcp --allow-exec"))
+		return
+	}
+	var req execRequest
+	err := json.Unmarshal([]byte(spec), &req)
+	if err != nil {
+		pc.send(packetError, []byte(fmt.Sprintf("bad exec request: %s", err)))
+		return
+	}
+	argv := req.Argv
+	if len(argv) == 0 {
+		shell := os.Getenv("SHELL")
+		if shell == "" {
+			shell = "/bin/sh"
+		}
+		argv = []string{shell, "-l"}
+	}
+	fmt.Fprintf(os.Stderr, "running %q for the far end.\n", argv)
+
+	cmd := exec.Command(argv[0], argv[1:]...)
+	cmd.Env = os.Environ()
+	if req.Term != "" {
+		cmd.Env = append(cmd.Env, "TERM="+req.Term)
+	}
+	master, err := startPty(cmd, req.Rows, req.Cols)
+	if err != nil {
+		pc.send(packetError, []byte(err.Error()))
+		return
+	}
+	defer master.Close()
+
+	// Signals go to the command's group if the terminal has no foreground
+	// one, which may belong to something else once the command has been
+	// reaped. exited is set before that and checked under sigLock.
+	var sigLock sync.Mutex
+	exited := false
+	sendSignal := func(sig syscall.Signal) {
+		sigLock.Lock()
+		defer sigLock.Unlock()
+		if !exited {
+			signalForeground(master, cmd, sig)
+		}
+	}
+
+	output := make(chan struct{})
+	draining := make(chan struct{})
+	go func() {
+		defer close(output)
+		buf := make([]byte, 4096)
+		for {
+			select {
+			case <-draining:
+				master.SetReadDeadline(time.Now().Add(outputDrainTimeout))
+			default:
+			}
+			// Fails once the command and everything it started have
+			// closed the terminal, or the drain deadline passes.
+			n, err := master.Read(buf)
+			if n > 0 && pc.send(packetData, buf[:n]) != nil {
+				return
+			}
+			if err != nil {
+				return
+			}
+		}
+	}()
+	go func() {
+		for {
+			kind, p, err := pc.receive()
+			if err != nil {
+				// Like a terminal hanging up.
+				sendSignal(syscall.SIGHUP)
+				return
+			}
+			switch kind {
+			case packetData:
+				master.Write(p)
+			case packetResize:
+				if len(p) == 4 {
+					setPtySize(master, binary.BigEndian.Uint16(p), binary.BigEndian.Uint16(p[2:]))
+				}
+			case packetSignal:
+				if sig, ok := execSignals[string(p)]; ok {
+					sendSignal(sig)
+				}
+			case packetEOF:
+				// What ^D does at the start of a line.
+				master.Write([]byte{4})
+			}
+		}
+	}()
+
+	waitExited(cmd)
+	sigLock.Lock()
+	exited = true
+	sigLock.Unlock()
+	cmd.Wait()
+
+	close(draining)
+	err = master.SetReadDeadline(time.Now().Add(outputDrainTimeout))
+	if err != nil {
+		time.AfterFunc(outputDrainTimeout, func() { master.Close() })
+	}
+	<-output
+	var status [4]byte
+	binary.BigEndian.PutUint32(status[:], uint32(int32(exitStatus(cmd.ProcessState))))
+	pc.send(packetExit, status[:])
+}
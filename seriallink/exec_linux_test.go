@@ -0,0 +1,130 @@
+package main
+
+import (
+	"bytes"
+	"encoding/json"
+	"mako/serial/link"
+	"os"
+	"strings"
+	"testing"
+	"time"
+)
+
+// dialExec starts req on the far end of a pipe, returning the client side
+// of the session.
+func dialExec(t *testing.T, allow bool, req execRequest) *packetConn {
+	if _, err := os.Stat("/dev/ptmx"); err != nil {
+		t.Skip("no pseudo-terminals:", err)
+	}
+	allowExec = allow
+	t.Cleanup(func() { allowExec = false })
+
+	l1, l2 := link.Pipe(link.PipeConfig{})
+	t.Cleanup(func() {
+		l1.Close()
+		l2.Close()
+	})
+	go serveLink(l1, "")
+
+	target, err := json.Marshal(req)
+	if err != nil {
+		t.Fatal(err)
+	}
+	conn, err := l2.DialTarget(execPrefix + string(target))
+	if err != nil {
+		t.Fatal(err)
+	}
+	t.Cleanup(func() { conn.Close() })
+	return newPacketConn(conn)
+}
+
+// runExec runs the client with input and returns the output and status.
+func runExec(t *testing.T, pc *packetConn, input string) (string, int) {
+	var out bytes.Buffer
+	done := make(chan struct{})
+	var status int
+	var err error
+	go func() {
+		status, err = execClient(pc, strings.NewReader(input), &out)
+		close(done)
+	}()
+	select {
+	case <-done:
+	case <-time.After(10 * time.Second):
+		t.Fatal("command did not finish")
+	}
+	if err != nil {
+		t.Fatal(err)
+	}
+	return out.String(), status
+}
+
+func TestExec(t *testing.T) {
+	pc := dialExec(t, true, execRequest{Argv: []string{"sh", "-c", "echo hello; exit 3"}})
+	out, status := runExec(t, pc, "")
+	if !strings.Contains(out, "hello\r\n") || status != 3 {
+		t.Fatalf("bad result %q %d", out, status)
+	}
+}
+
+// expect reads output until it contains s.
+func expect(t *testing.T, pc *packetConn, s string) {
+	var out []byte
+	for !bytes.Contains(out, []byte(s)) {
+		kind, p, err := pc.receive()
+		if err != nil {
+			t.Fatal(err)
+		}
+		if kind != packetData {
+			t.Fatalf("expected %q, got packet %c %q after %q", s, kind, p, out)
+		}
+		out = append(out, p...)
+	}
+}
+
+// A background process keeping the terminal open must not hold up the
+// exit status.
+func TestExecBackgroundChild(t *testing.T) {
+	pc := dialExec(t, true, execRequest{Argv: []string{"sh", "-c", "sleep 30 & echo started; exit 4"}})
+	start := time.Now()
+	out, status := runExec(t, pc, "")
+	if !strings.Contains(out, "started") || status != 4 {
+		t.Fatalf("bad result %q %d", out, status)
+	}
+	if time.Since(start) > 5*time.Second {
+		t.Fatal("waited for the background process")
+	}
+}
+
+func TestExecInputAndResize(t *testing.T) {
+	pc := dialExec(t, true, execRequest{
+		Argv: []string{"sh", "-c", "stty size; read line; echo got $line; stty size"},
+		Rows: 24,
+		Cols: 80,
+	})
+	expect(t, pc, "24 80")
+	pc.sendResize(30, 100)
+	out, status := runExec(t, pc, "x\n")
+	got := strings.Index(out, "got x")
+	if got < 0 || !strings.Contains(out[got:], "30 100") || status != 0 {
+		t.Fatalf("bad result %q %d", out, status)
+	}
+}
+
+func TestExecSignal(t *testing.T) {
+	pc := dialExec(t, true, execRequest{Argv: []string{"sh", "-c", "echo ready; exec sleep 10"}})
+	expect(t, pc, "ready")
+	pc.send(packetSignal, []byte("TERM"))
+	_, status := runExec(t, pc, "")
+	if status != 128+15 {
+		t.Fatal("expected the command to be killed by SIGTERM", status)
+	}
+}
+
+func TestExecRefused(t *testing.T) {
+	pc := dialExec(t, false, execRequest{Argv: []string{"true"}})
+	_, err := execClient(pc, strings.NewReader(""), &bytes.Buffer{})
+	if err == nil || !strings.Contains(err.Error(), "--allow-exec") {
+		t.Fatal("expected exec to be refused", err)
+	}
+}
@@ -0,0 +1,114 @@
+package main
+
+import (
+	"fmt"
+	"net"
+	"strings"
+)
+
+// forward is a tcp2link rule: connections accepted on listen are carried
+// over the link, and the far end connects them to target. An empty
+// target leaves the choice to the far end.
+type forward struct {
+	listen string
+	target string
+}
+
+// parseForward parses [bind_address:]port:host:hostport, IPv6 addresses
+// go in brackets. Without a bind address only local connections are
+// accepted. Either [bind_address:]port or host:hostport may be a Unix
+// socket path instead.
+func parseForward(spec string) (forward, error) {
+	return parseForwardNet("tcp", spec)
+}
+
+// parseForwardNet is parseForward with port names looked up for network.
+// Only tcp forwards may use Unix sockets.
+func parseForwardNet(network, spec string) (forward, error) {
+	bad := fmt.Errorf("bad forward %q, expected [bind_address:]port:host:hostport", spec)
+	unix := network == "tcp"
+	parts := splitForward(spec)
+	var rule forward
+
+	n := len(parts)
+	switch {
+	case n >= 2 && unix && isUnixPath(parts[n-1]):
+		rule.target = parts[n-1]
+		parts = parts[:n-1]
+	case n >= 3:
+		host, port := parts[n-2], parts[n-1]
+		if host == "" {
+			return forward{}, fmt.Errorf("bad forward %q, missing host", spec)
+		}
+		_, err := net.LookupPort(network, port)
+		if err != nil {
+			return forward{}, fmt.Errorf("bad forward %q: %w", spec, err)
+		}
+		rule.target = net.JoinHostPort(unbracket(host), port)
+		parts = parts[:n-2]
+	default:
+		return forward{}, bad
+	}
+
+	bind := "127.0.0.1"
+	switch len(parts) {
+	case 1:
+		if unix && isUnixPath(parts[0]) {
+			rule.listen = parts[0]
+			return rule, nil
+		}
+	case 2:
+		bind = parts[0]
+		parts = parts[1:]
+	default:
+		return forward{}, bad
+	}
+	_, err := net.LookupPort(network, parts[0])
+	if err != nil {
+		return forward{}, fmt.Errorf("bad forward %q: %w", spec, err)
+	}
+	rule.listen = net.JoinHostPort(unbracket(bind), parts[0])
+	return rule, nil
+}
+
+// splitForward splits on the colons that are not inside brackets.
+func splitForward(spec string) []string {
+	var parts []string
+	depth := 0
+	start := 0
+	for i, c := range spec {
+		switch c {
+		case '[':
+			depth++
+		case ']':
+			depth--
+		case ':':
+			if depth == 0 {
+				parts = append(parts, spec[start:i])
+				start = i + 1
+			}
+		}
+	}
+	return append(parts, spec[start:])
+}
+
+func unbracket(host string) string {
+	return strings.TrimSuffix(strings.TrimPrefix(host, "["), "]")
+}
+
+// forwardRules returns the -L rules, or a single rule for --listen
+// without a target if there are none.
+func (o *options) forwardRules() ([]forward, error) {
+	if len(o.Forwards) == 0 {
+		return []forward{{listen: o.Listen}}, nil
+	}
+	var rules []forward
+	for _, spec := range o.Forwards {
+		rule, err := parseForward(spec)
+		if err != nil {
+			return nil, err
+		}
+		rules = append(rules, rule)
+	}
+	return rules, nil
+}
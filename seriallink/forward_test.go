@@ -0,0 +1,155 @@
+package main
+
+import (
+	"io"
+	"mako/serial/link"
+	"net"
+	"testing"
+)
+
+func TestParseForward(t *testing.T) {
+	for _, tc := range []struct {
+		spec   string
+		listen string
+		target string
+	}{
+		{"2222:127.0.0.1:22", "127.0.0.1:2222", "127.0.0.1:22"},
+		{"0.0.0.0:8080:localhost:80", "0.0.0.0:8080", "localhost:80"},
+		{"9100:[::1]:9100", "127.0.0.1:9100", "[::1]:9100"},
+		{"[::]:22:10.0.0.1:ssh", "[::]:22", "10.0.0.1:ssh"},
+		{"/run/ctl.sock:127.0.0.1:22", "/run/ctl.sock", "127.0.0.1:22"},
+		{"2375:/var/run/docker.sock", "127.0.0.1:2375", "/var/run/docker.sock"},
+		{"0.0.0.0:2375:/var/run/docker.sock", "0.0.0.0:2375", "/var/run/docker.sock"},
+		{"./a.sock:./b.sock", "./a.sock", "./b.sock"},
+	} {
+		rule, err := parseForward(tc.spec)
+		if err != nil {
+			t.Fatal(tc.spec, err)
+		}
+		if rule.listen != tc.listen || rule.target != tc.target {
+			t.Fatal("bad rule for", tc.spec, rule)
+		}
+	}
+	for _, spec := range []string{"22", "22:host", "a:b:c:d:e", "x:host:22", "22::22", "22:host:nope", "/a.sock", "x:/a.sock"} {
+		_, err := parseForward(spec)
+		if err == nil {
+			t.Fatal("expected an error for", spec)
+		}
+	}
+}
+
+// permitTargets lets serveLink connect to targets for the test.
+func permitTargets(t *testing.T, targets ...string) {
+	permittedTargets = targets
+	t.Cleanup(func() { permittedTargets = nil })
+}
+
+// namedServer answers every connection with its name.
+func namedServer(t *testing.T, name string) string {
+	l, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	t.Cleanup(func() { l.Close() })
+	go func() {
+		for {
+			conn, err := l.Accept()
+			if err != nil {
+				return
+			}
+			conn.Write([]byte(name))
+			conn.Close()
+		}
+	}()
+	return l.Addr().String()
+}
+
+func TestForwards(t *testing.T) {
+	l1, l2 := link.Pipe(link.PipeConfig{})
+	defer l1.Close()
+	defer l2.Close()
+
+	targets := map[string]string{
+		"ssh":   namedServer(t, "ssh"),
+		"admin": namedServer(t, "admin"),
+		"":      namedServer(t, "default"),
+	}
+	permitTargets(t, targets["ssh"], targets["admin"])
+	go serveLink(l1, targets[""])
+
+	listeners := map[string]net.Listener{}
+	for name, target := range targets {
+		l, err := net.Listen("tcp", "127.0.0.1:0")
+		if err != nil {
+			t.Fatal(err)
+		}
+		defer l.Close()
+		if name == "" {
+			// No -L rules, the far end picks.
+			target = ""
+			name = "default"
+		}
+		listeners[name] = l
+		go serveForward(l2, l, target)
+	}
+
+	// Several connections through each forward at once.
+	done := make(chan error)
+	count := 0
+	for name, l := range listeners {
+		for i := 0; i < 3; i++ {
+			count++
+			go func(name, addr string) {
+				conn, err := net.Dial("tcp", addr)
+				if err != nil {
+					done <- err
+					return
+				}
+				defer conn.Close()
+				got, err := io.ReadAll(conn)
+				if err == nil && string(got) != name {
+					t.Errorf("connected to %q through the %q forward", got, name)
+				}
+				done <- err
+			}(name, l.Addr().String())
+		}
+	}
+	for i := 0; i < count; i++ {
+		err := <-done
+		if err != nil {
+			t.Fatal(err)
+		}
+	}
+}
+
+func TestForwardNotPermitted(t *testing.T) {
+	l1, l2 := link.Pipe(link.PipeConfig{})
+	defer l1.Close()
+	defer l2.Close()
+	permitTargets(t, namedServer(t, "ssh"))
+	go serveLink(l1, namedServer(t, "default"))
+
+	conn, err := l2.DialTarget(namedServer(t, "admin"))
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer conn.Close()
+	got, err := io.ReadAll(conn)
+	if err != nil || len(got) != 0 {
+		t.Fatal("expected the session to be refused", string(got), err)
+	}
+}
+
+func TestOptionsForwards(t *testing.T) {
+	o := defaultOptions("tcp2link")
+	rules, err := o.forwardRules()
+	if err != nil || len(rules) != 1 || rules[0].listen != o.Listen || rules[0].target != "" {
+		t.Fatal("expected the --listen rule", rules, err)
+	}
+
+	o.Forwards = stringList{"2222:127.0.0.1:22", "8080:127.0.0.1:80"}
+	rules, err = o.forwardRules()
+	if err != nil || len(rules) != 2 || rules[1].target != "127.0.0.1:80" {
+		t.Fatal("bad rules", rules, err)
+	}
+}
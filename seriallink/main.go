@@ -1,16 +1,33 @@
 package main
 
 import (
+	"flag"
 	"fmt"
 	"net"
 	"io"
-	"os"
 	"mako/serial/link"
+	"os"
+	"strings"
 )
 
 func help() {
     fmt.Println("seriallink provides a reliable link over lossy serial ports")
-    fmt.Println("on a mako run: seriallink ")
+    fmt.Println("")
+    fmt.Println("usage:")
+    fmt.Println("  seriallink tcp2link [options]   carry local tcp connections over the link,")
+    fmt.Println("                                  -L [bind:]port:host:hostport adds a forward")
+    fmt.Println("                                  -R [bind:]port:host:hostport adds a reverse forward")
+    fmt.Println("                                  -U [bind:]port:host:hostport adds a udp forward")
+    fmt.Println("  seriallink link2tcp [options]   forward sessions from the link to a tcp address")
+    fmt.Println("  seriallink socks [options]      run a SOCKS5 proxy whose connections go over the link")
+    fmt.Println("  seriallink shell [options]      open a shell on the far end")
+    fmt.Println("  seriallink exec [options] -- command [args...]")
+    fmt.Println("                                  run a command on the far end")
+    fmt.Println("  seriallink decode [file]        inspect captured link traffic")
+    fmt.Println("")
+    fmt.Println("on a mako run: seriallink link2tcp, add --allow-exec for shell and exec")
+    fmt.Println("and --permit host:port for each address the far end may connect to")
+    fmt.Println("run seriallink <mode> --help for the options of each mode.")
     os.Exit(0)
 }
 
@@ -35,62 +52,215 @@ func proxy(conn1 ,conn2 net.Conn) {
     
 }
 
-func tcp2link() error {
-    l,err := net.Listen("tcp","127.0.0.1:")
+func tcp2link(o *options) error {
+    socketMode = os.FileMode(o.SocketMode)
+    rules,err := o.forwardRules()
+    if err != nil {
+        return err
+    }
+    var listeners []net.Listener
+    defer func() {
+        for _,l := range listeners {
+            l.Close()
+        }
+    } ()
+    for _,rule := range rules {
+        l,err := listenEndpoint(rule.listen)
+        if err != nil {
+            return err
+        }
+        listeners = append(listeners,l)
+        if rule.target == "" {
+            fmt.Printf("listening on %s\n",l.Addr())
+        } else {
+            fmt.Printf("listening on %s, forwarding to %s\n",l.Addr(),rule.target)
+        }
+    }
+    
+    udpRules,err := o.udpForwardRules()
+    if err != nil {
+        return err
+    }
+    var packetConns []net.PacketConn
+    defer func() {
+        for _,pc := range packetConns {
+            pc.Close()
+        }
+    } ()
+    for _,rule := range udpRules {
+        pc,err := net.ListenPacket("udp",rule.listen)
+        if err != nil {
+            return err
+        }
+        packetConns = append(packetConns,pc)
+        fmt.Printf("listening on udp %s, forwarding to %s\n",pc.LocalAddr(),rule.target)
+    }
+    
+    reverse,err := o.reverseRules()
     if err != nil {
         return err
     }
-    defer l.Close()
-    fmt.Printf("listening on %s\n",l.Addr())
     
-    linkconn,err := net.Dial("tcp","127.0.0.1:8000")
+    link,closeLink,err := o.createLink()
     if err != nil {
-        return fmt.Errorf("dialing remote end of link failed. %s",err)
+        return err
+    }
+    defer closeLink()
+    
+    go serveReverse(link,reverse)
+    // Requested alongside serving the local forwards, a slow far end
+    // must not hold those up. Each forward lasts until the link closes.
+    for _,rule := range reverse {
+        go func(rule forward) {
+            control,addr,err := requestReverse(link,rule)
+            if err != nil {
+                fmt.Printf("reverse forward of %s failed. %s\n",rule.listen,err)
+                return
+            }
+            fmt.Printf("far end listening on %s, forwarding to %s\n",addr,rule.target)
+            <- link.Done()
+            control.Close()
+        } (rule)
+    }
+    
+    // Stop accepting connections as soon as the link is lost.
+    go func() {
+        <- link.Done()
+        for _,l := range listeners {
+            l.Close()
+        }
+        for _,pc := range packetConns {
+            pc.Close()
+        }
+    } ()
+    
+    errs := make(chan error,len(listeners)+len(packetConns)+1)
+    // With only reverse forwards nothing else ends the wait.
+    go func() {
+        <- link.Done()
+        errs <- link.Err()
+    } ()
+    for i := range listeners {
+        go func(l net.Listener, target string) {
+            errs <- serveForward(link,l,target)
+        } (listeners[i],rules[i].target)
+    }
+    for i := range packetConns {
+        go func(pc net.PacketConn, target string) {
+            errs <- serveUDPForward(link,pc,target)
+        } (packetConns[i],udpRules[i].target)
     }
-    defer linkconn.Close()
-    link := link.CreateLink(linkconn,linkconn)
-        
+    err = <- errs
+    if link.IsDown() {
+        return link.Err()
+    }
+    return err
+}
+
+// serveForward carries each connection accepted on l over a new session
+// asking the far end for target.
+func serveForward(lk *link.Link, l net.Listener, target string) error {
     for {
-        // Only accept one connection at a time.
         conn1,err := l.Accept()
         if err != nil {
             return err
         }
         fmt.Printf("incoming connection from %s. \n",conn1.RemoteAddr())
-        conn2,err := link.Dial()
-        if err != nil {
-            conn1.Close()
-            if link.IsDown() {
-                return err
-            } else {
+        go func() {
+            conn2,err := lk.DialTarget(target)
+            if err != nil {
+                conn1.Close()
                 fmt.Printf("dialing on link failed. %s\n",err)
-                continue
+                return
             }
-        }
-        proxy(conn1,conn2)
-        fmt.Println("connection closed.\n")
+            proxy(conn1,conn2)
+            fmt.Println("connection closed.")
+        } ()
+    }
+}
+
+func socks(o *options) error {
+    socketMode = os.FileMode(o.SocketMode)
+    l,err := listenEndpoint(o.Listen)
+    if err != nil {
+        return err
+    }
+    defer l.Close()
+    fmt.Printf("socks proxy listening on %s\n",l.Addr())
+    
+    link,closeLink,err := o.createLink()
+    if err != nil {
+        return err
     }
+    defer closeLink()
+    
+    // Stop accepting connections as soon as the link is lost.
+    go func() {
+        <- link.Done()
+        l.Close()
+    } ()
+    
+    err = serveSocks(link,l)
+    if link.IsDown() {
+        return link.Err()
+    }
+    return err
 }
 
-func handle_link2tcp(lconn net.Conn) {
-    tcpconn,err := net.Dial("tcp","127.0.0.1:22")
+func handle_link2tcp(lconn net.Conn, target string) {
+    tcpconn,err := dialEndpoint(target)
     if err != nil {
         lconn.Close()
-        fmt.Fprintf(os.Stderr,"failed to dial tcp conn. %s\n",err)
+        fmt.Fprintf(os.Stderr,"failed to dial %s. %s\n",target,err)
         return
     }
     proxy(tcpconn,lconn)    
 }
 
-func link2tcp() error {
-    l := link.CreateLink(os.Stdin,os.Stdout)
-    defer l.Close()
+func link2tcp(o *options) error {
+    socketMode = os.FileMode(o.SocketMode)
+    allowExec = o.AllowExec
+    permittedTargets = append([]string{o.Target},o.Permit...)
+    gatewayPorts = o.GatewayPorts
+    reverseSockets = o.ReverseSockets
+    l,closeLink,err := o.createLink()
+    if err != nil {
+        return err
+    }
+    defer closeLink()
+    go serveDatagrams(l)
+    return serveLink(l,o.Target)
+}
+
+// serveLink forwards each session to the target it was dialed with, or
+// defaultTarget if it has none.
+func serveLink(l *link.Link, defaultTarget string) error {
     for {
         lconn,err := l.Accept()
         if err != nil {
             return err
         }
-        handle_link2tcp(lconn)
+        target := lconn.(*link.LinkSession).Target()
+        if addr,ok := strings.CutPrefix(target,reverseListenPrefix); ok {
+            go serveReverseListen(l,lconn,addr)
+            continue
+        }
+        if req,ok := strings.CutPrefix(target,execPrefix); ok {
+            go serveExec(lconn,req)
+            continue
+        }
+        if addr,ok := strings.CutPrefix(target,socksConnectPrefix); ok {
+            go serveSocksConnect(lconn,addr)
+            continue
+        }
+        if target == "" {
+            target = defaultTarget
+        } else if !targetPermitted(target) {
+            fmt.Fprintf(os.Stderr,"refused session to %s, it is not --permit'ted.\n",target)
+            lconn.Close()
+            continue
+        }
+        go handle_link2tcp(lconn,target)
     }
 }
 
@@ -101,20 +271,61 @@ func main() {
     }
     
     switch args[1] {
+        case "help","-h","-help","--help":
+            help()
         case "tcp2link":
-            err := tcp2link()
+            o,err := parseOptions(args[1],args[2:],flag.ExitOnError)
+            if err != nil {
+                fmt.Fprintln(os.Stderr,err)
+                os.Exit(2)
+            }
+            err = tcp2link(o)
             if err != nil {
                 fmt.Println("failed to listen for connections.",err)
                 os.Exit(1)
             }
         case "link2tcp":
-            err := link2tcp()
+            o,err := parseOptions(args[1],args[2:],flag.ExitOnError)
+            if err != nil {
+                fmt.Fprintln(os.Stderr,err)
+                os.Exit(2)
+            }
+            err = link2tcp(o)
+            if err != nil {
+                fmt.Println("failed to listen for connections.",err)
+                os.Exit(1)
+            }
+        case "socks":
+            o,err := parseOptions(args[1],args[2:],flag.ExitOnError)
+            if err != nil {
+                fmt.Fprintln(os.Stderr,err)
+                os.Exit(2)
+            }
+            err = socks(o)
             if err != nil {
                 fmt.Println("failed to listen for connections.",err)
                 os.Exit(1)
             }
+        case "shell","exec":
+            o,err := parseOptions(args[1],args[2:],flag.ExitOnError)
+            if err != nil {
+                fmt.Fprintln(os.Stderr,err)
+                os.Exit(2)
+            }
+            status,err := execRemote(o)
+            if err != nil {
+                fmt.Fprintln(os.Stderr,"failed to run the command.",err)
+                os.Exit(1)
+            }
+            os.Exit(status)
+        case "decode":
+            err := decode(args[2:])
+            if err != nil {
+                fmt.Println("decode failed.",err)
+                os.Exit(1)
+            }
         default:
-            fmt.Println("unknown mode! %s",args[1])
+            fmt.Printf("unknown mode! %s\n",args[1])
             os.Exit(1)
     }
 
@@ -0,0 +1,546 @@
+package main
+
+import (
+	"bytes"
+	"encoding/json"
+	"errors"
+	"flag"
+	"fmt"
+	"io"
+	"log/slog"
+	"mako/serial/link"
+	"mako/serial/link/serialport"
+	"os"
+	"strconv"
+	"strings"
+	"time"
+)
+
+// options configure the modes that run a link. They come from the defaults,
+// then the --config file, then any flags given on the command line. -L, -R
+// and -U given on the command line replace the lists of the file rather
+// than adding to them.
+type options struct {
+	// Local address tcp2link accepts connections on, if there are no
+	// Forwards. Listen and target addresses may also be Unix socket
+	// paths, see endpoint.go.
+	Listen string `json:"listen"`
+	// tcp2link forward rules, [bind_address:]port:host:hostport.
+	Forwards stringList `json:"forwards"`
+	// tcp2link reverse forward rules in the same form. link2tcp listens
+	// on the first address and host:hostport is on the tcp2link side.
+	Reverse stringList `json:"reverse"`
+	// tcp2link UDP forward rules in the same form as Forwards.
+	UDPForwards stringList `json:"udp_forwards"`
+	// Address link2tcp forwards sessions to when they don't name one.
+	Target string `json:"target"`
+	// Permissions of the Unix sockets listened on.
+	SocketMode fileMode `json:"socket_mode"`
+	// Addresses link2tcp connects to when the far end names them, besides
+	// Target. "*" permits any.
+	Permit stringList `json:"permit"`
+	// Whether link2tcp listens for reverse forwards on addresses other
+	// than loopback ones, and on Unix sockets.
+	GatewayPorts   bool `json:"gateway_ports"`
+	ReverseSockets bool `json:"reverse_sockets"`
+	// Whether link2tcp runs commands for shell and exec.
+	AllowExec bool `json:"allow_exec"`
+	// What exec runs on the far end, from the command line only.
+	Command []string `json:"-"`
+	// What the link runs over: stdio, tcp or serial.
+	Transport string `json:"transport"`
+	// Address dialed by the tcp transport.
+	Endpoint string        `json:"endpoint"`
+	Serial   serialOptions `json:"serial"`
+	Link     linkOptions   `json:"link"`
+	Log      logOptions    `json:"log"`
+
+	// Whether the config file named a transport, see parseOptions.
+	transportSet bool
+}
+
+type serialOptions struct {
+	Device   string `json:"device"`
+	Baud     int    `json:"baud"`
+	Parity   string `json:"parity"`
+	StopBits int    `json:"stopbits"`
+	Flow     string `json:"flow"`
+}
+
+// linkOptions mirror link.Config, zero values keep the link defaults.
+type linkOptions struct {
+	KeepaliveInterval  duration `json:"keepalive_interval"`
+	KeepaliveTimeout   duration `json:"keepalive_timeout"`
+	HandshakeTimeout   duration `json:"handshake_timeout"`
+	RetransmitTimeout  duration `json:"retransmit_timeout"`
+	MinSegmentSize     int      `json:"min_segment_size"`
+	MaxSegmentSize     int      `json:"max_segment_size"`
+	InitialSegmentSize int      `json:"initial_segment_size"`
+	MaxDatagramSize    int      `json:"max_datagram_size"`
+	UDPIdleTimeout     duration `json:"udp_idle_timeout"`
+}
+
+type logOptions struct {
+	// debug, info, warn, error or none.
+	Level string `json:"level"`
+	// Log file, stderr if empty. Refused when Level is none.
+	File string `json:"file"`
+	// pcapng capture of all link frames, none if empty.
+	Capture string `json:"capture"`
+}
+
+// stringList is a flag that can be given several times.
+type stringList []string
+
+func (l *stringList) String() string {
+	return strings.Join(*l, ",")
+}
+
+// Set adds s as it is, addresses and socket paths may hold commas.
+func (l *stringList) Set(s string) error {
+	*l = append(*l, s)
+	return nil
+}
+
+// duration is a time.Duration written as "1s" or "250ms" in the config
+// file and on the command line.
+type duration time.Duration
+
+func (d duration) String() string {
+	return time.Duration(d).String()
+}
+
+func (d *duration) Set(s string) error {
+	v, err := time.ParseDuration(s)
+	if err != nil {
+		return err
+	}
+	*d = duration(v)
+	return nil
+}
+
+func (d duration) MarshalJSON() ([]byte, error) {
+	return json.Marshal(d.String())
+}
+
+func (d *duration) UnmarshalJSON(b []byte) error {
+	var s string
+	err := json.Unmarshal(b, &s)
+	if err != nil {
+		return err
+	}
+	return d.Set(s)
+}
+
+// fileMode is an os.FileMode written in octal, such as "0660".
+type fileMode os.FileMode
+
+func (m fileMode) String() string {
+	return fmt.Sprintf("%04o", uint32(m))
+}
+
+func (m *fileMode) Set(s string) error {
+	v, err := strconv.ParseUint(s, 8, 32)
+	if err != nil || v&^0777 != 0 {
+		return fmt.Errorf("bad file mode %q, expected permissions such as 0660", s)
+	}
+	*m = fileMode(v)
+	return nil
+}
+
+func (m fileMode) MarshalJSON() ([]byte, error) {
+	return json.Marshal(m.String())
+}
+
+func (m *fileMode) UnmarshalJSON(b []byte) error {
+	var s string
+	err := json.Unmarshal(b, &s)
+	if err != nil {
+		return err
+	}
+	return m.Set(s)
+}
+
+func defaultOptions(mode string) *options {
+	def := link.DefaultConfig()
+	o := &options{
+		Listen:     "127.0.0.1:0",
+		Target:     "127.0.0.1:22",
+		Transport:  "stdio",
+		Endpoint:   "127.0.0.1:8000",
+		SocketMode: 0600,
+		Serial: serialOptions{
+			Baud:     115200,
+			Parity:   "none",
+			StopBits: 1,
+			Flow:     "none",
+		},
+		Link: linkOptions{
+			KeepaliveInterval:  duration(def.KeepaliveInterval),
+			KeepaliveTimeout:   duration(def.KeepaliveTimeout),
+			HandshakeTimeout:   duration(def.HandshakeTimeout),
+			RetransmitTimeout:  duration(def.RetransmitTimeout),
+			MinSegmentSize:     def.MinSegmentSize,
+			MaxSegmentSize:     def.MaxSegmentSize,
+			InitialSegmentSize: def.InitialSegmentSize,
+			MaxDatagramSize:    def.MaxDatagramSize,
+			UDPIdleTimeout:     duration(def.DatagramIdleTimeout),
+		},
+		Log: logOptions{
+			Level: "none",
+		},
+	}
+	switch mode {
+	case "tcp2link", "shell", "exec":
+		o.Transport = "tcp"
+	case "socks":
+		o.Transport = "tcp"
+		o.Listen = "127.0.0.1:1080"
+	}
+	return o
+}
+
+// bindFlags defines a flag for every option, storing into o.
+func (o *options) bindFlags(fs *flag.FlagSet) {
+	fs.String("config", "", "JSON config file, flags given as well override it")
+	fs.StringVar(&o.Listen, "listen", o.Listen, "tcp2link and socks: address or Unix socket path to accept connections on")
+	fs.Var(&o.Forwards, "L", "tcp2link: forward `[bind_address:]port:host:hostport` over the link, either side may be a Unix socket path instead, may be repeated")
+	fs.Var(&o.Reverse, "R", "tcp2link: reverse forward `[bind_address:]port:host:hostport`, the far end listens and host:hostport is reached from this side, may be repeated")
+	fs.Var(&o.UDPForwards, "U", "tcp2link: forward UDP datagrams received on `[bind_address:]port:host:hostport` over the link, may be repeated")
+	fs.StringVar(&o.Target, "target", o.Target, "link2tcp: address or Unix socket path to forward sessions to if they don't name one")
+	fs.Var(&o.SocketMode, "socket-mode", "`permissions` of the Unix sockets listened on")
+	fs.Var(&o.Permit, "permit", "link2tcp: `host:port` or Unix socket path the far end may connect to besides --target, * for any, may be repeated")
+	fs.BoolVar(&o.GatewayPorts, "gateway-ports", o.GatewayPorts, "link2tcp: let -R rules of the far end listen on addresses other than loopback ones")
+	fs.BoolVar(&o.ReverseSockets, "reverse-sockets", o.ReverseSockets, "link2tcp: let -R rules of the far end listen on Unix socket paths")
+	fs.BoolVar(&o.AllowExec, "allow-exec", o.AllowExec, "link2tcp: run commands the far end asks for with shell and exec")
+	fs.StringVar(&o.Transport, "transport", o.Transport, "what the link runs over: stdio, tcp or serial")
+	fs.StringVar(&o.Endpoint, "endpoint", o.Endpoint, "address or Unix socket path dialed by the tcp transport")
+
+	fs.StringVar(&o.Serial.Device, "device", o.Serial.Device, "serial device, e.g. /dev/ttyUSB0, implies --transport serial")
+	fs.IntVar(&o.Serial.Baud, "baud", o.Serial.Baud, "serial baud rate")
+	fs.StringVar(&o.Serial.Parity, "parity", o.Serial.Parity, "serial parity: none, odd or even")
+	fs.IntVar(&o.Serial.StopBits, "stopbits", o.Serial.StopBits, "serial stop bits: 1 or 2")
+	fs.StringVar(&o.Serial.Flow, "flow", o.Serial.Flow, "serial flow control: none, rtscts or xonxoff")
+
+	fs.Var(&o.Link.KeepaliveInterval, "keepalive-interval", "`interval` between keepalive pings")
+	fs.Var(&o.Link.KeepaliveTimeout, "keepalive-timeout", "`time` a silent peer is given before the session is lost")
+	fs.Var(&o.Link.HandshakeTimeout, "handshake-timeout", "`time` each handshake step may take")
+	fs.Var(&o.Link.RetransmitTimeout, "retransmit-timeout", "`time` to wait for an ack before resending")
+	fs.IntVar(&o.Link.MinSegmentSize, "min-segment", o.Link.MinSegmentSize, "smallest DATA segment in bytes")
+	fs.IntVar(&o.Link.MaxSegmentSize, "max-segment", o.Link.MaxSegmentSize, "largest DATA segment in bytes")
+	fs.IntVar(&o.Link.InitialSegmentSize, "initial-segment", o.Link.InitialSegmentSize, "DATA segment size to start with")
+	fs.IntVar(&o.Link.MaxDatagramSize, "max-datagram", o.Link.MaxDatagramSize, "largest UDP datagram in bytes carried over the link")
+	fs.Var(&o.Link.UDPIdleTimeout, "udp-idle-timeout", "`time` without datagrams after which a UDP flow is forgotten")
+
+	fs.StringVar(&o.Log.Level, "log-level", o.Log.Level, "log level: debug, info, warn, error or none")
+	fs.StringVar(&o.Log.File, "log-file", o.Log.File, "file to log to, stderr if empty, needs a --log-level")
+	fs.StringVar(&o.Log.Capture, "capture", o.Log.Capture, "write a pcapng capture of all link frames to this file")
+}
+
+// parseOptions parses the command line of mode.
+func parseOptions(mode string, args []string, errorHandling flag.ErrorHandling) (*options, error) {
+	o := defaultOptions(mode)
+	fs := flag.NewFlagSet(mode, errorHandling)
+	o.bindFlags(fs)
+	fs.Usage = func() { modeUsage(fs) }
+	err := fs.Parse(args)
+	if err != nil {
+		return nil, err
+	}
+	if mode == "exec" {
+		if fs.NArg() == 0 {
+			return nil, errors.New("exec needs a command, as in seriallink exec -- uname -a")
+		}
+	} else if fs.NArg() != 0 {
+		return nil, fmt.Errorf("unexpected argument %q", fs.Arg(0))
+	}
+
+	if path := fs.Lookup("config").Value.String(); path != "" {
+		// Start again from the file, then put back what was given on the
+		// command line.
+		o = defaultOptions(mode)
+		err := o.load(path)
+		if err != nil {
+			return nil, err
+		}
+		fileFs := flag.NewFlagSet(mode, flag.ContinueOnError)
+		o.bindFlags(fileFs)
+		fs.Visit(func(f *flag.Flag) {
+			if err != nil {
+				return
+			}
+			// String joins lists, so they are copied instead.
+			if l, ok := fileFs.Lookup(f.Name).Value.(*stringList); ok {
+				*l = append(stringList(nil), *f.Value.(*stringList)...)
+				return
+			}
+			err = fileFs.Set(f.Name, f.Value.String())
+		})
+		if err != nil {
+			return nil, err
+		}
+	}
+
+	// --device alone is enough to select the serial transport, unless
+	// the transport was given as well.
+	explicit := o.transportSet
+	fs.Visit(func(f *flag.Flag) {
+		if f.Name == "transport" {
+			explicit = true
+		}
+	})
+	if o.Serial.Device != "" && !explicit {
+		o.Transport = "serial"
+	}
+	o.Command = fs.Args()
+	return o, o.validate()
+}
+
+// load reads a JSON config file over o.
+func (o *options) load(path string) error {
+	data, err := os.ReadFile(path)
+	if err != nil {
+		return err
+	}
+	dec := json.NewDecoder(bytes.NewReader(data))
+	dec.DisallowUnknownFields()
+	err = dec.Decode(o)
+	if err != nil {
+		return fmt.Errorf("reading config %s: %w", path, err)
+	}
+	var set struct {
+		Transport *string `json:"transport"`
+	}
+	json.Unmarshal(data, &set)
+	o.transportSet = set.Transport != nil
+	return nil
+}
+
+func (o *options) validate() error {
+	switch o.Transport {
+	case "stdio", "tcp":
+	case "serial":
+		if o.Serial.Device == "" {
+			return errors.New("the serial transport needs a --device")
+		}
+		_, err := o.Serial.config()
+		if err != nil {
+			return err
+		}
+	default:
+		return fmt.Errorf("unknown transport %q", o.Transport)
+	}
+	_, err := o.forwardRules()
+	if err != nil {
+		return err
+	}
+	_, err = o.reverseRules()
+	if err != nil {
+		return err
+	}
+	_, err = o.udpForwardRules()
+	if err != nil {
+		return err
+	}
+	_, err = parseLogLevel(o.Log.Level)
+	if err != nil {
+		return err
+	}
+	if o.Log.Level == "none" && o.Log.File != "" {
+		return errors.New("--log-file needs a --log-level other than none")
+	}
+	return nil
+}
+
+func (o *serialOptions) config() (serialport.Config, error) {
+	conf := serialport.Config{
+		Device:   o.Device,
+		Baud:     o.Baud,
+		StopBits: o.StopBits,
+	}
+	var err error
+	conf.Parity, err = serialport.ParseParity(o.Parity)
+	if err != nil {
+		return conf, err
+	}
+	conf.Flow, err = serialport.ParseFlowControl(o.Flow)
+	if err != nil {
+		return conf, err
+	}
+	return conf, nil
+}
+
+// parseLogLevel accepts none as well, for which the caller sets no logger.
+func parseLogLevel(s string) (slog.Level, error) {
+	var level slog.Level
+	if s == "none" {
+		return level, nil
+	}
+	err := level.UnmarshalText([]byte(s))
+	if err != nil {
+		return level, fmt.Errorf("unknown log level %q", s)
+	}
+	return level, nil
+}
+
+// linkConfig builds the link configuration, opening the log and capture
+// files. The returned function closes them.
+func (o *options) linkConfig() (link.Config, func(), error) {
+	conf := link.Config{
+		KeepaliveInterval:   time.Duration(o.Link.KeepaliveInterval),
+		KeepaliveTimeout:    time.Duration(o.Link.KeepaliveTimeout),
+		HandshakeTimeout:    time.Duration(o.Link.HandshakeTimeout),
+		RetransmitTimeout:   time.Duration(o.Link.RetransmitTimeout),
+		MinSegmentSize:      o.Link.MinSegmentSize,
+		MaxSegmentSize:      o.Link.MaxSegmentSize,
+		InitialSegmentSize:  o.Link.InitialSegmentSize,
+		MaxDatagramSize:     o.Link.MaxDatagramSize,
+		DatagramIdleTimeout: time.Duration(o.Link.UDPIdleTimeout),
+	}
+	var files []*os.File
+	cleanup := func() {
+		for _, f := range files {
+			f.Close()
+		}
+	}
+
+	if o.Log.Level != "none" {
+		level, err := parseLogLevel(o.Log.Level)
+		if err != nil {
+			return conf, cleanup, err
+		}
+		var w io.Writer = os.Stderr
+		if o.Log.File != "" {
+			f, err := os.OpenFile(o.Log.File, os.O_WRONLY|os.O_CREATE|os.O_APPEND, 0644)
+			if err != nil {
+				return conf, cleanup, err
+			}
+			files = append(files, f)
+			w = f
+		}
+		conf.Logger = slog.New(slog.NewTextHandler(w, &slog.HandlerOptions{Level: level}))
+	}
+
+	if o.Log.Capture != "" {
+		f, err := os.Create(o.Log.Capture)
+		if err != nil {
+			cleanup()
+			return conf, func() {}, err
+		}
+		files = append(files, f)
+		conf.Capture = f
+	}
+	return conf, cleanup, nil
+}
+
+// openTransport opens what the link runs over.
+func (o *options) openTransport() (io.ReadCloser, io.WriteCloser, error) {
+	switch o.Transport {
+	case "stdio":
+		return os.Stdin, os.Stdout, nil
+	case "tcp":
+		conn, err := dialEndpoint(o.Endpoint)
+		if err != nil {
+			return nil, nil, fmt.Errorf("dialing remote end of link failed. %s", err)
+		}
+		return conn, conn, nil
+	case "serial":
+		conf, err := o.Serial.config()
+		if err != nil {
+			return nil, nil, err
+		}
+		port, err := serialport.Open(conf)
+		if err != nil {
+			return nil, nil, fmt.Errorf("opening serial port failed. %s", err)
+		}
+		return port, port, nil
+	}
+	return nil, nil, fmt.Errorf("unknown transport %q", o.Transport)
+}
+
+// createLink opens the transport and starts a link over it. The returned
+// function closes the link and everything opened for it.
+func (o *options) createLink() (*link.Link, func(), error) {
+	conf, cleanup, err := o.linkConfig()
+	if err != nil {
+		return nil, nil, err
+	}
+	r, w, err := o.openTransport()
+	if err != nil {
+		cleanup()
+		return nil, nil, err
+	}
+	l := link.CreateLinkWithConfig(r, w, conf)
+	return l, func() {
+		l.Close()
+		// Stdin and stdout are left alone, they are not ours.
+		if o.Transport != "stdio" {
+			r.Close()
+			w.Close()
+		}
+		cleanup()
+	}, nil
+}
+
+const configExample = `{
+  "forwards": ["2222:127.0.0.1:22", "8080:127.0.0.1:80", "9100:127.0.0.1:9100"],
+  "reverse": ["8123:127.0.0.1:123", "5140:logs.example.com:514"],
+  "socket_mode": "0660",
+  "udp_forwards": ["5353:10.0.0.1:53", "5514:127.0.0.1:514"],
+  "transport": "serial",
+  "serial": {"device": "/dev/ttyUSB0", "baud": 115200, "flow": "rtscts"},
+  "link": {"keepalive_timeout": "10s", "max_segment_size": 512},
+  "log": {"level": "info", "file": "/var/log/seriallink.log"}
+}`
+
+func modeUsage(fs *flag.FlagSet) {
+	w := fs.Output()
+	switch fs.Name() {
+	case "tcp2link":
+		fmt.Fprintln(w, "usage: seriallink tcp2link [options]")
+		fmt.Fprintln(w, "")
+		fmt.Fprintln(w, "Accepts TCP connections and carries each over a new session on the link.")
+		fmt.Fprintln(w, "Every -L rule listens on its own port and asks the far end to connect")
+		fmt.Fprintln(w, "to its host and port, like ssh -L. Without any, connections are taken")
+		fmt.Fprintln(w, "on --listen and the far end connects them to its --target.")
+		fmt.Fprintln(w, "Every -R rule has the far end listen instead, connections it takes")
+		fmt.Fprintln(w, "come back over the link and are connected to host:hostport from here.")
+		fmt.Fprintln(w, "Every -U rule takes UDP datagrams on its port and has the far end send")
+		fmt.Fprintln(w, "them on to host:hostport. Replies go back to the sender they answer,")
+		fmt.Fprintln(w, "until the flow has been idle for --udp-idle-timeout.")
+		fmt.Fprintln(w, "Ports and host:hostport in rules may be Unix socket paths instead, as in")
+		fmt.Fprintln(w, "-L /run/ctl.sock:/var/run/docker.sock. A path must contain a slash.")
+	case "link2tcp":
+		fmt.Fprintln(w, "usage: seriallink link2tcp [options]")
+		fmt.Fprintln(w, "")
+		fmt.Fprintln(w, "Accepts sessions from the link and connects each to the address it was")
+		fmt.Fprintln(w, "dialed with, or --target if none was given. Listens for the -R rules")
+		fmt.Fprintln(w, "of the tcp2link side and sends on the datagrams of its -U rules.")
+		fmt.Fprintln(w, "Only --target and the addresses given with --permit are connected to,")
+		fmt.Fprintln(w, "the -L and -U rules of the far end and its socks proxy need them.")
+		fmt.Fprintln(w, "-R rules may only listen on loopback addresses, unless --gateway-ports")
+		fmt.Fprintln(w, "is given, and on Unix sockets with --reverse-sockets.")
+		fmt.Fprintln(w, "With --allow-exec it also runs the commands of shell and exec, as the")
+		fmt.Fprintln(w, "user link2tcp runs as. Anyone who can reach the link can then do so.")
+	case "socks":
+		fmt.Fprintln(w, "usage: seriallink socks [options]")
+		fmt.Fprintln(w, "")
+		fmt.Fprintln(w, "Runs a SOCKS5 proxy on --listen. Each CONNECT request opens a session")
+		fmt.Fprintln(w, "naming the requested destination, which link2tcp on the far end dials.")
+		fmt.Fprintln(w, "That needs link2tcp --permit for the destinations, or --permit '*'.")
+		fmt.Fprintln(w, "Only the options about the link and --listen apply.")
+	case "shell", "exec":
+		fmt.Fprintln(w, "usage: seriallink shell [options]")
+		fmt.Fprintln(w, "       seriallink exec [options] -- command [args...]")
+		fmt.Fprintln(w, "")
+		fmt.Fprintln(w, "Runs a login shell, or the command, on the far end under a pseudo-terminal")
+		fmt.Fprintln(w, "connected to this one, and exits with its exit status. Window size")
+		fmt.Fprintln(w, "changes and signals are passed on. link2tcp on the far end must be")
+		fmt.Fprintln(w, "started with --allow-exec. Only the options about the link apply.")
+	}
+	fmt.Fprintln(w, "")
+	fs.PrintDefaults()
+	fmt.Fprintln(w, "")
+	fmt.Fprintln(w, "The same settings can be given in a --config file, for example:")
+	fmt.Fprintln(w, configExample)
+}
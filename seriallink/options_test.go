@@ -0,0 +1,220 @@
+package main
+
+import (
+	"flag"
+	"mako/serial/link/serialport"
+	"os"
+	"path/filepath"
+	"testing"
+	"time"
+)
+
+func writeConfig(t *testing.T, data string) string {
+	path := filepath.Join(t.TempDir(), "config.json")
+	err := os.WriteFile(path, []byte(data), 0644)
+	if err != nil {
+		t.Fatal(err)
+	}
+	return path
+}
+
+func TestOptionsDefaults(t *testing.T) {
+	o, err := parseOptions("tcp2link", nil, flag.ContinueOnError)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if o.Listen != "127.0.0.1:0" || o.Transport != "tcp" || o.Endpoint != "127.0.0.1:8000" {
+		t.Fatal("bad tcp2link defaults", o)
+	}
+	o, err = parseOptions("link2tcp", nil, flag.ContinueOnError)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if o.Target != "127.0.0.1:22" || o.Transport != "stdio" {
+		t.Fatal("bad link2tcp defaults", o)
+	}
+	o, err = parseOptions("socks", nil, flag.ContinueOnError)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if o.Listen != "127.0.0.1:1080" || o.Transport != "tcp" {
+		t.Fatal("bad socks defaults", o)
+	}
+}
+
+func TestOptionsFlags(t *testing.T) {
+	o, err := parseOptions("link2tcp", []string{
+		"--target", "10.0.0.1:80",
+		"-L", "2222:127.0.0.1:22", "-L", "8080:127.0.0.1:80",
+		"--device", "/dev/ttyUSB0", "--baud", "9600", "--parity", "even", "--stopbits", "2", "--flow", "rtscts",
+		"--keepalive-timeout", "10s", "--max-segment", "512",
+		"--log-level", "debug",
+	}, flag.ContinueOnError)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if o.Target != "10.0.0.1:80" {
+		t.Fatal("bad target", o.Target)
+	}
+	if len(o.Forwards) != 2 || o.Forwards[1] != "8080:127.0.0.1:80" {
+		t.Fatal("bad forwards", o.Forwards)
+	}
+	if o.Transport != "serial" {
+		t.Fatal("--device should select the serial transport", o.Transport)
+	}
+	conf, err := o.Serial.config()
+	if err != nil {
+		t.Fatal(err)
+	}
+	expected := serialport.Config{
+		Device:   "/dev/ttyUSB0",
+		Baud:     9600,
+		Parity:   serialport.EvenParity,
+		StopBits: 2,
+		Flow:     serialport.RTSCTS,
+	}
+	if conf != expected {
+		t.Fatal("bad serial config", conf)
+	}
+
+	lconf, cleanup, err := o.linkConfig()
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer cleanup()
+	if lconf.KeepaliveTimeout != 10*time.Second || lconf.MaxSegmentSize != 512 {
+		t.Fatal("bad link config", lconf)
+	}
+	if lconf.KeepaliveInterval != time.Second || lconf.Logger == nil {
+		t.Fatal("bad link config", lconf)
+	}
+}
+
+func TestOptionsConfigFile(t *testing.T) {
+	path := writeConfig(t, `{
+		"listen": "127.0.0.1:2222",
+		"endpoint": "10.0.0.2:8000",
+		"forwards": ["2222:127.0.0.1:22"],
+		"link": {"retransmit_timeout": "20ms", "max_segment_size": 256},
+		"log": {"level": "warn"}
+	}`)
+
+	// Flags win over the file, whichever order they come in.
+	o, err := parseOptions("tcp2link", []string{"--max-segment", "128", "--config", path}, flag.ContinueOnError)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if o.Listen != "127.0.0.1:2222" || o.Endpoint != "10.0.0.2:8000" || o.Log.Level != "warn" {
+		t.Fatal("file not applied", o)
+	}
+	if time.Duration(o.Link.RetransmitTimeout) != 20*time.Millisecond {
+		t.Fatal("bad duration", o.Link.RetransmitTimeout)
+	}
+	if len(o.Forwards) != 1 {
+		t.Fatal("bad forwards", o.Forwards)
+	}
+	if o.Link.MaxSegmentSize != 128 {
+		t.Fatal("flag should override the file", o.Link.MaxSegmentSize)
+	}
+	if o.Link.KeepaliveTimeout != duration(5*time.Second) {
+		t.Fatal("unset fields should keep their defaults", o.Link.KeepaliveTimeout)
+	}
+}
+
+func TestOptionsConfigFileLists(t *testing.T) {
+	path := writeConfig(t, `{
+		"forwards": ["2222:127.0.0.1:22", "8080:127.0.0.1:80"],
+		"reverse": ["8123:127.0.0.1:123"]
+	}`)
+	o, err := parseOptions("tcp2link", []string{"--config", path, "-L", "9000:127.0.0.1:90"}, flag.ContinueOnError)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(o.Forwards) != 1 || o.Forwards[0] != "9000:127.0.0.1:90" {
+		t.Fatal("-L should replace the forwards of the file", o.Forwards)
+	}
+	if len(o.Reverse) != 1 {
+		t.Fatal("lists not given as flags should come from the file", o.Reverse)
+	}
+}
+
+// Socket paths may hold commas, list flags must not split them.
+func TestOptionsListCommas(t *testing.T) {
+	for _, args := range [][]string{
+		{"--permit", "/tmp/a,b.sock", "--permit", "127.0.0.1:22"},
+		{"--config", writeConfig(t, `{}`), "--permit", "/tmp/a,b.sock", "--permit", "127.0.0.1:22"},
+	} {
+		o, err := parseOptions("link2tcp", args, flag.ContinueOnError)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if len(o.Permit) != 2 || o.Permit[0] != "/tmp/a,b.sock" || o.Permit[1] != "127.0.0.1:22" {
+			t.Fatal("bad permit list", o.Permit)
+		}
+	}
+}
+
+func TestOptionsConfigFileTransport(t *testing.T) {
+	path := writeConfig(t, `{
+		"transport": "tcp",
+		"serial": {"device": "/dev/ttyUSB0"}
+	}`)
+	o, err := parseOptions("tcp2link", []string{"--config", path}, flag.ContinueOnError)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if o.Transport != "tcp" {
+		t.Fatal("the transport of the file should be kept", o.Transport)
+	}
+
+	path = writeConfig(t, `{"serial": {"device": "/dev/ttyUSB0"}}`)
+	o, err = parseOptions("tcp2link", []string{"--config", path}, flag.ContinueOnError)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if o.Transport != "serial" {
+		t.Fatal("a device alone should select the serial transport", o.Transport)
+	}
+}
+
+func TestOptionsErrors(t *testing.T) {
+	for _, args := range [][]string{
+		{"--transport", "carrier-pigeon"},
+		{"--transport", "serial"},
+		{"--device", "/dev/ttyS0", "--parity", "mark"},
+		{"--log-level", "chatty"},
+		{"--log-file", "/tmp/seriallink.log"},
+		{"--log-level", "none", "--log-file", "/tmp/seriallink.log"},
+		{"-L", "22:host"},
+		{"-R", "22:host"},
+		{"--keepalive-timeout", "soon"},
+		{"--socket-mode", "0999"},
+		{"--socket-mode", "17777"},
+		{"--config", writeConfig(t, `{"listne": "127.0.0.1:1"}`)},
+		{"--config", "/nonexistent.json"},
+		{"extra"},
+	} {
+		_, err := parseOptions("tcp2link", args, flag.ContinueOnError)
+		if err == nil {
+			t.Fatal("expected an error for", args)
+		}
+	}
+}
+
+func TestOptionsExec(t *testing.T) {
+	o, err := parseOptions("exec", []string{"--endpoint", "127.0.0.1:9", "--", "ls", "-l"}, flag.ContinueOnError)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if o.Transport != "tcp" || len(o.Command) != 2 || o.Command[1] != "-l" {
+		t.Fatal("bad exec options", o)
+	}
+	_, err = parseOptions("exec", nil, flag.ContinueOnError)
+	if err == nil {
+		t.Fatal("expected an error without a command")
+	}
+	_, err = parseOptions("shell", []string{"ls"}, flag.ContinueOnError)
+	if err == nil {
+		t.Fatal("expected an error for an argument to shell")
+	}
+}
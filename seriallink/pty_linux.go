@@ -0,0 +1,183 @@
+package main
+
+import (
+	"fmt"
+	"os"
+	"os/exec"
+	"os/signal"
+	"syscall"
+	"unsafe"
+)
+
+// startPty starts cmd as a session leader with a new pseudo-terminal as
+// its controlling terminal, and returns the master side.
+func startPty(cmd *exec.Cmd, rows, cols uint16) (*os.File, error) {
+	master, err := os.OpenFile("/dev/ptmx", os.O_RDWR|syscall.O_NOCTTY, 0)
+	if err != nil {
+		return nil, err
+	}
+	var n uint32
+	var unlock int32
+	err = control(master, func(fd uintptr) error {
+		err := ioctl(fd, syscall.TIOCGPTN, uintptr(unsafe.Pointer(&n)))
+		if err != nil {
+			return err
+		}
+		return ioctl(fd, syscall.TIOCSPTLCK, uintptr(unsafe.Pointer(&unlock)))
+	})
+	if err != nil {
+		master.Close()
+		return nil, err
+	}
+	if rows != 0 && cols != 0 {
+		setPtySize(master, rows, cols)
+	}
+	slave, err := os.OpenFile(fmt.Sprintf("/dev/pts/%d", n), os.O_RDWR|syscall.O_NOCTTY, 0)
+	if err != nil {
+		master.Close()
+		return nil, err
+	}
+	// Only the command keeps the slave open, so reads on the master fail
+	// once it is gone.
+	defer slave.Close()
+
+	cmd.Stdin = slave
+	cmd.Stdout = slave
+	cmd.Stderr = slave
+	cmd.SysProcAttr = &syscall.SysProcAttr{Setsid: true, Setctty: true}
+	err = cmd.Start()
+	if err != nil {
+		master.Close()
+		return nil, err
+	}
+	return master, nil
+}
+
+func setPtySize(master *os.File, rows, cols uint16) error {
+	ws := winsize{Row: rows, Col: cols}
+	return control(master, func(fd uintptr) error {
+		return ioctl(fd, syscall.TIOCSWINSZ, uintptr(unsafe.Pointer(&ws)))
+	})
+}
+
+// signalForeground sends sig to the foreground process group of the
+// terminal, or to the command's if that is unknown.
+func signalForeground(master *os.File, cmd *exec.Cmd, sig syscall.Signal) error {
+	var pgrp int32
+	err := control(master, func(fd uintptr) error {
+		return ioctl(fd, syscall.TIOCGPGRP, uintptr(unsafe.Pointer(&pgrp)))
+	})
+	if err != nil || pgrp <= 0 {
+		// The command is a session leader, its pid is its group.
+		pgrp = int32(cmd.Process.Pid)
+	}
+	return syscall.Kill(-int(pgrp), sig)
+}
+
+// waitExited waits for the command to exit without reaping it, so its
+// pid is not reused before cmd.Wait.
+func waitExited(cmd *exec.Cmd) error {
+	const pPid = 1
+	var info [128]byte
+	for {
+		_, _, errno := syscall.Syscall6(syscall.SYS_WAITID, pPid, uintptr(cmd.Process.Pid),
+			uintptr(unsafe.Pointer(&info)), syscall.WEXITED|syscall.WNOWAIT, 0, 0)
+		if errno == syscall.EINTR {
+			continue
+		} else if errno != 0 {
+			return errno
+		}
+		return nil
+	}
+}
+
+// exitStatus is the status a shell would report, 128 plus the signal
+// number for a command killed by a signal.
+func exitStatus(state *os.ProcessState) int {
+	if ws, ok := state.Sys().(syscall.WaitStatus); ok && ws.Signaled() {
+		return 128 + int(ws.Signal())
+	}
+	return state.ExitCode()
+}
+
+func isTerminal(f *os.File) bool {
+	var t syscall.Termios
+	err := control(f, func(fd uintptr) error {
+		return ioctl(fd, syscall.TCGETS, uintptr(unsafe.Pointer(&t)))
+	})
+	return err == nil
+}
+
+func terminalSize(f *os.File) (uint16, uint16, error) {
+	var ws winsize
+	err := control(f, func(fd uintptr) error {
+		return ioctl(fd, syscall.TIOCGWINSZ, uintptr(unsafe.Pointer(&ws)))
+	})
+	return ws.Row, ws.Col, err
+}
+
+// makeRaw puts the terminal in raw mode, like cfmakeraw, and returns a
+// function restoring the previous mode.
+func makeRaw(f *os.File) (func(), error) {
+	var old syscall.Termios
+	err := control(f, func(fd uintptr) error {
+		err := ioctl(fd, syscall.TCGETS, uintptr(unsafe.Pointer(&old)))
+		if err != nil {
+			return err
+		}
+		t := old
+		t.Iflag &^= syscall.IGNBRK | syscall.BRKINT | syscall.PARMRK | syscall.ISTRIP |
+			syscall.INLCR | syscall.IGNCR | syscall.ICRNL | syscall.IXON
+		t.Oflag &^= syscall.OPOST
+		t.Lflag &^= syscall.ECHO | syscall.ECHONL | syscall.ICANON | syscall.ISIG | syscall.IEXTEN
+		t.Cflag &^= syscall.CSIZE | syscall.PARENB
+		t.Cflag |= syscall.CS8
+		t.Cc[syscall.VMIN] = 1
+		t.Cc[syscall.VTIME] = 0
+		return ioctl(fd, syscall.TCSETS, uintptr(unsafe.Pointer(&t)))
+	})
+	if err != nil {
+		return nil, err
+	}
+	return func() {
+		control(f, func(fd uintptr) error {
+			return ioctl(fd, syscall.TCSETS, uintptr(unsafe.Pointer(&old)))
+		})
+	}, nil
+}
+
+// notifyResize relays window size changes of the terminal to c.
+func notifyResize(c chan<- os.Signal) {
+	signal.Notify(c, syscall.SIGWINCH)
+}
+
+type winsize struct {
+	Row    uint16
+	Col    uint16
+	Xpixel uint16
+	Ypixel uint16
+}
+
+// control runs f on the file descriptor of file.
+func control(file *os.File, f func(fd uintptr) error) error {
+	rc, err := file.SyscallConn()
+	if err != nil {
+		return err
+	}
+	var ferr error
+	err = rc.Control(func(fd uintptr) {
+		ferr = f(fd)
+	})
+	if err != nil {
+		return err
+	}
+	return ferr
+}
+
+func ioctl(fd, req, arg uintptr) error {
+	_, _, errno := syscall.Syscall(syscall.SYS_IOCTL, fd, req, arg)
+	if errno != 0 {
+		return errno
+	}
+	return nil
+}
@@ -0,0 +1,48 @@
+//go:build !linux
+
+package main
+
+import (
+	"errors"
+	"os"
+	"os/exec"
+	"syscall"
+)
+
+var errNoPty = errors.New("pseudo-terminals are only supported on linux")
+
+// startPty is only implemented on linux.
+func startPty(cmd *exec.Cmd, rows, cols uint16) (*os.File, error) {
+	return nil, errNoPty
+}
+
+func setPtySize(master *os.File, rows, cols uint16) error {
+	return errNoPty
+}
+
+func signalForeground(master *os.File, cmd *exec.Cmd, sig syscall.Signal) error {
+	return cmd.Process.Signal(sig)
+}
+
+func waitExited(cmd *exec.Cmd) error {
+	return errNoPty
+}
+
+func exitStatus(state *os.ProcessState) int {
+	return state.ExitCode()
+}
+
+func isTerminal(f *os.File) bool {
+	return false
+}
+
+func terminalSize(f *os.File) (uint16, uint16, error) {
+	return 0, 0, errNoPty
+}
+
+func makeRaw(f *os.File) (func(), error) {
+	return nil, errNoPty
+}
+
+func notifyResize(c chan<- os.Signal) {
+}
@@ -0,0 +1,161 @@
+package main
+
+// Reverse forwards work like ssh -R. For each rule tcp2link opens a
+// control session asking link2tcp to listen on the rule's address, and
+// link2tcp answers with a status line. Connections link2tcp accepts there
+// come back over the link as sessions naming the listen address, which
+// tcp2link connects to the rule's target. The far end never chooses what
+// tcp2link connects to, and a forward lasts as long as its control
+// session. Unless link2tcp allows more, the far end may only have it
+// listen on loopback addresses, like ssh without GatewayPorts.
+
+import (
+	"bufio"
+	"errors"
+	"fmt"
+	"io"
+	"mako/serial/link"
+	"net"
+	"os"
+	"strings"
+	"time"
+)
+
+// Session target prefixes for control sessions, and for sessions
+// carrying a reverse forwarded connection.
+const (
+	reverseListenPrefix = "listen:"
+	reverseTargetPrefix = "reverse:"
+)
+
+// How long the far end may take to answer a reverse forward request.
+var reverseRequestTimeout = 30 * time.Second
+
+// Whether link2tcp listens on addresses other than loopback ones, and on
+// Unix sockets, for reverse forwards. See --gateway-ports and
+// --reverse-sockets.
+var (
+	gatewayPorts   bool
+	reverseSockets bool
+)
+
+// reverseListenAllowed returns why link2tcp won't listen on addr for the
+// far end, or nil if it may.
+func reverseListenAllowed(addr string) error {
+	if isUnixPath(addr) {
+		if !reverseSockets {
+			return fmt.Errorf("listening on Unix socket %s is not allowed, see link2tcp --reverse-sockets", addr)
+		}
+		return nil
+	}
+	if gatewayPorts {
+		return nil
+	}
+	host, _, err := net.SplitHostPort(addr)
+	if err != nil {
+		return err
+	}
+	if ip := net.ParseIP(host); host != "localhost" && (ip == nil || !ip.IsLoopback()) {
+		return fmt.Errorf("listening on %s is not allowed, only loopback addresses are without link2tcp --gateway-ports", addr)
+	}
+	return nil
+}
+
+// requestReverse asks the far end to listen for rule. The returned
+// control session must be kept open for as long as the forward is wanted.
+func requestReverse(lk *link.Link, rule forward) (net.Conn, string, error) {
+	control, err := lk.DialTarget(reverseListenPrefix + rule.listen)
+	if err != nil {
+		return nil, "", err
+	}
+	control.SetReadDeadline(time.Now().Add(reverseRequestTimeout))
+	status, err := bufio.NewReader(control).ReadString('\n')
+	if err != nil {
+		control.Close()
+		return nil, "", err
+	}
+	control.SetReadDeadline(time.Time{})
+	status = strings.TrimSpace(status)
+	addr, ok := strings.CutPrefix(status, "ok ")
+	if !ok {
+		control.Close()
+		return nil, "", errors.New(status)
+	}
+	return control, addr, nil
+}
+
+// serveReverse accepts the sessions the far end opens for reverse
+// forwards and connects each to the target of its rule. Anything else is
+// refused.
+func serveReverse(lk *link.Link, rules []forward) error {
+	targets := map[string]string{}
+	for _, rule := range rules {
+		targets[reverseTargetPrefix+rule.listen] = rule.target
+	}
+	for {
+		lconn, err := lk.Accept()
+		if err != nil {
+			return err
+		}
+		target, ok := targets[lconn.(*link.LinkSession).Target()]
+		if !ok {
+			fmt.Printf("refused session for %q.\n", lconn.(*link.LinkSession).Target())
+			lconn.Close()
+			continue
+		}
+		go handle_link2tcp(lconn, target)
+	}
+}
+
+// serveReverseListen is the link2tcp side of a control session: it
+// listens on addr until the control session closes, carrying each
+// connection back over the link.
+func serveReverseListen(lk *link.Link, control net.Conn, addr string) {
+	defer control.Close()
+	err := reverseListenAllowed(addr)
+	var l net.Listener
+	if err == nil {
+		l, err = listenEndpoint(addr)
+	}
+	if err != nil {
+		fmt.Fprintf(control, "error: %s\n", err)
+		fmt.Fprintf(os.Stderr, "reverse forward failed. %s\n", err)
+		return
+	}
+	defer l.Close()
+	fmt.Fprintf(control, "ok %s\n", l.Addr())
+	fmt.Fprintf(os.Stderr, "reverse forwarding %s\n", l.Addr())
+
+	go func() {
+		io.Copy(io.Discard, control)
+		l.Close()
+	}()
+	for {
+		conn, err := l.Accept()
+		if err != nil {
+			return
+		}
+		go func() {
+			lconn, err := lk.DialTarget(reverseTargetPrefix + addr)
+			if err != nil {
+				conn.Close()
+				fmt.Fprintf(os.Stderr, "dialing on link failed. %s\n", err)
+				return
+			}
+			proxy(conn, lconn)
+		}()
+	}
+}
+
+// reverseRules returns the -R rules.
+func (o *options) reverseRules() ([]forward, error) {
+	var rules []forward
+	for _, spec := range o.Reverse {
+		rule, err := parseForward(spec)
+		if err != nil {
+			return nil, err
+		}
+		rules = append(rules, rule)
+	}
+	return rules, nil
+}
@@ -0,0 +1,121 @@
+package main
+
+import (
+	"errors"
+	"io"
+	"mako/serial/link"
+	"net"
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+	"time"
+)
+
+func TestReverseForward(t *testing.T) {
+	l1, l2 := link.Pipe(link.PipeConfig{})
+	defer l1.Close()
+	defer l2.Close()
+
+	// l1 is the link2tcp side, l2 tcp2link.
+	go serveLink(l1, "")
+	rule := forward{listen: "127.0.0.1:0", target: namedServer(t, "ntp")}
+	go serveReverse(l2, []forward{rule})
+
+	control, addr, err := requestReverse(l2, rule)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	for i := 0; i < 3; i++ {
+		conn, err := net.Dial("tcp", addr)
+		if err != nil {
+			t.Fatal(err)
+		}
+		got, err := io.ReadAll(conn)
+		conn.Close()
+		if err != nil || string(got) != "ntp" {
+			t.Fatal("reverse forward failed", string(got), err)
+		}
+	}
+
+	// Closing the control session ends the forward.
+	control.Close()
+	deadline := time.Now().Add(5 * time.Second)
+	for {
+		conn, err := net.Dial("tcp", addr)
+		if err != nil {
+			break
+		}
+		conn.Close()
+		if time.Now().After(deadline) {
+			t.Fatal("far end still listening")
+		}
+		time.Sleep(10 * time.Millisecond)
+	}
+}
+
+func TestReverseRequestTimeout(t *testing.T) {
+	reverseRequestTimeout = 50 * time.Millisecond
+	t.Cleanup(func() { reverseRequestTimeout = 30 * time.Second })
+	l1, l2 := link.Pipe(link.PipeConfig{})
+	defer l1.Close()
+	defer l2.Close()
+
+	// A far end that never answers.
+	go func() {
+		con, err := l1.Accept()
+		if err == nil {
+			defer con.Close()
+			<-l1.Done()
+		}
+	}()
+	start := time.Now()
+	_, _, err := requestReverse(l2, forward{listen: "127.0.0.1:0"})
+	if !errors.Is(err, os.ErrDeadlineExceeded) {
+		t.Fatal("expected the request to time out", err)
+	}
+	if d := time.Since(start); d > 5*time.Second {
+		t.Fatal("took too long", d)
+	}
+}
+
+func TestReverseForwardErrors(t *testing.T) {
+	l1, l2 := link.Pipe(link.PipeConfig{})
+	defer l1.Close()
+	defer l2.Close()
+
+	go serveLink(l1, "")
+	go serveReverse(l2, nil)
+
+	// The far end cannot listen on this.
+	_, _, err := requestReverse(l2, forward{listen: "256.0.0.1:1"})
+	if err == nil {
+		t.Fatal("expected an error")
+	}
+	// Nor is it allowed to listen on these.
+	for _, addr := range []string{"0.0.0.0:0", ":0", filepath.Join(t.TempDir(), "r.sock")} {
+		_, _, err = requestReverse(l2, forward{listen: addr})
+		if err == nil || !strings.Contains(err.Error(), "not allowed") {
+			t.Fatal("expected listening to be refused", addr, err)
+		}
+	}
+	reverseSockets = true
+	defer func() { reverseSockets = false }()
+	control, _, err := requestReverse(l2, forward{listen: filepath.Join(t.TempDir(), "r.sock")})
+	if err != nil {
+		t.Fatal("--reverse-sockets should allow Unix sockets", err)
+	}
+	control.Close()
+
+	// Sessions from the far end that match no rule are refused.
+	con, err := l1.DialTarget(reverseTargetPrefix + "127.0.0.1:22")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer con.Close()
+	_, err = con.Read(make([]byte, 1))
+	if err != io.EOF {
+		t.Fatal("session should have been closed", err)
+	}
+}
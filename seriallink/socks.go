@@ -0,0 +1,258 @@
+package main
+
+// A SOCKS5 server (RFC 1928) whose connections go over the link. Only
+// CONNECT without authentication is supported. The session is dialed
+// with socksConnectPrefix followed by the destination. link2tcp dials it
+// and answers with a status line, "ok" or "error <reason>: <message>",
+// so the client hears whether the destination could be reached before
+// any data flows.
+
+import (
+	"encoding/binary"
+	"errors"
+	"fmt"
+	"io"
+	"mako/serial/link"
+	"net"
+	"os"
+	"strconv"
+	"strings"
+	"syscall"
+	"time"
+)
+
+// Session target prefix for SOCKS connections.
+const socksConnectPrefix = "connect:"
+
+// How long a client may take to send its request.
+var socksHandshakeTimeout = 30 * time.Second
+
+const (
+	socksVersion = 5
+
+	socksNoAuth       = 0
+	socksNoAcceptable = 0xff
+
+	socksConnect = 1
+
+	socksIPv4   = 1
+	socksDomain = 3
+	socksIPv6   = 4
+
+	socksSucceeded          = 0
+	socksGeneralFailure     = 1
+	socksNotAllowed         = 2
+	socksNetUnreachable     = 3
+	socksHostUnreachable    = 4
+	socksConnRefused        = 5
+	socksCommandUnsupported = 7
+	socksAddressUnsupported = 8
+)
+
+// Reasons link2tcp gives for failing to connect, and the replies they
+// become.
+var socksFailures = map[string]byte{
+	"not-permitted":       socksNotAllowed,
+	"network-unreachable": socksNetUnreachable,
+	"host-unreachable":    socksHostUnreachable,
+	"refused":             socksConnRefused,
+}
+
+// serveSocks handles SOCKS clients connecting to l until it fails.
+func serveSocks(lk *link.Link, l net.Listener) error {
+	for {
+		conn, err := l.Accept()
+		if err != nil {
+			return err
+		}
+		go func() {
+			conn.SetReadDeadline(time.Now().Add(socksHandshakeTimeout))
+			target, err := socksHandshake(conn)
+			if err != nil {
+				fmt.Printf("socks request from %s failed. %s\n", conn.RemoteAddr(), err)
+				conn.Close()
+				return
+			}
+			conn.SetReadDeadline(time.Time{})
+			fmt.Printf("socks connection from %s to %s.\n", conn.RemoteAddr(), target)
+			lconn, err := lk.DialTarget(socksConnectPrefix + target)
+			if err != nil {
+				socksReply(conn, socksGeneralFailure)
+				conn.Close()
+				fmt.Printf("dialing on link failed. %s\n", err)
+				return
+			}
+			status, err := readStatusLine(lconn)
+			if err != nil {
+				status = err.Error()
+			}
+			if status != "ok" {
+				reply := byte(socksGeneralFailure)
+				if reason, _, ok := strings.Cut(strings.TrimPrefix(status, "error "), ":"); ok {
+					if r, ok := socksFailures[reason]; ok {
+						reply = r
+					}
+				}
+				socksReply(conn, reply)
+				conn.Close()
+				lconn.Close()
+				fmt.Printf("socks connection to %s failed. %s\n", target, status)
+				return
+			}
+			err = socksReply(conn, socksSucceeded)
+			if err != nil {
+				conn.Close()
+				lconn.Close()
+				return
+			}
+			proxy(conn, lconn)
+		}()
+	}
+}
+
+// readStatusLine reads the status line link2tcp answers a SOCKS session
+// with. It reads a byte at a time so nothing after it is consumed.
+func readStatusLine(conn net.Conn) (string, error) {
+	var line []byte
+	var b [1]byte
+	for len(line) < 1024 {
+		_, err := io.ReadFull(conn, b[:])
+		if err != nil {
+			return "", err
+		}
+		if b[0] == '\n' {
+			return string(line), nil
+		}
+		line = append(line, b[0])
+	}
+	return "", errors.New("status line too long")
+}
+
+// serveSocksConnect is the link2tcp side of a SOCKS session: it dials
+// target, reports how that went and then carries the connection.
+func serveSocksConnect(lconn net.Conn, target string) {
+	if !targetPermitted(target) {
+		fmt.Fprintf(os.Stderr, "refused session to %s, it is not --permit'ted.\n", target)
+		fmt.Fprintf(lconn, "error not-permitted: %s is not permitted\n", target)
+		lconn.Close()
+		return
+	}
+	conn, err := dialEndpoint(target)
+	if err != nil {
+		fmt.Fprintf(os.Stderr, "failed to dial %s. %s\n", target, err)
+		fmt.Fprintf(lconn, "error %s: %s\n", dialFailure(err), err)
+		lconn.Close()
+		return
+	}
+	_, err = fmt.Fprintf(lconn, "ok\n")
+	if err != nil {
+		conn.Close()
+		lconn.Close()
+		return
+	}
+	proxy(conn, lconn)
+}
+
+// dialFailure classifies a dial error for the status line.
+func dialFailure(err error) string {
+	var dnsErr *net.DNSError
+	switch {
+	case errors.Is(err, syscall.ECONNREFUSED):
+		return "refused"
+	case errors.Is(err, syscall.ENETUNREACH):
+		return "network-unreachable"
+	case errors.Is(err, syscall.EHOSTUNREACH), errors.As(err, &dnsErr), errors.Is(err, os.ErrDeadlineExceeded):
+		return "host-unreachable"
+	}
+	return "failed"
+}
+
+// socksHandshake negotiates the method and reads the CONNECT request,
+// returning its destination as host:port. Failures the client should
+// hear about have been replied to.
+func socksHandshake(conn net.Conn) (string, error) {
+	var head [2]byte
+	_, err := io.ReadFull(conn, head[:])
+	if err != nil {
+		return "", err
+	}
+	if head[0] != socksVersion {
+		return "", fmt.Errorf("unsupported socks version %d", head[0])
+	}
+	methods := make([]byte, head[1])
+	_, err = io.ReadFull(conn, methods)
+	if err != nil {
+		return "", err
+	}
+	method := byte(socksNoAcceptable)
+	for _, m := range methods {
+		if m == socksNoAuth {
+			method = socksNoAuth
+		}
+	}
+	_, err = conn.Write([]byte{socksVersion, method})
+	if err != nil {
+		return "", err
+	}
+	if method == socksNoAcceptable {
+		return "", errors.New("client requires authentication")
+	}
+
+	var req [4]byte
+	_, err = io.ReadFull(conn, req[:])
+	if err != nil {
+		return "", err
+	}
+	if req[0] != socksVersion {
+		return "", fmt.Errorf("unsupported socks version %d", req[0])
+	}
+
+	var host string
+	switch req[3] {
+	case socksIPv4, socksIPv6:
+		ip := make(net.IP, net.IPv4len)
+		if req[3] == socksIPv6 {
+			ip = make(net.IP, net.IPv6len)
+		}
+		_, err = io.ReadFull(conn, ip)
+		host = ip.String()
+	case socksDomain:
+		var n [1]byte
+		_, err = io.ReadFull(conn, n[:])
+		if err != nil {
+			return "", err
+		}
+		name := make([]byte, n[0])
+		_, err = io.ReadFull(conn, name)
+		host = string(name)
+		if err == nil && isUnixPath(host) {
+			// The far end would take it for a Unix socket.
+			socksReply(conn, socksAddressUnsupported)
+			return "", fmt.Errorf("bad host name %q", host)
+		}
+	default:
+		socksReply(conn, socksAddressUnsupported)
+		return "", fmt.Errorf("unsupported address type %d", req[3])
+	}
+	if err != nil {
+		return "", err
+	}
+	var port [2]byte
+	_, err = io.ReadFull(conn, port[:])
+	if err != nil {
+		return "", err
+	}
+
+	if req[1] != socksConnect {
+		socksReply(conn, socksCommandUnsupported)
+		return "", fmt.Errorf("unsupported command %d", req[1])
+	}
+	return net.JoinHostPort(host, strconv.Itoa(int(binary.BigEndian.Uint16(port[:])))), nil
+}
+
+// socksReply sends a reply with an unspecified bound address, there is
+// no meaningful one on this side of the link.
+func socksReply(conn net.Conn, status byte) error {
+	_, err := conn.Write([]byte{socksVersion, status, 0, socksIPv4, 0, 0, 0, 0, 0, 0})
+	return err
+}
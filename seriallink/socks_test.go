@@ -0,0 +1,148 @@
+package main
+
+import (
+	"bytes"
+	"encoding/binary"
+	"io"
+	"mako/serial/link"
+	"net"
+	"strconv"
+	"testing"
+	"time"
+)
+
+func socksProxy(t *testing.T) string {
+	l1, l2 := link.Pipe(link.PipeConfig{})
+	t.Cleanup(func() {
+		l1.Close()
+		l2.Close()
+	})
+	permitTargets(t, "*")
+	go serveLink(l1, "")
+
+	l, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	t.Cleanup(func() { l.Close() })
+	go serveSocks(l2, l)
+	return l.Addr().String()
+}
+
+// socksRequest connects to the proxy and sends a request, returning the
+// connection and the reply status.
+func socksRequest(t *testing.T, proxy string, cmd byte, addr []byte, port int) (net.Conn, byte) {
+	conn, err := net.Dial("tcp", proxy)
+	if err != nil {
+		t.Fatal(err)
+	}
+	t.Cleanup(func() { conn.Close() })
+	conn.Write([]byte{5, 1, 0})
+	reply := make([]byte, 2)
+	_, err = io.ReadFull(conn, reply)
+	if err != nil || !bytes.Equal(reply, []byte{5, 0}) {
+		t.Fatal("bad method reply", reply, err)
+	}
+
+	req := append([]byte{5, cmd, 0}, addr...)
+	req = binary.BigEndian.AppendUint16(req, uint16(port))
+	conn.Write(req)
+	reply = make([]byte, 10)
+	_, err = io.ReadFull(conn, reply)
+	if err != nil {
+		t.Fatal(err)
+	}
+	return conn, reply[1]
+}
+
+func splitPort(t *testing.T, addr string) (string, int) {
+	host, port, err := net.SplitHostPort(addr)
+	if err != nil {
+		t.Fatal(err)
+	}
+	p, _ := strconv.Atoi(port)
+	return host, p
+}
+
+func TestSocksConnect(t *testing.T) {
+	proxy := socksProxy(t)
+	_, port := splitPort(t, namedServer(t, "web"))
+
+	for _, addr := range [][]byte{
+		{socksIPv4, 127, 0, 0, 1},
+		append([]byte{socksDomain, 9}, "localhost"...),
+	} {
+		conn, status := socksRequest(t, proxy, socksConnect, addr, port)
+		if status != socksSucceeded {
+			t.Fatal("request failed", status)
+		}
+		got, err := io.ReadAll(conn)
+		if err != nil || string(got) != "web" {
+			t.Fatal("bad data through the proxy", string(got), err)
+		}
+	}
+}
+
+func TestSocksConnectFailures(t *testing.T) {
+	proxy := socksProxy(t)
+
+	// Nothing listens here any more.
+	l, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	_, port := splitPort(t, l.Addr().String())
+	l.Close()
+	_, status := socksRequest(t, proxy, socksConnect, []byte{socksIPv4, 127, 0, 0, 1}, port)
+	if status != socksConnRefused {
+		t.Fatal("expected connection refused", status)
+	}
+
+	_, port = splitPort(t, namedServer(t, "web"))
+	permitTargets(t, "127.0.0.1:1")
+	_, status = socksRequest(t, proxy, socksConnect, []byte{socksIPv4, 127, 0, 0, 1}, port)
+	if status != socksNotAllowed {
+		t.Fatal("expected the destination to be refused", status)
+	}
+}
+
+func TestSocksHandshakeTimeout(t *testing.T) {
+	socksHandshakeTimeout = 50 * time.Millisecond
+	t.Cleanup(func() { socksHandshakeTimeout = 30 * time.Second })
+	proxy := socksProxy(t)
+	conn, err := net.Dial("tcp", proxy)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer conn.Close()
+	// Only part of a greeting.
+	conn.Write([]byte{5})
+	conn.SetReadDeadline(time.Now().Add(5 * time.Second))
+	_, err = conn.Read(make([]byte, 1))
+	if err != io.EOF {
+		t.Fatal("expected the proxy to give up on the client", err)
+	}
+}
+
+func TestSocksUnsupported(t *testing.T) {
+	proxy := socksProxy(t)
+
+	// BIND
+	_, status := socksRequest(t, proxy, 2, []byte{socksIPv4, 127, 0, 0, 1}, 80)
+	if status != socksCommandUnsupported {
+		t.Fatal("BIND should be refused", status)
+	}
+
+	// Only username/password authentication offered.
+	conn, err := net.Dial("tcp", proxy)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer conn.Close()
+	conn.Write([]byte{5, 1, 2})
+	reply := make([]byte, 2)
+	_, err = io.ReadFull(conn, reply)
+	if err != nil || reply[1] != socksNoAcceptable {
+		t.Fatal("expected no acceptable methods", reply, err)
+	}
+}
@@ -0,0 +1,184 @@
+package main
+
+// UDP forwards map every sender seen on a -U port to its own datagram
+// association on the link. link2tcp gives each association a connected
+// UDP socket towards the association's target, so replies find their way
+// back to the association and from there to the original sender. Both
+// ends forget a flow once its association goes idle. A flow link2tcp
+// can't serve is kept until idle too, swallowing its datagrams, as every
+// datagram would otherwise set the association up and get refused again.
+
+import (
+	"errors"
+	"fmt"
+	"mako/serial/link"
+	"net"
+	"os"
+	"sync"
+	"time"
+)
+
+// Largest datagram read from a UDP socket, the link refuses anything over
+// its MaxDatagramSize anyway.
+const udpReadSize = 64 * 1024
+
+// udpForwardRules returns the -U rules.
+func (o *options) udpForwardRules() ([]forward, error) {
+	var rules []forward
+	for _, spec := range o.UDPForwards {
+		rule, err := parseForwardNet("udp", spec)
+		if err != nil {
+			return nil, err
+		}
+		rules = append(rules, rule)
+	}
+	return rules, nil
+}
+
+// serveUDPForward carries the datagrams received on pc over the link to
+// target, until pc is closed.
+func serveUDPForward(lk *link.Link, pc net.PacketConn, target string) error {
+	var lock sync.Mutex
+	flows := map[string]*link.Association{}
+	buf := make([]byte, udpReadSize)
+	for {
+		n, addr, err := pc.ReadFrom(buf)
+		if err != nil {
+			return err
+		}
+		key := addr.String()
+		lock.Lock()
+		a := flows[key]
+		if a == nil || a.Err() != nil {
+			a, err = lk.DialDatagram(target)
+			if err != nil {
+				lock.Unlock()
+				return err
+			}
+			flows[key] = a
+			go func() {
+				udpReplies(a, pc, addr)
+				lock.Lock()
+				if flows[key] == a {
+					delete(flows, key)
+				}
+				lock.Unlock()
+			}()
+		}
+		lock.Unlock()
+		err = a.Send(buf[:n])
+		if err != nil {
+			fmt.Printf("dropped udp datagram from %s. %s\n", addr, err)
+		}
+	}
+}
+
+// udpReplies sends what comes back on a to addr until a closes.
+func udpReplies(a *link.Association, pc net.PacketConn, addr net.Addr) {
+	for {
+		p, err := a.Receive()
+		if err != nil {
+			return
+		}
+		pc.WriteTo(p, addr)
+	}
+}
+
+// serveDatagrams sends the datagrams of each association the far end
+// starts on to its target.
+func serveDatagrams(lk *link.Link) error {
+	for {
+		a, err := lk.AcceptDatagram()
+		if err != nil {
+			return err
+		}
+		go handleDatagrams(a)
+	}
+}
+
+// How often a refused or failing udp target is reported at most.
+var udpRefusalLogInterval = time.Minute
+
+var udpRefusals = rateLimiter{seen: map[string]time.Time{}}
+
+// rateLimiter tells whether something keyed by a string is due to be
+// reported again.
+type rateLimiter struct {
+	lock sync.Mutex
+	seen map[string]time.Time
+}
+
+// allow reports whether key was last allowed over interval ago, and if
+// so counts it as allowed now.
+func (r *rateLimiter) allow(key string, interval time.Duration) bool {
+	r.lock.Lock()
+	defer r.lock.Unlock()
+	now := time.Now()
+	for k, t := range r.seen {
+		if now.Sub(t) >= interval {
+			delete(r.seen, k)
+		}
+	}
+	if _, ok := r.seen[key]; ok {
+		return false
+	}
+	r.seen[key] = now
+	return true
+}
+
+func handleDatagrams(a *link.Association) {
+	defer a.Close()
+	if !targetPermitted(a.Target()) {
+		if udpRefusals.allow(a.Target(), udpRefusalLogInterval) {
+			fmt.Fprintf(os.Stderr, "refused datagrams to udp %s, it is not --permit'ted.\n", a.Target())
+		}
+		discardDatagrams(a)
+		return
+	}
+	conn, err := net.Dial("udp", a.Target())
+	if err != nil {
+		if udpRefusals.allow(a.Target(), udpRefusalLogInterval) {
+			fmt.Fprintf(os.Stderr, "failed to dial udp %s. %s\n", a.Target(), err)
+		}
+		discardDatagrams(a)
+		return
+	}
+	// Closing conn once the association is over ends the reply loop.
+	defer conn.Close()
+	go func() {
+		buf := make([]byte, udpReadSize)
+		for {
+			n, err := conn.Read(buf)
+			if errors.Is(err, net.ErrClosed) {
+				return
+			} else if err != nil {
+				// Connected UDP sockets report ICMP errors for earlier
+				// datagrams, such as nobody listening, they don't end
+				// the flow.
+				continue
+			}
+			err = a.Send(buf[:n])
+			if err != nil && a.Err() != nil {
+				return
+			}
+		}
+	}()
+	for {
+		p, err := a.Receive()
+		if err != nil {
+			return
+		}
+		conn.Write(p)
+	}
+}
+
+// discardDatagrams drops what arrives on a until it goes idle, so the
+// association stays known and further datagrams aren't refused anew.
+func discardDatagrams(a *link.Association) {
+	for {
+		_, err := a.Receive()
+		if err != nil {
+			return
+		}
+	}
+}
@@ -0,0 +1,134 @@
+package main
+
+import (
+	"flag"
+	"mako/serial/link"
+	"net"
+	"testing"
+	"time"
+)
+
+// udpEcho answers every datagram with name followed by the datagram.
+func udpEcho(t *testing.T, name string) string {
+	pc, err := net.ListenPacket("udp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	t.Cleanup(func() { pc.Close() })
+	go func() {
+		buf := make([]byte, 1500)
+		for {
+			n, addr, err := pc.ReadFrom(buf)
+			if err != nil {
+				return
+			}
+			pc.WriteTo(append([]byte(name), buf[:n]...), addr)
+		}
+	}()
+	return pc.LocalAddr().String()
+}
+
+func TestUDPForward(t *testing.T) {
+	l1, l2 := link.Pipe(link.PipeConfig{})
+	defer l1.Close()
+	defer l2.Close()
+	permitTargets(t, "*")
+	go serveDatagrams(l1)
+
+	pc, err := net.ListenPacket("udp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer pc.Close()
+	go serveUDPForward(l2, pc, udpEcho(t, "echo:"))
+
+	// Two senders, each must only get its own replies.
+	for _, msg := range []string{"a", "b", "c"} {
+		for _, sender := range []string{"1", "2"} {
+			conn, err := net.Dial("udp", pc.LocalAddr().String())
+			if err != nil {
+				t.Fatal(err)
+			}
+			defer conn.Close()
+			conn.Write([]byte(sender + msg))
+			conn.SetReadDeadline(time.Now().Add(5 * time.Second))
+			buf := make([]byte, 100)
+			n, err := conn.Read(buf)
+			if err != nil {
+				t.Fatal(err)
+			}
+			if string(buf[:n]) != "echo:"+sender+msg {
+				t.Fatal("bad reply", string(buf[:n]))
+			}
+		}
+	}
+}
+
+func TestOptionsUDPForwards(t *testing.T) {
+	o, err := parseOptions("tcp2link", []string{"-U", "5514:127.0.0.1:domain", "--udp-idle-timeout", "5s"}, flag.ContinueOnError)
+	if err != nil {
+		t.Fatal(err)
+	}
+	rules, err := o.udpForwardRules()
+	if err != nil || len(rules) != 1 || rules[0].listen != "127.0.0.1:5514" || rules[0].target != "127.0.0.1:domain" {
+		t.Fatal("bad rules", rules, err)
+	}
+	conf, cleanup, err := o.linkConfig()
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer cleanup()
+	if conf.DatagramIdleTimeout != 5*time.Second {
+		t.Fatal("bad idle timeout", conf.DatagramIdleTimeout)
+	}
+}
+
+func TestUDPRefusedAssociationKept(t *testing.T) {
+	l1, l2 := link.Pipe(link.PipeConfig{})
+	defer l1.Close()
+	defer l2.Close()
+	permitTargets(t, "127.0.0.1:1")
+
+	accepted := make(chan *link.Association, 10)
+	go func() {
+		for {
+			a, err := l1.AcceptDatagram()
+			if err != nil {
+				return
+			}
+			accepted <- a
+			go handleDatagrams(a)
+		}
+	}()
+
+	a, err := l2.DialDatagram("127.0.0.1:9")
+	if err != nil {
+		t.Fatal(err)
+	}
+	for i := 0; i < 5; i++ {
+		if err := a.Send([]byte("x")); err != nil {
+			t.Fatal(err)
+		}
+		time.Sleep(20 * time.Millisecond)
+	}
+	<-accepted
+	select {
+	case <-accepted:
+		t.Fatal("refused association was set up again")
+	case <-time.After(100 * time.Millisecond):
+	}
+}
+
+func TestRateLimiter(t *testing.T) {
+	r := rateLimiter{seen: map[string]time.Time{}}
+	if !r.allow("a", 50*time.Millisecond) || !r.allow("b", 50*time.Millisecond) {
+		t.Fatal("first report held back")
+	}
+	if r.allow("a", 50*time.Millisecond) {
+		t.Fatal("repeated report allowed")
+	}
+	time.Sleep(60 * time.Millisecond)
+	if !r.allow("a", 50*time.Millisecond) {
+		t.Fatal("report held back after the interval")
+	}
+}
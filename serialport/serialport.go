@@ -0,0 +1,102 @@
+package serialport
+
+// This package opens serial devices and configures them for carrying a
+// link: raw mode, no echo or line editing, with the given line settings.
+
+import (
+	"fmt"
+	"strings"
+)
+
+type Parity int
+
+const (
+	NoParity Parity = iota
+	OddParity
+	EvenParity
+)
+
+type FlowControl int
+
+const (
+	NoFlowControl FlowControl = iota
+	// Hardware flow control on the RTS and CTS lines.
+	RTSCTS
+	// Software flow control. Link frames are base64 text delimited by
+	// '~', so they never contain the XON and XOFF bytes.
+	XONXOFF
+)
+
+// Config describes how to open a serial device. Zero fields get the
+// defaults, 115200 baud 8N1 without flow control.
+type Config struct {
+	Device   string
+	Baud     int
+	DataBits int
+	Parity   Parity
+	StopBits int
+	Flow     FlowControl
+}
+
+func (conf Config) withDefaults() Config {
+	if conf.Baud == 0 {
+		conf.Baud = 115200
+	}
+	if conf.DataBits == 0 {
+		conf.DataBits = 8
+	}
+	if conf.StopBits == 0 {
+		conf.StopBits = 1
+	}
+	return conf
+}
+
+func (p Parity) String() string {
+	switch p {
+	case NoParity:
+		return "none"
+	case OddParity:
+		return "odd"
+	case EvenParity:
+		return "even"
+	}
+	return fmt.Sprintf("Parity(%d)", int(p))
+}
+
+// ParseParity accepts none, odd or even.
+func ParseParity(s string) (Parity, error) {
+	switch strings.ToLower(s) {
+	case "none", "n":
+		return NoParity, nil
+	case "odd", "o":
+		return OddParity, nil
+	case "even", "e":
+		return EvenParity, nil
+	}
+	return NoParity, fmt.Errorf("unknown parity %q", s)
+}
+
+func (f FlowControl) String() string {
+	switch f {
+	case NoFlowControl:
+		return "none"
+	case RTSCTS:
+		return "rtscts"
+	case XONXOFF:
+		return "xonxoff"
+	}
+	return fmt.Sprintf("FlowControl(%d)", int(f))
+}
+
+// ParseFlowControl accepts none, rtscts or xonxoff.
+func ParseFlowControl(s string) (FlowControl, error) {
+	switch strings.ToLower(s) {
+	case "none":
+		return NoFlowControl, nil
+	case "rtscts":
+		return RTSCTS, nil
+	case "xonxoff":
+		return XONXOFF, nil
+	}
+	return NoFlowControl, fmt.Errorf("unknown flow control %q", s)
+}
@@ -0,0 +1,167 @@
+package serialport
+
+import (
+	"fmt"
+	"os"
+	"syscall"
+	"unsafe"
+)
+
+// Missing from the syscall package. cbaud and tcflsh differ between
+// architectures, see the termios_linux_*.go files.
+const (
+	crtscts  = 0x80000000
+	tciflush = 0
+)
+
+var baudRates = map[int]uint32{
+	50:      syscall.B50,
+	75:      syscall.B75,
+	110:     syscall.B110,
+	134:     syscall.B134,
+	150:     syscall.B150,
+	200:     syscall.B200,
+	300:     syscall.B300,
+	600:     syscall.B600,
+	1200:    syscall.B1200,
+	1800:    syscall.B1800,
+	2400:    syscall.B2400,
+	4800:    syscall.B4800,
+	9600:    syscall.B9600,
+	19200:   syscall.B19200,
+	38400:   syscall.B38400,
+	57600:   syscall.B57600,
+	115200:  syscall.B115200,
+	230400:  syscall.B230400,
+	460800:  syscall.B460800,
+	500000:  syscall.B500000,
+	576000:  syscall.B576000,
+	921600:  syscall.B921600,
+	1000000: syscall.B1000000,
+	1152000: syscall.B1152000,
+	1500000: syscall.B1500000,
+	2000000: syscall.B2000000,
+	2500000: syscall.B2500000,
+	3000000: syscall.B3000000,
+	3500000: syscall.B3500000,
+	4000000: syscall.B4000000,
+}
+
+var dataBits = map[int]uint32{
+	5: syscall.CS5,
+	6: syscall.CS6,
+	7: syscall.CS7,
+	8: syscall.CS8,
+}
+
+// Open opens the device and puts it in raw mode with the configured line
+// settings. Anything already waiting in the input queue is discarded.
+func Open(conf Config) (*os.File, error) {
+	conf = conf.withDefaults()
+	// Without O_NONBLOCK the open can hang waiting for carrier detect.
+	// The file then stays non blocking so the runtime poller handles it.
+	f, err := os.OpenFile(conf.Device, os.O_RDWR|syscall.O_NOCTTY|syscall.O_NONBLOCK, 0)
+	if err != nil {
+		return nil, err
+	}
+	err = configure(f, conf)
+	if err != nil {
+		f.Close()
+		return nil, fmt.Errorf("configuring %s: %w", conf.Device, err)
+	}
+	return f, nil
+}
+
+// makeTermios applies conf to t.
+func makeTermios(t *syscall.Termios, conf Config) error {
+	speed, ok := baudRates[conf.Baud]
+	if !ok {
+		return fmt.Errorf("unsupported baud rate %d", conf.Baud)
+	}
+	size, ok := dataBits[conf.DataBits]
+	if !ok {
+		return fmt.Errorf("unsupported data bits %d", conf.DataBits)
+	}
+
+	// The same as cfmakeraw.
+	t.Iflag &^= syscall.IGNBRK | syscall.BRKINT | syscall.PARMRK | syscall.ISTRIP |
+		syscall.INLCR | syscall.IGNCR | syscall.ICRNL | syscall.IXON | syscall.IXOFF |
+		syscall.IXANY | syscall.INPCK
+	t.Oflag &^= syscall.OPOST
+	t.Lflag &^= syscall.ECHO | syscall.ECHONL | syscall.ICANON | syscall.ISIG | syscall.IEXTEN
+	t.Cflag &^= syscall.CSIZE | syscall.PARENB | syscall.PARODD | syscall.CSTOPB | crtscts | cbaud
+	t.Cflag |= size | syscall.CREAD | syscall.CLOCAL
+
+	switch conf.Parity {
+	case NoParity:
+	case OddParity:
+		t.Cflag |= syscall.PARENB | syscall.PARODD
+		t.Iflag |= syscall.INPCK
+	case EvenParity:
+		t.Cflag |= syscall.PARENB
+		t.Iflag |= syscall.INPCK
+	default:
+		return fmt.Errorf("unsupported parity %s", conf.Parity)
+	}
+
+	switch conf.StopBits {
+	case 1:
+	case 2:
+		t.Cflag |= syscall.CSTOPB
+	default:
+		return fmt.Errorf("unsupported stop bits %d", conf.StopBits)
+	}
+
+	switch conf.Flow {
+	case NoFlowControl:
+	case RTSCTS:
+		t.Cflag |= crtscts
+	case XONXOFF:
+		t.Iflag |= syscall.IXON | syscall.IXOFF
+	default:
+		return fmt.Errorf("unsupported flow control %s", conf.Flow)
+	}
+
+	setSpeed(t, speed)
+
+	// Reads return as soon as there is a byte.
+	t.Cc[syscall.VMIN] = 1
+	t.Cc[syscall.VTIME] = 0
+	return nil
+}
+
+func configure(f *os.File, conf Config) error {
+	rc, err := f.SyscallConn()
+	if err != nil {
+		return err
+	}
+	var ioctlErr error
+	err = rc.Control(func(fd uintptr) {
+		var t syscall.Termios
+		ioctlErr = ioctl(fd, syscall.TCGETS, uintptr(unsafe.Pointer(&t)))
+		if ioctlErr != nil {
+			return
+		}
+		ioctlErr = makeTermios(&t, conf)
+		if ioctlErr != nil {
+			return
+		}
+		ioctlErr = ioctl(fd, syscall.TCSETS, uintptr(unsafe.Pointer(&t)))
+		if ioctlErr != nil {
+			return
+		}
+		ioctlErr = ioctl(fd, tcflsh, tciflush)
+	})
+	if err != nil {
+		return err
+	}
+	return ioctlErr
+}
+
+func ioctl(fd, req, arg uintptr) error {
+	_, _, errno := syscall.Syscall(syscall.SYS_IOCTL, fd, req, arg)
+	if errno != 0 {
+		return errno
+	}
+	return nil
+}
@@ -0,0 +1,229 @@
+package serialport
+
+import (
+	"bytes"
+	"fmt"
+	"io"
+	"mako/serial/link"
+	"net"
+	"os"
+	"syscall"
+	"testing"
+	"unsafe"
+)
+
+// openPty returns the master side of a new pseudo-terminal and the path
+// of its slave.
+func openPty(t *testing.T) (*os.File, string) {
+	master, err := os.OpenFile("/dev/ptmx", os.O_RDWR|syscall.O_NOCTTY, 0)
+	if err != nil {
+		t.Skip("no pseudo-terminals:", err)
+	}
+	t.Cleanup(func() { master.Close() })
+
+	var n uint32
+	var unlock int32
+	rc, err := master.SyscallConn()
+	if err != nil {
+		t.Fatal(err)
+	}
+	rc.Control(func(fd uintptr) {
+		err = ioctl(fd, syscall.TIOCGPTN, uintptr(unsafe.Pointer(&n)))
+		if err == nil {
+			err = ioctl(fd, syscall.TIOCSPTLCK, uintptr(unsafe.Pointer(&unlock)))
+		}
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+	return master, fmt.Sprintf("/dev/pts/%d", n)
+}
+
+func getTermios(t *testing.T, f *os.File) syscall.Termios {
+	var tio syscall.Termios
+	rc, err := f.SyscallConn()
+	if err != nil {
+		t.Fatal(err)
+	}
+	rc.Control(func(fd uintptr) {
+		err = ioctl(fd, syscall.TCGETS, uintptr(unsafe.Pointer(&tio)))
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+	return tio
+}
+
+func TestOpenConfigures(t *testing.T) {
+	_, slave := openPty(t)
+
+	port, err := Open(Config{
+		Device:   slave,
+		Baud:     9600,
+		StopBits: 2,
+		Flow:     RTSCTS,
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer port.Close()
+
+	tio := getTermios(t, port)
+	if tio.Cflag&cbaud != syscall.B9600 {
+		t.Fatal("baud rate not set", tio.Cflag&cbaud)
+	}
+	if tio.Cflag&syscall.CSIZE != syscall.CS8 {
+		t.Fatal("expected 8 data bits")
+	}
+	if tio.Cflag&syscall.CSTOPB == 0 {
+		t.Fatal("expected 2 stop bits")
+	}
+	if tio.Cflag&crtscts == 0 {
+		t.Fatal("expected hardware flow control")
+	}
+	if tio.Lflag&(syscall.ICANON|syscall.ECHO|syscall.ISIG) != 0 {
+		t.Fatal("not in raw mode")
+	}
+}
+
+// Pseudo-terminals force 8 bits without parity, so check those settings
+// without a device.
+func TestMakeTermios(t *testing.T) {
+	var tio syscall.Termios
+	err := makeTermios(&tio, Config{Parity: OddParity, DataBits: 7}.withDefaults())
+	if err != nil {
+		t.Fatal(err)
+	}
+	if tio.Cflag&(syscall.PARENB|syscall.PARODD) != syscall.PARENB|syscall.PARODD {
+		t.Fatal("expected odd parity")
+	}
+	if tio.Cflag&syscall.CSIZE != syscall.CS7 {
+		t.Fatal("expected 7 data bits")
+	}
+
+	err = makeTermios(&tio, Config{Parity: EvenParity}.withDefaults())
+	if err != nil {
+		t.Fatal(err)
+	}
+	if tio.Cflag&(syscall.PARENB|syscall.PARODD) != syscall.PARENB {
+		t.Fatal("expected even parity")
+	}
+	if tio.Cflag&syscall.CSIZE != syscall.CS8 || tio.Cflag&cbaud != syscall.B115200 {
+		t.Fatal("expected the defaults")
+	}
+}
+
+func TestOpenRawData(t *testing.T) {
+	master, slave := openPty(t)
+
+	port, err := Open(Config{Device: slave})
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer port.Close()
+
+	// Every byte value must pass untouched in both directions, in
+	// particular no newline translation, echo or control characters.
+	data := make([]byte, 256)
+	for idx := range data {
+		data[idx] = byte(idx)
+	}
+
+	go master.Write(data)
+	got := make([]byte, len(data))
+	_, err = io.ReadFull(port, got)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if string(got) != string(data) {
+		t.Fatal("data changed on the way in", got)
+	}
+
+	go port.Write(data)
+	_, err = io.ReadFull(master, got)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if string(got) != string(data) {
+		t.Fatal("data changed on the way out", got)
+	}
+}
+
+func TestOpenCloseUnblocksRead(t *testing.T) {
+	_, slave := openPty(t)
+
+	port, err := Open(Config{Device: slave})
+	if err != nil {
+		t.Fatal(err)
+	}
+	done := make(chan error, 1)
+	go func() {
+		_, err := port.Read(make([]byte, 16))
+		done <- err
+	}()
+	port.Close()
+	if <-done == nil {
+		t.Fatal("read should fail once closed")
+	}
+}
+
+func TestOpenBadConfig(t *testing.T) {
+	_, slave := openPty(t)
+
+	for _, conf := range []Config{
+		{Device: slave, Baud: 12345},
+		{Device: slave, DataBits: 9},
+		{Device: slave, StopBits: 3},
+		{Device: "/nonexistent"},
+	} {
+		port, err := Open(conf)
+		if err == nil {
+			port.Close()
+			t.Fatal("expected an error for", conf)
+		}
+	}
+}
+
+func TestLinkOverPty(t *testing.T) {
+	master, slave := openPty(t)
+
+	port, err := Open(Config{Device: slave})
+	if err != nil {
+		t.Fatal(err)
+	}
+	l1 := link.CreateLink(port, port)
+	defer l1.Close()
+	l2 := link.CreateLink(master, master)
+	defer l2.Close()
+
+	accepted := make(chan net.Conn, 1)
+	go func() {
+		con, err := l1.Accept()
+		if err != nil {
+			t.Error(err)
+		}
+		accepted <- con
+	}()
+	s2, err := l2.Dial()
+	if err != nil {
+		t.Fatal(err)
+	}
+	s1 := <-accepted
+	if s1 == nil {
+		t.FailNow()
+	}
+
+	data := make([]byte, 10000)
+	for idx := range data {
+		data[idx] = byte(idx)
+	}
+	go s2.Write(data)
+	got := make([]byte, len(data))
+	_, err = io.ReadFull(s1, got)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if !bytes.Equal(got, data) {
+		t.Fatal("data corrupted in transit")
+	}
+}
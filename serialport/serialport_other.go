@@ -0,0 +1,13 @@
+//go:build !linux
+
+package serialport
+
+import (
+	"errors"
+	"os"
+)
+
+// Open is only implemented on linux.
+func Open(conf Config) (*os.File, error) {
+	return nil, errors.New("serial ports are only supported on linux")
+}
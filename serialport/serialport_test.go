@@ -0,0 +1,28 @@
+package serialport
+
+import (
+	"testing"
+)
+
+func TestParse(t *testing.T) {
+	for _, s := range []string{"none", "odd", "even"} {
+		p, err := ParseParity(s)
+		if err != nil || p.String() != s {
+			t.Fatal("bad parity", s, p, err)
+		}
+	}
+	for _, s := range []string{"none", "rtscts", "xonxoff"} {
+		f, err := ParseFlowControl(s)
+		if err != nil || f.String() != s {
+			t.Fatal("bad flow control", s, f, err)
+		}
+	}
+	_, err := ParseParity("mark")
+	if err == nil {
+		t.Fatal("expected an error")
+	}
+	_, err = ParseFlowControl("dtrdsr")
+	if err == nil {
+		t.Fatal("expected an error")
+	}
+}
@@ -0,0 +1,18 @@
+//go:build linux && !mips && !mipsle && !mips64 && !mips64le && !ppc64 && !ppc64le
+
+package serialport
+
+import "syscall"
+
+// The asm-generic values, also used by x86 and arm.
+const (
+	cbaud  = 0x100f
+	tcflsh = 0x540b
+)
+
+// setSpeed sets both the input and output speed of t.
+func setSpeed(t *syscall.Termios, speed uint32) {
+	t.Cflag |= speed
+	t.Ispeed = speed
+	t.Ospeed = speed
+}
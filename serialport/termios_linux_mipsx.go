@@ -0,0 +1,16 @@
+//go:build linux && (mips || mipsle || mips64 || mips64le)
+
+package serialport
+
+import "syscall"
+
+const (
+	cbaud  = 0x100f
+	tcflsh = 0x5407
+)
+
+// setSpeed sets both the input and output speed of t. The mips termios
+// has no separate speed fields, the speed is only kept in Cflag.
+func setSpeed(t *syscall.Termios, speed uint32) {
+	t.Cflag |= speed
+}
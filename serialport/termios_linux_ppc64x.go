@@ -0,0 +1,17 @@
+//go:build linux && (ppc64 || ppc64le)
+
+package serialport
+
+import "syscall"
+
+const (
+	cbaud  = 0xff
+	tcflsh = 0x2000741f
+)
+
+// setSpeed sets both the input and output speed of t.
+func setSpeed(t *syscall.Termios, speed uint32) {
+	t.Cflag |= speed
+	t.Ispeed = speed
+	t.Ospeed = speed
+}
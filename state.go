@@ -0,0 +1,131 @@
+package link
+
+import (
+	"fmt"
+)
+
+// SessionState is the lifecycle state of a LinkSession.
+//
+// A session starts CONNECTING while Dial or Accept run the handshake and
+// becomes ESTABLISHED once it completes. A local Close moves it through
+// CLOSING, where the peer is told, to CLOSED. A session the peer closed
+// also ends CLOSED. A session that died without a clean close, because
+// of a keepalive timeout or a failure of the link underneath it, ends
+// LOST.
+type SessionState int
+
+const (
+	CONNECTING SessionState = iota
+	ESTABLISHED
+	CLOSING
+	CLOSED
+	LOST
+)
+
+func (st SessionState) String() string {
+	switch st {
+	case CONNECTING:
+		return "CONNECTING"
+	case ESTABLISHED:
+		return "ESTABLISHED"
+	case CLOSING:
+		return "CLOSING"
+	case CLOSED:
+		return "CLOSED"
+	case LOST:
+		return "LOST"
+	default:
+		return fmt.Sprintf("SessionState(%d)", int(st))
+	}
+}
+
+// isFinal reports whether no more transitions can happen from st.
+func (st SessionState) isFinal() bool {
+	return st == CLOSED || st == LOST
+}
+
+// StateEvent describes a session state transition.
+type StateEvent struct {
+	Session *LinkSession
+	From    SessionState
+	To      SessionState
+	// Why the session ended, set on transitions to CLOSED or LOST. It is
+	// the same error LinkSession.Err reports afterwards.
+	Err error
+}
+
+// Notify causes the link to send every session state transition to ch.
+//
+// Like signal.Notify, the link does not block sending to ch, events are
+// dropped if ch is not ready. Use a buffered channel large enough for
+// the expected rate of transitions.
+func (link *Link) Notify(ch chan<- StateEvent) {
+	link.notifyLock.Lock()
+	defer link.notifyLock.Unlock()
+	link.notify = append(link.notify, ch)
+}
+
+// StopNotify stops sending events to ch.
+func (link *Link) StopNotify(ch chan<- StateEvent) {
+	link.notifyLock.Lock()
+	defer link.notifyLock.Unlock()
+	for idx, c := range link.notify {
+		if c == ch {
+			link.notify = append(link.notify[:idx], link.notify[idx+1:]...)
+			return
+		}
+	}
+}
+
+func (link *Link) sendEvent(ev StateEvent) {
+	link.notifyLock.Lock()
+	defer link.notifyLock.Unlock()
+	for _, ch := range link.notify {
+		select {
+		case ch <- ev:
+		default:
+		}
+	}
+}
+
+// State returns the current state of the session.
+func (s *LinkSession) State() SessionState {
+	s.stateLock.Lock()
+	defer s.stateLock.Unlock()
+	return s.state
+}
+
+// transition moves the session from one state to another and reports
+// whether it did. It fails if the session is no longer in state from.
+func (s *LinkSession) transition(from, to SessionState, err error) bool {
+	s.stateLock.Lock()
+	if s.state != from {
+		s.stateLock.Unlock()
+		return false
+	}
+	s.state = to
+	s.stateLock.Unlock()
+
+	s.log.Debug("session state changed", "from", from, "to", to)
+	s.link.sendEvent(StateEvent{
+		Session: s,
+		From:    from,
+		To:      to,
+		Err:     err,
+	})
+	return true
+}
+
+// finish moves the session into its final state, whatever state it is
+// currently in.
+func (s *LinkSession) finish(to SessionState, err error) {
+	for {
+		from := s.State()
+		if from.isFinal() {
+			return
+		}
+		if s.transition(from, to, err) {
+			return
+		}
+	}
+}
@@ -0,0 +1,91 @@
+package link
+
+import (
+	"errors"
+	"net"
+	"testing"
+	"time"
+)
+
+func connectedSessions(t *testing.T, l1, l2 *Link) (*LinkSession, *LinkSession) {
+	accepted := make(chan net.Conn, 1)
+	go func() {
+		con, err := l1.Accept()
+		if err != nil {
+			t.Error(err)
+		}
+		accepted <- con
+	}()
+
+	con, err := l2.Dial()
+	if err != nil {
+		t.Fatal(err)
+	}
+	acon := <-accepted
+	if acon == nil {
+		t.FailNow()
+	}
+	return acon.(*LinkSession), con.(*LinkSession)
+}
+
+func expectEvent(t *testing.T, ch chan StateEvent, s *LinkSession, from, to SessionState) StateEvent {
+	select {
+	case ev := <-ch:
+		if ev.Session != s || ev.From != from || ev.To != to {
+			t.Fatalf("expected %s -> %s, got %s -> %s", from, to, ev.From, ev.To)
+		}
+		return ev
+	case <-time.After(2 * time.Second):
+		t.Fatalf("timeout waiting for %s -> %s", from, to)
+	}
+	panic("unreachable")
+}
+
+func TestSessionStateClose(t *testing.T) {
+	l1, l2 := Pipe(PipeConfig{})
+	defer l1.Close()
+	defer l2.Close()
+
+	ev1 := make(chan StateEvent, 10)
+	ev2 := make(chan StateEvent, 10)
+	l1.Notify(ev1)
+	l2.Notify(ev2)
+
+	s1, s2 := connectedSessions(t, l1, l2)
+	expectEvent(t, ev1, s1, CONNECTING, ESTABLISHED)
+	expectEvent(t, ev2, s2, CONNECTING, ESTABLISHED)
+
+	s2.Close()
+	expectEvent(t, ev2, s2, ESTABLISHED, CLOSING)
+	expectEvent(t, ev2, s2, CLOSING, CLOSED)
+	ev := expectEvent(t, ev1, s1, ESTABLISHED, CLOSED)
+	if ev.Err != ErrPeerClosed {
+		t.Fatal("expected peer close", ev.Err)
+	}
+	if s1.State() != CLOSED || s2.State() != CLOSED {
+		t.Fatal("bad final states", s1.State(), s2.State())
+	}
+}
+
+func TestSessionStateLost(t *testing.T) {
+	l1, l2 := Pipe(PipeConfig{})
+	defer l2.Close()
+
+	ev1 := make(chan StateEvent, 10)
+	l1.Notify(ev1)
+
+	s1, _ := connectedSessions(t, l1, l2)
+	expectEvent(t, ev1, s1, CONNECTING, ESTABLISHED)
+
+	l1.Close()
+	ev := expectEvent(t, ev1, s1, ESTABLISHED, LOST)
+	if !errors.Is(ev.Err, ErrLinkDown) {
+		t.Fatal("expected the link failure as cause", ev.Err)
+	}
+
+	select {
+	case <-l1.Done():
+	default:
+		t.Fatal("link should be down")
+	}
+}
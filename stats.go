@@ -0,0 +1,97 @@
+package link
+
+import (
+	"time"
+)
+
+// LinkStats counts the traffic seen by a Link, across all sessions.
+type LinkStats struct {
+	FramesSent     uint64
+	FramesReceived uint64
+	// Bytes written to and read from the underlying transport, including
+	// framing, checksums and frames that failed to decode.
+	WireBytesSent     uint64
+	WireBytesReceived uint64
+	// Bytes carried in the payload of DATA frames.
+	PayloadBytesSent     uint64
+	PayloadBytesReceived uint64
+	// Frames dropped by readMessages because their checksum did not match.
+	ChecksumFailures uint64
+	// Frames dropped by readMessages for any other decoding problem.
+	DecodeErrors uint64
+	// Datagrams sent and received on any association, and received ones
+	// dropped because nobody was reading them fast enough or they
+	// belonged to no association.
+	DatagramsSent     uint64
+	DatagramsReceived uint64
+	DatagramsDropped  uint64
+}
+
+// frameErrors is the total number of received frames that were dropped.
+func (st LinkStats) frameErrors() uint64 {
+	return st.ChecksumFailures + st.DecodeErrors
+}
+
+// SessionStats counts the traffic of a single LinkSession and reports
+// its current send state.
+type SessionStats struct {
+	PayloadBytesSent     uint64
+	PayloadBytesReceived uint64
+	DataFramesSent       uint64
+	// DATA frames that had to be sent again because no ack arrived.
+	Retransmissions uint64
+	// DATA frames received that had already been delivered.
+	DuplicateFrames uint64
+	// DATA frames dropped because the read buffer was full.
+	BufferFullDrops uint64
+	// Messages dropped because the session had not taken the earlier ones
+	// from the link.
+	InboxDrops uint64
+
+	// Smoothed round trip time between sending a DATA frame and receiving
+	// its ack. Zero until the first DATA frame has been acked.
+	RTT time.Duration
+	// How long the next DATA frame is given to be acked before it is
+	// sent again, see Config.RetransmitTimeout.
+	RetransmitTimeout time.Duration
+	// Size of the next DATA segment Write will send.
+	SegmentSize int
+	// Sequence number of the next DATA frame to send.
+	SendSeqnum uint
+	// Sequence number of the next DATA frame expected from the peer.
+	RecvSeqnum uint
+	// Payload bytes sent but not yet acked.
+	Unacked int
+	// Bytes received but not yet read, and the room left for more.
+	Buffered int
+	Window   int
+}
+
+// Stats returns a snapshot of the link counters.
+func (link *Link) Stats() LinkStats {
+	link.statsLock.Lock()
+	defer link.statsLock.Unlock()
+	return link.stats
+}
+
+// Stats returns a snapshot of the session counters.
+func (s *LinkSession) Stats() SessionStats {
+	s.statsLock.Lock()
+	st := s.stats
+	s.statsLock.Unlock()
+	st.Buffered = s.readBuff.Len()
+	st.Window = s.readBuff.Available()
+	return st
+}
+
+func (link *Link) updateStats(f func(st *LinkStats)) {
+	link.statsLock.Lock()
+	f(&link.stats)
+	link.statsLock.Unlock()
+}
+
+func (s *LinkSession) updateStats(f func(st *SessionStats)) {
+	s.statsLock.Lock()
+	f(&s.stats)
+	s.statsLock.Unlock()
+}
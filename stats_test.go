@@ -0,0 +1,79 @@
+package link
+
+import (
+	"io"
+	"testing"
+	"time"
+)
+
+func TestStats(t *testing.T) {
+	l1, l2 := Pipe(PipeConfig{})
+	defer l1.Close()
+	defer l2.Close()
+
+	accepted := make(chan *LinkSession, 1)
+	go func() {
+		con, err := l1.Accept()
+		if err != nil {
+			t.Error(err)
+			accepted <- nil
+			return
+		}
+		accepted <- con.(*LinkSession)
+	}()
+
+	con, err := l2.Dial()
+	if err != nil {
+		t.Fatal(err)
+	}
+	s2 := con.(*LinkSession)
+	s1 := <-accepted
+	if s1 == nil {
+		t.FailNow()
+	}
+
+	data := make([]byte, 1000)
+	_, err = s2.Write(data)
+	if err != nil {
+		t.Fatal(err)
+	}
+	// Write returns once everything is acked, so it is all buffered.
+	st := s1.Stats()
+	if st.Buffered != 1000 || st.Window != 1024*1024-1000 {
+		t.Fatal("bad receive window", st)
+	}
+	_, err = io.ReadFull(s1, data)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	st = s2.Stats()
+	if st.PayloadBytesSent != 1000 || st.DataFramesSent < 1 {
+		t.Fatal("bad send stats", st)
+	}
+	if st.RTT <= 0 || st.RTT > time.Second {
+		t.Fatal("bad rtt", st.RTT)
+	}
+	if st.RetransmitTimeout < DefaultConfig().RetransmitTimeout || st.RetransmitTimeout < st.RTT {
+		t.Fatal("the retransmit timeout should follow the rtt", st)
+	}
+	if st.SendSeqnum != firstSeqnum+uint(st.DataFramesSent-st.Retransmissions) {
+		t.Fatal("bad seqnum", st)
+	}
+	if st.Unacked != 0 {
+		t.Fatal("nothing should be in flight", st)
+	}
+
+	st = s1.Stats()
+	if st.PayloadBytesReceived != 1000 || st.RecvSeqnum != s2.Stats().SendSeqnum {
+		t.Fatal("bad receive stats", st)
+	}
+
+	ls := l2.Stats()
+	if ls.PayloadBytesSent < 1000 || ls.WireBytesSent <= ls.PayloadBytesSent {
+		t.Fatal("bad link stats", ls)
+	}
+	if ls.ChecksumFailures != 0 || ls.DecodeErrors != 0 {
+		t.Fatal("unexpected frame errors", ls)
+	}
+}